@@ -0,0 +1,81 @@
+package cmdexec
+
+import (
+	_ "embed"
+	"fmt"
+
+	"github.com/dop251/goja"
+)
+
+//go:embed assert.js
+var assertCore string
+
+// TestResult is the outcome of a single `l2.test()`
+// call, or of an `expect()` failing outside of one
+type TestResult struct {
+	Name   string `json:"name"`
+	Passed bool   `json:"passed"`
+	Error  string `json:"error,omitempty"`
+}
+
+// EnableAssertions installs `expect()` and `l2.test()`
+// into the given runtime
+func EnableAssertions(vm *goja.Runtime) error {
+	if _, err := vm.RunString(assertCore); err != nil {
+		return fmt.Errorf("couldn't load the assertion helpers: %w", err)
+	}
+	return nil
+}
+
+// RunProcessorCode executes a processor block and returns
+// its errors. The exception is an `expect()` failing outside
+// of `l2.test()`, which is recorded as a failed test (rather
+// than returned) and ends the block. Like RunVMCode, the
+// block runs on the event loop of the VM
+func RunProcessorCode(jsCode string, vm *goja.Runtime) error {
+	err := runScript(vm, jsCode)
+	if err == nil {
+		return nil
+	}
+	if obj, ok := thrownValue(err).(*goja.Object); ok && obj.Get("name") != nil && obj.Get("name").String() == "AssertionError" {
+		recordTestResult(vm, "expect", false, obj.Get("message").String())
+		return nil
+	}
+	return scriptError(err)
+}
+
+func recordTestResult(vm *goja.Runtime, name string, passed bool, message string) {
+	l2 := vm.Get("l2").ToObject(vm)
+	results := l2.Get("_results").ToObject(vm)
+	push, _ := goja.AssertFunction(results.Get("push"))
+	entry := map[string]interface{}{"name": name, "passed": passed, "error": message}
+	push(results, vm.ToValue(entry))
+}
+
+// CollectTestResults returns the test results recorded
+// since the previous call, and clears them from the VM
+func CollectTestResults(vm *goja.Runtime) []TestResult {
+	res := make([]TestResult, 0)
+	l2Val := vm.Get("l2")
+	if l2Val == nil {
+		return res
+	}
+	l2 := l2Val.ToObject(vm)
+	raw, ok := l2.Get("_results").Export().([]interface{})
+	if !ok {
+		return res
+	}
+	for _, r := range raw {
+		entry, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		tr := TestResult{}
+		tr.Name, _ = entry["name"].(string)
+		tr.Passed, _ = entry["passed"].(bool)
+		tr.Error, _ = entry["error"].(string)
+		res = append(res, tr)
+	}
+	l2.Set("_results", vm.NewArray())
+	return res
+}
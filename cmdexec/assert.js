@@ -0,0 +1,147 @@
+// Assertion helpers for processor blocks. The script is
+// evaluated in every VM created through GetJSVm and sets up:
+//
+//   expect(actual).toBe(expected)     // and friends, with .not
+//   l2.test("name", function () {})  // named, recorded checks
+//   l2.test("name", async () => {})   // awaited by the event loop
+//
+// Results of l2.test() calls accumulate in l2._results,
+// which the Go side drains after each processor block.
+(function (global) {
+  function AssertionError(message) {
+    this.name = "AssertionError";
+    this.message = message;
+  }
+  AssertionError.prototype = Object.create(Error.prototype);
+  AssertionError.prototype.constructor = AssertionError;
+
+  function show(value) {
+    if (typeof value === "string") {
+      return JSON.stringify(value);
+    }
+    try {
+      const s = JSON.stringify(value);
+      return s === undefined ? String(value) : s;
+    } catch (e) {
+      return String(value);
+    }
+  }
+
+  function deepEqual(a, b) {
+    if (a === b) {
+      return true;
+    }
+    if (a !== a && b !== b) {
+      return true; // NaN
+    }
+    if (a === null || b === null || typeof a !== "object" || typeof b !== "object") {
+      return false;
+    }
+    if (Array.isArray(a) !== Array.isArray(b)) {
+      return false;
+    }
+    const keysA = Object.keys(a);
+    const keysB = Object.keys(b);
+    if (keysA.length !== keysB.length) {
+      return false;
+    }
+    for (const k of keysA) {
+      if (!Object.prototype.hasOwnProperty.call(b, k) || !deepEqual(a[k], b[k])) {
+        return false;
+      }
+    }
+    return true;
+  }
+
+  function lookupPath(obj, path) {
+    const parts = Array.isArray(path) ? path : String(path).split(".");
+    let cur = obj;
+    for (const p of parts) {
+      if (cur === null || cur === undefined || !(p in Object(cur))) {
+        return { found: false };
+      }
+      cur = cur[p];
+    }
+    return { found: true, value: cur };
+  }
+
+  function matchers(actual, negate) {
+    function check(pass, verb, expected, hasExpected) {
+      if (pass !== negate) {
+        return;
+      }
+      let msg = "expected " + show(actual) + (negate ? " not " : " ") + verb;
+      if (hasExpected) {
+        msg += " " + show(expected);
+      }
+      throw new AssertionError(msg);
+    }
+
+    return {
+      toBe: (e) => check(actual === e || (actual !== actual && e !== e), "to be", e, true),
+      toEqual: (e) => check(deepEqual(actual, e), "to equal", e, true),
+      toBeTruthy: () => check(!!actual, "to be truthy"),
+      toBeFalsy: () => check(!actual, "to be falsy"),
+      toBeNull: () => check(actual === null, "to be null"),
+      toBeDefined: () => check(actual !== undefined, "to be defined"),
+      toBeUndefined: () => check(actual === undefined, "to be undefined"),
+      toBeGreaterThan: (e) => check(actual > e, "to be greater than", e, true),
+      toBeGreaterThanOrEqual: (e) => check(actual >= e, "to be greater than or equal to", e, true),
+      toBeLessThan: (e) => check(actual < e, "to be less than", e, true),
+      toBeLessThanOrEqual: (e) => check(actual <= e, "to be less than or equal to", e, true),
+      toContain: (e) =>
+        check(
+          actual !== null && actual !== undefined && typeof actual.indexOf === "function" && actual.indexOf(e) !== -1,
+          "to contain",
+          e,
+          true
+        ),
+      toMatch: (e) => check(typeof actual === "string" && (e instanceof RegExp ? e.test(actual) : actual.indexOf(e) !== -1), "to match", String(e), true),
+      toHaveLength: (e) => check(actual !== null && actual !== undefined && actual.length === e, "to have length", e, true),
+      toHaveProperty: function (path, value) {
+        const res = lookupPath(actual, path);
+        if (arguments.length > 1) {
+          check(res.found && deepEqual(res.value, value), "to have property " + path + " equal to", value, true);
+        } else {
+          check(res.found, "to have property", path, true);
+        }
+      },
+    };
+  }
+
+  function expect(actual) {
+    const m = matchers(actual, false);
+    m.not = matchers(actual, true);
+    return m;
+  }
+
+  const l2 = global.l2 || {};
+  Object.defineProperty(l2, "_results", { value: [], writable: true, enumerable: false });
+  function failed(name, e) {
+    const message = e && e.message !== undefined ? e.message : String(e);
+    l2._results.push({ name: String(name), passed: false, error: message });
+  }
+
+  // An async test function is recorded once its promise
+  // settles, which the returned promise lets callers await
+  l2.test = function (name, fn) {
+    let res;
+    try {
+      res = fn();
+    } catch (e) {
+      failed(name, e);
+      return;
+    }
+    if (res && typeof res.then === "function") {
+      return res.then(
+        () => { l2._results.push({ name: String(name), passed: true }); },
+        (e) => failed(name, e)
+      );
+    }
+    l2._results.push({ name: String(name), passed: true });
+  };
+
+  global.l2 = l2;
+  global.expect = expect;
+  global.AssertionError = AssertionError;
+})(this);
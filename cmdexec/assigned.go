@@ -0,0 +1,113 @@
+package cmdexec
+
+import (
+	"reflect"
+
+	"github.com/dop251/goja/ast"
+	"github.com/dop251/goja/parser"
+	"github.com/dop251/goja/token"
+)
+
+// AssignedNames returns the names which the code of a
+// processor block may set: those it declares or assigns
+// (`let TOKEN = ...`, `({TOKEN} = res)`, `globalThis.TOKEN =
+// ...`, `TOKEN++`), and those it passes to a `set()` method,
+// such as `l2.session.set('TOKEN', ...)`. Names merely
+// mentioned, as in a comment, don't count. False is
+// returned for code which doesn't parse
+func AssignedNames(code string) (map[string]bool, bool) {
+	prog, err := parser.ParseFile(nil, "", code, 0)
+	if err != nil {
+		// Code with a top-level await parses as the body of
+		// an async function (see asyncWrap)
+		if prog, err = parser.ParseFile(nil, "", "(async function () {"+code+"\n})()", 0); err != nil {
+			return nil, false
+		}
+	}
+	names := make(map[string]bool)
+	add := func(target ast.Node) {
+		for _, name := range boundNames(target) {
+			names[name] = true
+		}
+	}
+	walkAST(reflect.ValueOf(prog), func(node ast.Node) {
+		switch n := node.(type) {
+		case *ast.Binding:
+			add(n.Target)
+		case *ast.FunctionDeclaration:
+			add(n.Function.Name)
+		case *ast.ClassDeclaration:
+			add(n.Class.Name)
+		case *ast.AssignExpression:
+			if name, ok := globalMember(n.Left); ok {
+				names[name] = true
+			} else {
+				add(n.Left)
+			}
+		case *ast.UnaryExpression:
+			if n.Operator == token.INCREMENT || n.Operator == token.DECREMENT {
+				add(n.Operand)
+			}
+		case *ast.CallExpression:
+			if dot, ok := n.Callee.(*ast.DotExpression); ok && dot.Identifier.Name == "set" && len(n.ArgumentList) > 0 {
+				if s, ok := n.ArgumentList[0].(*ast.StringLiteral); ok {
+					names[s.Value.String()] = true
+				}
+			}
+		}
+	})
+	return names, true
+}
+
+// globalMember returns the name of a property set on the
+// global object, as in `globalThis.NAME` or `this['NAME']`
+func globalMember(expr ast.Expression) (string, bool) {
+	var left ast.Expression
+	var name string
+	switch e := expr.(type) {
+	case *ast.DotExpression:
+		left, name = e.Left, e.Identifier.Name.String()
+	case *ast.BracketExpression:
+		s, ok := e.Member.(*ast.StringLiteral)
+		if !ok {
+			return "", false
+		}
+		left, name = e.Left, s.Value.String()
+	default:
+		return "", false
+	}
+	switch l := left.(type) {
+	case *ast.ThisExpression:
+		return name, true
+	case *ast.Identifier:
+		return name, l.Name == "globalThis" || l.Name == "window"
+	}
+	return "", false
+}
+
+// walkAST calls `visit` on every node of the syntax tree
+// held by `v`
+func walkAST(v reflect.Value, visit func(ast.Node)) {
+	switch v.Kind() {
+	case reflect.Interface:
+		if !v.IsNil() {
+			walkAST(v.Elem(), visit)
+		}
+	case reflect.Ptr:
+		if v.IsNil() || !v.CanInterface() || v.Elem().Kind() != reflect.Struct || v.Elem().Type().PkgPath() != reflect.TypeOf(ast.Program{}).PkgPath() {
+			return
+		}
+		if node, ok := v.Interface().(ast.Node); ok {
+			visit(node)
+		}
+		walkAST(v.Elem(), visit)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			walkAST(v.Field(i), visit)
+		}
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			walkAST(v.Index(i), visit)
+		}
+	}
+}
@@ -0,0 +1,376 @@
+package cmdexec
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+
+	"github.com/HexmosTech/lama2/preprocess"
+	"github.com/dop251/goja"
+	"github.com/dop251/goja/ast"
+	"github.com/dop251/goja/parser"
+	"github.com/dop251/goja_nodejs/eventloop"
+)
+
+// loopState ties a runtime to the goja_nodejs event loop
+// which created it
+type loopState struct {
+	loop *eventloop.EventLoop
+	// setInterval and clearInterval are the functions of the
+	// loop itself, out of reach of scripts replacing them
+	setInterval, clearInterval goja.Callable
+	// err is the first exception thrown by a timer callback
+	// since the loop was last started
+	err error
+	// pending maps the timers and holds which may still
+	// run to the function clearing them
+	pending map[interface{}]goja.Callable
+	// generation changes whenever the pending timers are
+	// dropped, so that the `fetch()` calls of a failed block
+	// don't settle in the blocks which follow
+	generation int
+}
+
+// EnableEventLoop makes scripts run through RunVMCode and
+// RunProcessorCode wait for the timers (`setTimeout()` and
+// `setInterval()`) and the `fetch()` calls they start, as
+// Node would. `vm` must be the runtime of `loop`, and the
+// `l2` object must exist (see EnableAssertions)
+func EnableEventLoop(vm *goja.Runtime, loop *eventloop.EventLoop) {
+	st := &loopState{loop: loop, pending: make(map[interface{}]goja.Callable)}
+	st.setInterval, _ = goja.AssertFunction(vm.Get("setInterval"))
+	st.clearInterval, _ = goja.AssertFunction(vm.Get("clearInterval"))
+
+	// The loop drops the exceptions of timer callbacks; they
+	// end the block instead, like uncaught errors end Node
+	for _, t := range []struct {
+		set, clear string
+		repeating  bool
+	}{{"setTimeout", "clearTimeout", false}, {"setInterval", "clearInterval", true}} {
+		t := t
+		schedule, _ := goja.AssertFunction(vm.Get(t.set))
+		clear, _ := goja.AssertFunction(vm.Get(t.clear))
+		vm.Set(t.set, func(call goja.FunctionCall) goja.Value {
+			fn, ok := goja.AssertFunction(call.Argument(0))
+			if !ok {
+				panic(vm.NewTypeError("The \"callback\" argument must be of type function"))
+			}
+			var key interface{}
+			args := append([]goja.Value{vm.ToValue(func(c goja.FunctionCall) goja.Value {
+				if !t.repeating {
+					delete(st.pending, key)
+				}
+				if _, err := fn(goja.Undefined(), c.Arguments...); err != nil && st.err == nil {
+					st.err = err
+					loop.StopNoWait()
+				}
+				return goja.Undefined()
+			})}, call.Arguments[1:]...)
+			handle, err := schedule(goja.Undefined(), args...)
+			if err != nil {
+				panic(err)
+			}
+			key = handle.Export()
+			st.pending[key] = clear
+			return handle
+		})
+		vm.Set(t.clear, func(call goja.FunctionCall) goja.Value {
+			if handle := call.Argument(0); !goja.IsUndefined(handle) && !goja.IsNull(handle) {
+				delete(st.pending, handle.Export())
+			}
+			clear(goja.Undefined(), call.Arguments...)
+			return goja.Undefined()
+		})
+	}
+	l2 := vm.Get("l2").ToObject(vm)
+	l2.DefineDataProperty("_loop", vm.ToValue(st), goja.FLAG_FALSE, goja.FLAG_FALSE, goja.FLAG_FALSE)
+}
+
+// loopOf returns the loop state of `vm`, or nil for a
+// runtime without an event loop
+func loopOf(vm *goja.Runtime) *loopState {
+	l2 := vm.Get("l2")
+	if l2 == nil || goja.IsUndefined(l2) {
+		return nil
+	}
+	st, _ := l2.ToObject(vm).Get("_loop").Export().(*loopState)
+	return st
+}
+
+// hold keeps the loop running until the returned function
+// is called, which must happen on the loop
+func (st *loopState) hold(vm *goja.Runtime) func() {
+	handle, _ := st.setInterval(goja.Undefined(), vm.ToValue(func(goja.FunctionCall) goja.Value { return goja.Undefined() }), vm.ToValue(math.MaxInt32))
+	st.pending[handle.Export()] = st.clearInterval
+	return func() {
+		delete(st.pending, handle.Export())
+		st.clearInterval(goja.Undefined(), handle)
+	}
+}
+
+// drop clears the pending timers and holds, so that none
+// of them runs in the blocks which follow
+func (st *loopState) drop(vm *goja.Runtime) {
+	for key, clear := range st.pending {
+		clear(goja.Undefined(), vm.ToValue(key))
+	}
+	st.pending = make(map[interface{}]goja.Callable)
+	st.generation++
+}
+
+// runLoop calls `fn` on the event loop of `vm`, then runs
+// the loop until no timer or `fetch()` is pending. The first
+// exception of a timer callback is returned, unless `fn`
+// itself fails; either way, the timers and `fetch()` calls
+// still pending are then dropped
+func runLoop(vm *goja.Runtime, fn func() error) error {
+	st := loopOf(vm)
+	if st == nil {
+		return fn()
+	}
+	var err error
+	st.err = nil
+	st.loop.Run(func(*goja.Runtime) {
+		if err = fn(); err != nil {
+			st.loop.StopNoWait()
+		}
+	})
+	if err == nil {
+		err = st.err
+	}
+	st.err = nil
+	if err != nil {
+		st.drop(vm)
+	}
+	return err
+}
+
+// Interrupter returns a function interrupting the script
+// running in `vm` (see `goja.Runtime.Interrupt`) and stopping
+// its event loop, which abandons the pending timers. Unlike
+// `vm` itself, the function may be called from any goroutine
+func Interrupter(vm *goja.Runtime) func(v interface{}) {
+	st := loopOf(vm)
+	return func(v interface{}) {
+		vm.Interrupt(v)
+		if st != nil {
+			st.loop.StopNoWait()
+		}
+	}
+}
+
+// Rejection is the error of a script whose top-level
+// `await` was rejected; Value is the rejection reason
+type Rejection struct {
+	Value goja.Value
+}
+
+func (r *Rejection) Error() string {
+	if obj, ok := r.Value.(*goja.Object); ok {
+		if stack := obj.Get("stack"); stack != nil && !goja.IsUndefined(stack) {
+			return stack.String()
+		}
+	}
+	return r.Value.String()
+}
+
+// thrownValue returns the JS value thrown by a script,
+// or nil if `err` isn't a JS exception
+func thrownValue(err error) goja.Value {
+	switch e := err.(type) {
+	case *goja.Exception:
+		return e.Value()
+	case *Rejection:
+		return e.Value
+	}
+	return nil
+}
+
+// scriptError formats the error of a script for the user
+func scriptError(err error) error {
+	if ex, ok := err.(*goja.Exception); ok {
+		return fmt.Errorf("%s", ex.String())
+	}
+	if r, ok := err.(*Rejection); ok {
+		return fmt.Errorf("%s", r.Error())
+	}
+	return err
+}
+
+// runScript runs `code` on the event loop of `vm` (see
+// runLoop). Code with a top-level `await` is run as the
+// body of an async function (see asyncWrap), and awaited.
+// The names it assigns become available to the bare `$name`
+// form of the request blocks (see preprocess.MarkAssigned)
+func runScript(vm *goja.Runtime, code string) error {
+	if names, ok := AssignedNames(code); ok {
+		preprocess.MarkAssigned(vm, names)
+	}
+	script, names, async := asyncWrap(code)
+	var val goja.Value
+	err := runLoop(vm, func() error {
+		var err error
+		val, err = vm.RunString(script)
+		return err
+	})
+	if err != nil || !async {
+		return err
+	}
+	if err := awaited(val); err != nil {
+		return err
+	}
+	return exportNames(vm, names, val.Export().(*goja.Promise).Result())
+}
+
+// awaited returns the error of a promise which, once the
+// loop ran (see runLoop), was rejected or is still pending.
+// Values other than promises are fine
+func awaited(val goja.Value) error {
+	if val == nil {
+		return nil
+	}
+	p, ok := val.Export().(*goja.Promise)
+	if !ok {
+		return nil
+	}
+	switch p.State() {
+	case goja.PromiseStateRejected:
+		return &Rejection{Value: p.Result()}
+	case goja.PromiseStatePending:
+		return fmt.Errorf("awaiting a promise which never settles")
+	}
+	return nil
+}
+
+// asyncWrap returns the script running `code`. Code which
+// doesn't parse, but would as the body of an async function
+// (that is, which has a top-level `await`), is wrapped in
+// one, and true is returned along with the names it declares
+// at its top level. The function resolves to an object of
+// their values, as exportNames expects
+func asyncWrap(code string) (string, []string, bool) {
+	if _, err := parser.ParseFile(nil, "", code, 0); err == nil || !strings.Contains(code, "await") {
+		return code, nil, false
+	}
+	// The first line stays the first line, for error locations
+	wrapped := "(async function () {" + code + "\n})()"
+	prog, err := parser.ParseFile(nil, "", wrapped, 0)
+	if err != nil {
+		return code, nil, false
+	}
+	fn, ok := wrappedFunction(prog)
+	if !ok {
+		return code, nil, false
+	}
+	seen := make(map[string]bool)
+	add := func(target ast.Node) {
+		for _, name := range boundNames(target) {
+			seen[name] = true
+		}
+	}
+	for _, decl := range fn.DeclarationList {
+		for _, b := range decl.List {
+			add(b.Target)
+		}
+	}
+	for _, stmt := range fn.Body.List {
+		switch s := stmt.(type) {
+		case *ast.LexicalDeclaration:
+			for _, b := range s.List {
+				add(b.Target)
+			}
+		case *ast.FunctionDeclaration:
+			add(s.Function.Name)
+		case *ast.ClassDeclaration:
+			add(s.Class.Name)
+		}
+	}
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return "(async function () {" + code + "\n;return {" + strings.Join(names, ", ") + "}\n})()", names, true
+}
+
+// wrappedFunction returns the function literal of the
+// script built by asyncWrap
+func wrappedFunction(prog *ast.Program) (*ast.FunctionLiteral, bool) {
+	if len(prog.Body) != 1 {
+		return nil, false
+	}
+	stmt, ok := prog.Body[0].(*ast.ExpressionStatement)
+	if !ok {
+		return nil, false
+	}
+	call, ok := stmt.Expression.(*ast.CallExpression)
+	if !ok {
+		return nil, false
+	}
+	fn, ok := call.Callee.(*ast.FunctionLiteral)
+	return fn, ok
+}
+
+// boundNames lists the identifiers bound by a declaration
+// target, including those of destructuring patterns
+func boundNames(target ast.Node) []string {
+	switch t := target.(type) {
+	case *ast.Identifier:
+		if t == nil {
+			return nil
+		}
+		return []string{t.Name.String()}
+	case *ast.ObjectPattern:
+		var names []string
+		for _, prop := range t.Properties {
+			switch p := prop.(type) {
+			case *ast.PropertyShort:
+				names = append(names, p.Name.Name.String())
+			case *ast.PropertyKeyed:
+				names = append(names, boundNames(p.Value)...)
+			}
+		}
+		if t.Rest != nil {
+			names = append(names, boundNames(t.Rest)...)
+		}
+		return names
+	case *ast.ArrayPattern:
+		var names []string
+		for _, el := range t.Elements {
+			if el != nil {
+				names = append(names, boundNames(el)...)
+			}
+		}
+		if t.Rest != nil {
+			names = append(names, boundNames(t.Rest)...)
+		}
+		return names
+	case *ast.AssignExpression:
+		return boundNames(t.Left)
+	}
+	return nil
+}
+
+// exportNames assigns the values declared by an async block
+// to the global names, so that the blocks which follow see
+// them as they would those of a synchronous block
+func exportNames(vm *goja.Runtime, names []string, values goja.Value) error {
+	obj, ok := values.(*goja.Object)
+	if len(names) == 0 || !ok {
+		return nil
+	}
+	var sb strings.Builder
+	sb.WriteString("(function (values) {")
+	for _, name := range names {
+		fmt.Fprintf(&sb, " %s = values.%s;", name, name)
+	}
+	sb.WriteString(" })")
+	assign, err := vm.RunString(sb.String())
+	if err != nil {
+		return err
+	}
+	fn, _ := goja.AssertFunction(assign)
+	_, err = fn(goja.Undefined(), obj)
+	return err
+}
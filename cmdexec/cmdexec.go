@@ -5,30 +5,140 @@
 package cmdexec
 
 import (
-	"errors"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
 	"os"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/HexmosTech/gabs/v2"
 	"github.com/HexmosTech/httpie-go"
+	"github.com/HexmosTech/lama2/cmdgen"
+	"github.com/HexmosTech/lama2/lama2cmd"
 	"github.com/HexmosTech/lama2/utils"
 	"github.com/rs/zerolog/log"
 )
 
+// execMu serializes ExecCommand
+var execMu sync.Mutex
+
 // ExecCommand changes directory to the given `apiDir`
 // and then executes the command specified in `cmdStr`
 // During command execution, ExecCommand streams output
 // to stdout.
 // Once execution finishes, previous CWD is restored,
-// and the command output is returned as a string
+// and the command output is returned as a string.
+// The CWD belongs to the whole process, so commands run
+// one at a time; a call waits for the one in progress,
+// including one abandoned by HTTPieExecutor.Execute
 func ExecCommand(cmdSlice []string, stdinBody string, apiDir string) (httpie.ExResponse, error) {
+	execMu.Lock()
+	defer execMu.Unlock()
 	oldDir, _ := os.Getwd()
 	utils.ChangeWorkingDir(apiDir)
+	defer utils.ChangeWorkingDir(oldDir)
 	resp, err := httpie.Lama2Entry(cmdSlice, strings.NewReader(stdinBody))
 	if err != nil {
-		log.Fatal().Str("Error from the API executor", err.Error()).Msg("")
-		return httpie.ExResponse{}, errors.New("Error from API executor: " + err.Error())
+		// Wrapped, so that a network error (a `net.Error`) can
+		// still be told apart, e.g. to retry the request
+		return httpie.ExResponse{}, fmt.Errorf("Error from API executor: %w", err)
 	}
 	log.Debug().Str("Response body from API executor", resp.Body).Msg("")
-	utils.ChangeWorkingDir(oldDir)
 	return resp, nil
 }
+
+// HTTPieExecutor is the original Executor backend. It
+// flattens the block into HTTPie-style arguments through
+// `cmdgen` and hands them over to the forked httpie-go
+type HTTPieExecutor struct {
+	Opts *lama2cmd.Opts
+}
+
+// Execute generates the HTTPie command for `block` and
+// runs it through ExecCommand. HTTPie only reports the
+// flattened headers, so the request details are taken
+// from the block itself. HTTPie can't be interrupted; when
+// `ctx` is done first, the command is left to finish in
+// the background (holding back the commands which follow,
+// see ExecCommand) and the context error is returned
+func (h *HTTPieExecutor) Execute(ctx context.Context, block *gabs.Container, apiDir string) (Response, error) {
+	cmd, stdinBody, err := cmdgen.ConstructCommand(block, h.Opts)
+	if err != nil {
+		return Response{}, err
+	}
+	jar := CookieJarFrom(ctx)
+	var jarURL *url.URL
+	if jar != nil {
+		jarURL, cmd = addJarCookies(jar, block, cmd)
+	}
+	log.Debug().Str("Stdin Body to be passed into httpie", stdinBody).Msg("")
+	start := time.Now()
+	type outcome struct {
+		ex  httpie.ExResponse
+		err error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		ex, err := ExecCommand(cmd, stdinBody, apiDir)
+		done <- outcome{ex, err}
+	}()
+	var ex httpie.ExResponse
+	select {
+	case <-ctx.Done():
+		return Response{}, ctx.Err()
+	case out := <-done:
+		if out.err != nil {
+			return Response{}, out.err
+		}
+		ex = out.ex
+	}
+	resp := NewResponse(ex)
+	resp.Elapsed = time.Since(start)
+	if jarURL != nil {
+		jar.SetCookies(jarURL, resp.Cookies)
+	}
+	resp.URL = block.S("url", "value").Data().(string)
+	resp.Request = RequestInfo{
+		Method:  strings.ToUpper(block.S("verb", "value").Data().(string)),
+		URL:     resp.URL,
+		Headers: make(http.Header),
+		Body:    stdinBody,
+	}
+	if headers := block.S("details", "headers"); headers != nil {
+		for key, val := range unwrapContainer(headers).ChildrenMap() {
+			resp.Request.Headers.Add(key, valueString(val))
+		}
+	}
+	return resp, nil
+}
+
+// addJarCookies adds the cookies of `jar` matching the
+// request URL to the `Cookie` header argument of an HTTPie
+// command, and returns that URL (nil if it's invalid)
+func addJarCookies(jar *CookieJar, block *gabs.Container, cmd []string) (*url.URL, []string) {
+	rawURL := block.S("url", "value").Data().(string)
+	if !reScheme.MatchString(rawURL) {
+		rawURL = "http://" + rawURL
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, cmd
+	}
+	pairs := make([]string, 0)
+	for _, c := range jar.Cookies(u) {
+		pairs = append(pairs, c.String())
+	}
+	if len(pairs) == 0 {
+		return u, cmd
+	}
+	for i, arg := range cmd {
+		if len(arg) > len("cookie:") && strings.EqualFold(arg[:len("cookie:")], "cookie:") {
+			cmd[i] = arg + "; " + strings.Join(pairs, "; ")
+			return u, cmd
+		}
+	}
+	return u, append(cmd, "Cookie:"+strings.Join(pairs, "; "))
+}
@@ -0,0 +1,383 @@
+package cmdexec
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// StoredCookie is a cookie as kept by a CookieJar, with
+// the attributes needed to decide which requests get it
+type StoredCookie struct {
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Domain string `json:"domain"`
+	// HostOnly cookies (set without a Domain attribute) are
+	// only sent to Domain itself, not to its subdomains
+	HostOnly bool   `json:"hostOnly"`
+	Path     string `json:"path"`
+	// Expires is zero for session cookies
+	Expires  time.Time `json:"expires,omitempty"`
+	Secure   bool      `json:"secure"`
+	HttpOnly bool      `json:"httpOnly"`
+}
+
+func (c StoredCookie) expired(now time.Time) bool {
+	return !c.Expires.IsZero() && !c.Expires.After(now)
+}
+
+func (c StoredCookie) matches(u *url.URL) bool {
+	host := strings.ToLower(u.Hostname())
+	if c.HostOnly {
+		if host != c.Domain {
+			return false
+		}
+	} else if host != c.Domain && !strings.HasSuffix(host, "."+c.Domain) {
+		return false
+	}
+	if c.Secure && u.Scheme != "https" {
+		return false
+	}
+	path := u.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	return path == c.Path || strings.HasPrefix(path, strings.TrimSuffix(c.Path, "/")+"/")
+}
+
+// CookieJar is an `http.CookieJar` which, unlike the one
+// of `net/http/cookiejar`, can list its cookies, so that
+// they can be shown to processor blocks and saved to a file
+// (see LoadCookieJar). It is safe for concurrent use
+type CookieJar struct {
+	mu      sync.Mutex
+	cookies []StoredCookie
+}
+
+// NewCookieJar returns an empty CookieJar
+func NewCookieJar() *CookieJar {
+	return &CookieJar{}
+}
+
+// defaultPath is the default cookie path of RFC 6265
+func defaultPath(u *url.URL) string {
+	path := u.EscapedPath()
+	i := strings.LastIndex(path, "/")
+	if !strings.HasPrefix(path, "/") || i <= 0 {
+		return "/"
+	}
+	return path[:i]
+}
+
+// SetCookies stores the cookies received in
+// response to a request for `u`
+func (j *CookieJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	now := time.Now()
+	host := strings.ToLower(u.Hostname())
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, c := range cookies {
+		sc := StoredCookie{Name: c.Name, Value: c.Value, Domain: host, HostOnly: true, Path: c.Path, Secure: c.Secure, HttpOnly: c.HttpOnly}
+		if c.Domain != "" {
+			domain := strings.ToLower(strings.TrimPrefix(c.Domain, "."))
+			// A host may only set cookies for itself or
+			// a parent domain; IP addresses have none
+			if host != domain && (net.ParseIP(host) != nil || !strings.HasSuffix(host, "."+domain)) {
+				continue
+			}
+			sc.Domain, sc.HostOnly = domain, false
+		}
+		if sc.Path == "" || !strings.HasPrefix(sc.Path, "/") {
+			sc.Path = defaultPath(u)
+		}
+		switch {
+		case c.MaxAge < 0:
+			sc.Expires = now.Add(-time.Second)
+		case c.MaxAge > 0:
+			sc.Expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		case !c.Expires.IsZero():
+			sc.Expires = c.Expires
+		}
+		j.store(sc, now)
+	}
+}
+
+// store replaces the cookie with the same name, domain and
+// path as `sc`, or adds it; expired cookies are dropped
+func (j *CookieJar) store(sc StoredCookie, now time.Time) {
+	kept := j.cookies[:0]
+	for _, c := range j.cookies {
+		if c.Name == sc.Name && c.Domain == sc.Domain && c.Path == sc.Path {
+			continue
+		}
+		kept = append(kept, c)
+	}
+	j.cookies = kept
+	if !sc.expired(now) {
+		j.cookies = append(j.cookies, sc)
+	}
+}
+
+// Cookies returns the cookies to send in a request
+// for `u`, the most specific paths first
+func (j *CookieJar) Cookies(u *url.URL) []*http.Cookie {
+	now := time.Now()
+	j.mu.Lock()
+	matching := make([]StoredCookie, 0)
+	for _, c := range j.cookies {
+		if !c.expired(now) && c.matches(u) {
+			matching = append(matching, c)
+		}
+	}
+	j.mu.Unlock()
+	sort.SliceStable(matching, func(a, b int) bool {
+		return len(matching[a].Path) > len(matching[b].Path)
+	})
+	res := make([]*http.Cookie, 0, len(matching))
+	for _, c := range matching {
+		res = append(res, &http.Cookie{Name: c.Name, Value: c.Value})
+	}
+	return res
+}
+
+// All returns the cookies held which haven't expired,
+// sorted by domain, path and name
+func (j *CookieJar) All() []StoredCookie {
+	now := time.Now()
+	j.mu.Lock()
+	res := make([]StoredCookie, 0, len(j.cookies))
+	for _, c := range j.cookies {
+		if !c.expired(now) {
+			res = append(res, c)
+		}
+	}
+	j.mu.Unlock()
+	sort.Slice(res, func(a, b int) bool {
+		if res[a].Domain != res[b].Domain {
+			return res[a].Domain < res[b].Domain
+		}
+		if res[a].Path != res[b].Path {
+			return res[a].Path < res[b].Path
+		}
+		return res[a].Name < res[b].Name
+	})
+	return res
+}
+
+// Restore adds cookies saved earlier (see All)
+func (j *CookieJar) Restore(cookies []StoredCookie) {
+	now := time.Now()
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, c := range cookies {
+		j.store(c, now)
+	}
+}
+
+// Delete removes the cookies called `name`
+// (for any domain and path)
+func (j *CookieJar) Delete(name string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	kept := j.cookies[:0]
+	for _, c := range j.cookies {
+		if c.Name != name {
+			kept = append(kept, c)
+		}
+	}
+	j.cookies = kept
+}
+
+// Clear removes every cookie
+func (j *CookieJar) Clear() {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.cookies = nil
+}
+
+// LoadCookieJar reads a cookie jar saved by Save. A `.json`
+// file holds an array of StoredCookie; any other file is in
+// the Netscape format used by curl and browsers. A missing
+// file yields an empty jar
+func LoadCookieJar(path string) (*CookieJar, error) {
+	jar := NewCookieJar()
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return jar, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if isJSONJar(path) {
+		if len(bytes.TrimSpace(content)) == 0 {
+			return jar, nil
+		}
+		if err := json.Unmarshal(content, &jar.cookies); err != nil {
+			return nil, fmt.Errorf("reading cookie jar %s: %w", path, err)
+		}
+	} else if jar.cookies, err = parseNetscapeCookies(content); err != nil {
+		return nil, fmt.Errorf("reading cookie jar %s: %w", path, err)
+	}
+	jar.cookies = jar.All()
+	return jar, nil
+}
+
+// Save writes the cookies which haven't expired to `path`,
+// in the format chosen by its extension (see LoadCookieJar)
+func (j *CookieJar) Save(path string) error {
+	cookies := j.All()
+	var content []byte
+	if isJSONJar(path) {
+		var err error
+		if content, err = json.MarshalIndent(cookies, "", "  "); err != nil {
+			return err
+		}
+	} else {
+		content = formatNetscapeCookies(cookies)
+	}
+	if dir := filepath.Dir(path); dir != "" {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(path, content, 0o600)
+}
+
+func isJSONJar(path string) bool {
+	return strings.EqualFold(filepath.Ext(path), ".json")
+}
+
+const httpOnlyPrefix = "#HttpOnly_"
+
+func netscapeBool(b bool) string {
+	if b {
+		return "TRUE"
+	}
+	return "FALSE"
+}
+
+// formatNetscapeCookies writes one tab separated line per
+// cookie: domain, subdomains flag, path, secure flag, expiry
+// (Unix time, 0 for session cookies), name and value
+func formatNetscapeCookies(cookies []StoredCookie) []byte {
+	var buf bytes.Buffer
+	buf.WriteString("# Netscape HTTP Cookie File\n# Written by lama2; edit at your own risk\n\n")
+	for _, c := range cookies {
+		domain := c.Domain
+		if !c.HostOnly {
+			domain = "." + domain
+		}
+		if c.HttpOnly {
+			domain = httpOnlyPrefix + domain
+		}
+		expires := int64(0)
+		if !c.Expires.IsZero() {
+			expires = c.Expires.Unix()
+		}
+		fmt.Fprintf(&buf, "%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			domain, netscapeBool(!c.HostOnly), c.Path, netscapeBool(c.Secure), expires, c.Name, c.Value)
+	}
+	return buf.Bytes()
+}
+
+func parseNetscapeCookies(content []byte) ([]StoredCookie, error) {
+	cookies := make([]StoredCookie, 0)
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		httpOnly := strings.HasPrefix(line, httpOnlyPrefix)
+		line = strings.TrimPrefix(line, httpOnlyPrefix)
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("line %d: expected 7 tab separated fields", n)
+		}
+		expires, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid expiry %q", n, fields[4])
+		}
+		c := StoredCookie{
+			Name:     fields[5],
+			Value:    fields[6],
+			Domain:   strings.ToLower(strings.TrimPrefix(fields[0], ".")),
+			HostOnly: fields[1] != "TRUE",
+			Path:     fields[2],
+			Secure:   fields[3] == "TRUE",
+			HttpOnly: httpOnly,
+		}
+		if expires > 0 {
+			c.Expires = time.Unix(expires, 0)
+		}
+		cookies = append(cookies, c)
+	}
+	return cookies, scanner.Err()
+}
+
+type cookieJarKey struct{}
+
+// WithCookieJar returns a context making executors send
+// the cookies of `jar` and store those they receive
+func WithCookieJar(ctx context.Context, jar *CookieJar) context.Context {
+	return context.WithValue(ctx, cookieJarKey{}, jar)
+}
+
+// CookieJarFrom returns the jar set through
+// WithCookieJar, or nil
+func CookieJarFrom(ctx context.Context) *CookieJar {
+	jar, _ := ctx.Value(cookieJarKey{}).(*CookieJar)
+	return jar
+}
+
+// BindCookieJar exposes `jar` to the processor blocks as
+// `l2.cookies`, with `all()`, `get(name)`, `delete(name)`
+// and `clear()`
+func BindCookieJar(vm *goja.Runtime, jar *CookieJar) {
+	cookies := vm.NewObject()
+	cookies.Set("all", func(call goja.FunctionCall) goja.Value {
+		all := jar.All()
+		res := make([]interface{}, 0, len(all))
+		for _, c := range all {
+			entry := map[string]interface{}{
+				"name":     c.Name,
+				"value":    c.Value,
+				"domain":   c.Domain,
+				"path":     c.Path,
+				"secure":   c.Secure,
+				"httpOnly": c.HttpOnly,
+				"expires":  nil,
+			}
+			if !c.Expires.IsZero() {
+				entry["expires"] = c.Expires.UTC().Format(time.RFC3339)
+			}
+			res = append(res, entry)
+		}
+		return vm.ToValue(res)
+	})
+	cookies.Set("get", func(name string) goja.Value {
+		for _, c := range jar.All() {
+			if c.Name == name {
+				return vm.ToValue(c.Value)
+			}
+		}
+		return goja.Undefined()
+	})
+	cookies.Set("delete", func(name string) { jar.Delete(name) })
+	cookies.Set("clear", func() { jar.Clear() })
+	vm.Get("l2").ToObject(vm).Set("cookies", cookies)
+}
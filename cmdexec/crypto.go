@@ -0,0 +1,57 @@
+package cmdexec
+
+import (
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"hash"
+
+	"github.com/dop251/goja"
+)
+
+var hashes = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// EnableCrypto installs `l2.crypto.hash(alg, data, encoding)`
+// and `l2.crypto.hmac(alg, key, data, encoding)`, for hooks
+// signing requests. `alg` is one of md5, sha1, sha256 and
+// sha512; the digest is encoded as `hex` (the default) or
+// `base64`. It must run after EnableAssertions, which creates
+// the `l2` object
+func EnableCrypto(vm *goja.Runtime) {
+	digest := func(alg string, encoding goja.Value, key []byte, data string) goja.Value {
+		newHash, ok := hashes[alg]
+		if !ok {
+			panic(vm.NewTypeError("l2.crypto: unknown algorithm '%s'; expected md5, sha1, sha256 or sha512", alg))
+		}
+		h := newHash()
+		if key != nil {
+			h = hmac.New(newHash, key)
+		}
+		h.Write([]byte(data))
+		sum := h.Sum(nil)
+		switch {
+		case goja.IsUndefined(encoding) || encoding.String() == "hex":
+			return vm.ToValue(hex.EncodeToString(sum))
+		case encoding.String() == "base64":
+			return vm.ToValue(base64.StdEncoding.EncodeToString(sum))
+		}
+		panic(vm.NewTypeError("l2.crypto: unknown encoding '%s'; expected hex or base64", encoding.String()))
+	}
+	crypto := vm.NewObject()
+	crypto.Set("hash", func(call goja.FunctionCall) goja.Value {
+		return digest(call.Argument(0).String(), call.Argument(2), nil, call.Argument(1).String())
+	})
+	crypto.Set("hmac", func(call goja.FunctionCall) goja.Value {
+		return digest(call.Argument(0).String(), call.Argument(3), []byte(call.Argument(1).String()), call.Argument(2).String())
+	})
+	vm.Get("l2").ToObject(vm).Set("crypto", crypto)
+}
@@ -0,0 +1,29 @@
+package cmdexec
+
+import (
+	"context"
+
+	"github.com/HexmosTech/gabs/v2"
+	"github.com/HexmosTech/lama2/lama2cmd"
+)
+
+// Executor sends the request described by a parsed
+// `Lama2File` block and returns the response (see
+// Response). The
+// `apiDir` is the directory of the API file; relative
+// paths (such as multipart files) are resolved against it.
+// Cancelling `ctx` (or reaching its deadline) abandons the
+// request
+type Executor interface {
+	Execute(ctx context.Context, block *gabs.Container, apiDir string) (Response, error)
+}
+
+// GetExecutor returns the Executor chosen by the user
+// through the `--executor` option. The native `net/http`
+// executor is used unless `httpie` is asked for explicitly
+func GetExecutor(o *lama2cmd.Opts) Executor {
+	if o.Executor == "httpie" {
+		return &HTTPieExecutor{Opts: o}
+	}
+	return NewNativeExecutor(o)
+}
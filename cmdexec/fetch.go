@@ -0,0 +1,184 @@
+package cmdexec
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HexmosTech/gabs/v2"
+	"github.com/HexmosTech/lama2/lama2cmd"
+	"github.com/dop251/goja"
+)
+
+// BindFetch installs a `fetch(url, {method, headers, body})`
+// which, like the one of Node, returns a promise of the
+// response, with `status`, `statusText`, `ok`, `url`,
+// `headers.get(name)`, `text()` and `json()`. The request is
+// sent through the QuietExecutor of `executor`, so it shares
+// the client and the cookie jar of `ctx` with the requester
+// blocks (but not the `l2.beforeSend()` hooks), without
+// printing the response, and bounded by `timeout` (the
+// `--timeout` option; zero means none). Requests are sent one
+// at a time, as executors needn't be safe for concurrent use
+func BindFetch(ctx context.Context, vm *goja.Runtime, executor Executor, dir string, timeout time.Duration) {
+	st := loopOf(vm)
+	executor = QuietExecutor(executor)
+	var mu sync.Mutex
+	vm.Set("fetch", func(call goja.FunctionCall) goja.Value {
+		promise, resolve, reject := vm.NewPromise()
+		block, err := fetchBlock(call.Argument(0), call.Argument(1))
+		if err != nil {
+			reject(vm.NewTypeError("fetch: %s", err.Error()))
+			return vm.ToValue(promise)
+		}
+		if st == nil {
+			reject(vm.NewTypeError("fetch: the runtime has no event loop"))
+			return vm.ToValue(promise)
+		}
+		release := st.hold(vm)
+		generation := st.generation
+		go func() {
+			reqCtx := ctx
+			if timeout > 0 {
+				var cancel context.CancelFunc
+				reqCtx, cancel = context.WithTimeout(ctx, timeout)
+				defer cancel()
+			}
+			mu.Lock()
+			resp, err := executor.Execute(reqCtx, block, dir)
+			mu.Unlock()
+			if err != nil && ctx.Err() == nil && errors.Is(reqCtx.Err(), context.DeadlineExceeded) {
+				err = fmt.Errorf("request timed out after %s: %w", timeout, context.DeadlineExceeded)
+			}
+			st.loop.RunOnLoop(func(vm *goja.Runtime) {
+				if generation != st.generation {
+					// The block which called fetch() failed meanwhile
+					return
+				}
+				release()
+				if err != nil {
+					reject(vm.NewTypeError("fetch failed: %s", err.Error()))
+					return
+				}
+				resolve(fetchResponse(vm, resp))
+			})
+		}()
+		return vm.ToValue(promise)
+	})
+}
+
+// QuietExecutor returns an Executor sending requests like
+// `executor` without printing the responses. HTTPie only
+// reports the body it prints, so a native executor stands in
+// for it; other executors are returned as they are
+func QuietExecutor(executor Executor) Executor {
+	switch e := executor.(type) {
+	case *NativeExecutor:
+		quiet := *e
+		quiet.Out = nil
+		return &quiet
+	case *HTTPieExecutor:
+		return &NativeExecutor{Client: NewNativeExecutor(&lama2cmd.Opts{}).Client}
+	}
+	return executor
+}
+
+// fetchBlock builds a requester block from the arguments
+// of `fetch()`; the body is sent as is (see RunBeforeSend)
+func fetchBlock(input, init goja.Value) (*gabs.Container, error) {
+	target := input
+	if obj, ok := input.(*goja.Object); ok && obj.Get("url") != nil {
+		target = obj.Get("url")
+	}
+	if target == nil || goja.IsUndefined(target) || goja.IsNull(target) || target.String() == "" {
+		return nil, fmt.Errorf("expected a URL")
+	}
+	method := "GET"
+	headers := gabs.New()
+	var body goja.Value
+	if opts, ok := init.(*goja.Object); ok && opts != nil {
+		if m := opts.Get("method"); m != nil && !goja.IsUndefined(m) {
+			method = strings.ToUpper(m.String())
+		}
+		if h, ok := opts.Get("headers").(*goja.Object); ok && h != nil {
+			headers = headerContainer(h)
+		}
+		body = opts.Get("body")
+	}
+
+	block := gabs.New()
+	block.Set(strings.ToLower(method), "verb", "value")
+	block.Set(target.String(), "url", "value")
+	block.Set(headers, "details", "headers")
+	if body != nil && !goja.IsUndefined(body) && !goja.IsNull(body) {
+		if method == "GET" || method == "HEAD" {
+			return nil, fmt.Errorf("a %s request can't have a body", method)
+		}
+		block.Set(body.String(), "details", "raw_body")
+	}
+	return block, nil
+}
+
+// fetchResponse builds the JS value a `fetch()` promise
+// resolves to
+func fetchResponse(vm *goja.Runtime, resp Response) *goja.Object {
+	obj := vm.NewObject()
+	obj.Set("status", resp.StatusCode)
+	obj.Set("statusText", resp.StatusText)
+	obj.Set("ok", resp.StatusCode >= 200 && resp.StatusCode < 300)
+	obj.Set("url", resp.URL)
+	obj.Set("headers", fetchHeaders(vm, resp.Header))
+
+	body := resp.Body
+	obj.Set("text", func(goja.FunctionCall) goja.Value {
+		promise, resolve, _ := vm.NewPromise()
+		resolve(body)
+		return vm.ToValue(promise)
+	})
+	obj.Set("json", func(goja.FunctionCall) goja.Value {
+		promise, resolve, reject := vm.NewPromise()
+		parse, _ := goja.AssertFunction(vm.Get("JSON").ToObject(vm).Get("parse"))
+		if val, err := parse(goja.Undefined(), vm.ToValue(body)); err != nil {
+			reject(thrownValue(err))
+		} else {
+			resolve(val)
+		}
+		return vm.ToValue(promise)
+	})
+	return obj
+}
+
+// fetchHeaders exposes response headers the way the
+// `Headers` class of `fetch()` does: `get(name)` (with the
+// values joined by commas, or null), `has(name)` and
+// `forEach(fn)`
+func fetchHeaders(vm *goja.Runtime, header http.Header) *goja.Object {
+	obj := vm.NewObject()
+	obj.Set("get", func(call goja.FunctionCall) goja.Value {
+		values := header.Values(call.Argument(0).String())
+		if len(values) == 0 {
+			return goja.Null()
+		}
+		return vm.ToValue(strings.Join(values, ", "))
+	})
+	obj.Set("has", func(call goja.FunctionCall) goja.Value {
+		return vm.ToValue(len(header.Values(call.Argument(0).String())) > 0)
+	})
+	obj.Set("forEach", func(call goja.FunctionCall) goja.Value {
+		fn, ok := goja.AssertFunction(call.Argument(0))
+		if !ok {
+			panic(vm.NewTypeError("headers.forEach() expects a function"))
+		}
+		for _, key := range (&headerObject{header: header}).Keys() {
+			if _, err := fn(goja.Undefined(), vm.ToValue(strings.Join(header.Values(key), ", ")), vm.ToValue(strings.ToLower(key)), obj); err != nil {
+				panic(err)
+			}
+		}
+		return goja.Undefined()
+	})
+	return obj
+}
@@ -0,0 +1,78 @@
+package cmdexec
+
+import (
+	"github.com/dop251/goja"
+)
+
+// FlowKind tells how a processor block wants the
+// run to continue
+type FlowKind int
+
+const (
+	// FlowNext carries on with the next block
+	FlowNext FlowKind = iota
+	// FlowSkipNext skips the next stage: its request
+	// and the processor block following it
+	FlowSkipNext
+	// FlowStop ends the run successfully
+	FlowStop
+	// FlowGoto continues with the stage named Target
+	FlowGoto
+)
+
+// FlowDirective is a change of control flow requested
+// through `l2.skipNext()`, `l2.stop()` or `l2.goto()`. It
+// takes effect once the processor block finishes; if a
+// block calls several of them, the last call wins
+type FlowDirective struct {
+	Kind FlowKind
+	// Target is the stage name (or number) given to `l2.goto()`
+	Target string
+	// Reason is the optional message given to `l2.stop()`
+	Reason string
+}
+
+// EnableFlowControl installs `l2.skipNext()`, `l2.stop()`
+// and `l2.goto()` into the given runtime; it must run after
+// EnableAssertions, which creates the `l2` object
+func EnableFlowControl(vm *goja.Runtime) {
+	l2 := vm.Get("l2").ToObject(vm)
+	set := func(d FlowDirective) goja.Value {
+		l2.DefineDataProperty("_flow", vm.ToValue(d), goja.FLAG_TRUE, goja.FLAG_TRUE, goja.FLAG_FALSE)
+		return goja.Undefined()
+	}
+	l2.Set("skipNext", func(call goja.FunctionCall) goja.Value {
+		return set(FlowDirective{Kind: FlowSkipNext})
+	})
+	l2.Set("stop", func(call goja.FunctionCall) goja.Value {
+		d := FlowDirective{Kind: FlowStop}
+		if arg := call.Argument(0); !goja.IsUndefined(arg) {
+			d.Reason = arg.String()
+		}
+		return set(d)
+	})
+	l2.Set("goto", func(call goja.FunctionCall) goja.Value {
+		arg := call.Argument(0)
+		if goja.IsUndefined(arg) || goja.IsNull(arg) || arg.String() == "" {
+			panic(vm.NewTypeError("l2.goto() expects a stage name or number"))
+		}
+		return set(FlowDirective{Kind: FlowGoto, Target: arg.String()})
+	})
+}
+
+// TakeFlowDirective returns the directive requested by the
+// last processor block (FlowNext if none), and clears it
+func TakeFlowDirective(vm *goja.Runtime) FlowDirective {
+	l2Val := vm.Get("l2")
+	if l2Val == nil {
+		return FlowDirective{}
+	}
+	l2 := l2Val.ToObject(vm)
+	flow := l2.Get("_flow")
+	if flow == nil {
+		return FlowDirective{}
+	}
+	d, _ := flow.Export().(FlowDirective)
+	l2.Delete("_flow")
+	return d
+}
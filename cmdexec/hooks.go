@@ -0,0 +1,184 @@
+package cmdexec
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/HexmosTech/gabs/v2"
+	"github.com/dop251/goja"
+)
+
+// HookFile is the name of the per-directory hook file: JS
+// code run once, before the first block of each API file of
+// its directory, typically to register `l2.beforeSend()` hooks
+const HookFile = "l2hooks.js"
+
+// EnableHooks installs `l2.beforeSend(fn)`, registering `fn`
+// to be called with each request once its variables are
+// expanded (see RunBeforeSend); it must run after
+// EnableAssertions, which creates the `l2` object
+func EnableHooks(vm *goja.Runtime) {
+	l2 := vm.Get("l2").ToObject(vm)
+	l2.DefineDataProperty("_beforeSend", vm.NewArray(), goja.FLAG_FALSE, goja.FLAG_FALSE, goja.FLAG_FALSE)
+	l2.Set("beforeSend", func(call goja.FunctionCall) goja.Value {
+		if _, ok := goja.AssertFunction(call.Argument(0)); !ok {
+			panic(vm.NewTypeError("l2.beforeSend() expects a function"))
+		}
+		hooks := l2.Get("_beforeSend").ToObject(vm)
+		push, _ := goja.AssertFunction(hooks.Get("push"))
+		push(hooks, call.Argument(0))
+		return goja.Undefined()
+	})
+}
+
+// LoadHookFile runs the HookFile of `dir` in the VM, if
+// there is one
+func LoadHookFile(vm *goja.Runtime, dir string) error {
+	content, err := os.ReadFile(filepath.Join(dir, HookFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := RunVMCode(string(content), vm); err != nil {
+		return fmt.Errorf("%s: %w", HookFile, err)
+	}
+	return nil
+}
+
+// RunBeforeSend calls the `l2.beforeSend()` hooks in the
+// order they were registered, with a request object holding
+// the `method`, `url`, `headers` and `body` (a string, or null
+// without one) of a block whose variables are expanded. The
+// changes the hooks make are written back to the block, and
+// the body is then sent exactly as the hooks last saw it. The
+// body of a multipart request is null, and can't be replaced.
+// A hook returning a promise (an async function) is awaited
+func RunBeforeSend(vm *goja.Runtime, block *gabs.Container) error {
+	l2Val := vm.Get("l2")
+	if l2Val == nil {
+		return nil
+	}
+	hooks, ok := l2Val.ToObject(vm).Get("_beforeSend").(*goja.Object)
+	if !ok || hooks == nil || hooks.Get("length").ToInteger() == 0 {
+		return nil
+	}
+	multipart := block.S("multipart", "value") != nil
+	body, hasBody, err := bodyText(block)
+	if err != nil {
+		return err
+	}
+
+	req := vm.NewObject()
+	req.Set("method", strings.ToUpper(block.S("verb", "value").Data().(string)))
+	req.Set("url", block.S("url", "value").Data().(string))
+	headers := vm.NewObject()
+	if h := block.S("details", "headers"); h != nil {
+		for key, val := range unwrapContainer(h).ChildrenMap() {
+			headers.Set(key, valueString(val))
+		}
+	}
+	req.Set("headers", headers)
+	if hasBody && !multipart {
+		req.Set("body", body)
+	} else {
+		req.Set("body", goja.Null())
+	}
+
+	for i := int64(0); i < hooks.Get("length").ToInteger(); i++ {
+		fn, _ := goja.AssertFunction(hooks.Get(strconv.FormatInt(i, 10)))
+		var res goja.Value
+		err := runLoop(vm, func() error {
+			var err error
+			res, err = fn(goja.Undefined(), req)
+			return err
+		})
+		if err == nil {
+			err = awaited(res)
+		}
+		if err != nil {
+			return fmt.Errorf("l2.beforeSend: %w", scriptError(err))
+		}
+	}
+
+	method := req.Get("method")
+	target := req.Get("url")
+	if method == nil || goja.IsUndefined(method) || method.String() == "" || target == nil || goja.IsUndefined(target) || target.String() == "" {
+		return fmt.Errorf("l2.beforeSend: the request needs a method and a url")
+	}
+	block.Set(strings.ToLower(method.String()), "verb", "value")
+	block.Set(target.String(), "url", "value")
+
+	newHeaders := gabs.New()
+	if h, ok := req.Get("headers").(*goja.Object); ok && h != nil {
+		newHeaders = headerContainer(h)
+	}
+	block.Delete("details", "headers")
+	block.Set(newHeaders, "details", "headers")
+
+	newBody := req.Get("body")
+	unset := newBody == nil || goja.IsUndefined(newBody) || goja.IsNull(newBody)
+	if multipart {
+		if !unset {
+			return fmt.Errorf("l2.beforeSend: the body of a multipart request can't be replaced")
+		}
+		return nil
+	}
+	if unset {
+		block.Delete("details", "ip_data")
+		block.Delete("details", "raw_body")
+		return nil
+	}
+	block.Set(newBody.String(), "details", "raw_body")
+	return nil
+}
+
+// headerContainer converts a JS object of headers to
+// the representation of the parser
+func headerContainer(h *goja.Object) *gabs.Container {
+	headers := gabs.New()
+	for _, key := range h.Keys() {
+		val := gabs.New()
+		val.Set(h.Get(key).String())
+		headers.Set(val, key)
+	}
+	return headers
+}
+
+// bodyText returns the body a block would send: compact
+// JSON, or URL encoded for a form. It reports false for
+// a block without a body
+func bodyText(block *gabs.Container) (string, bool, error) {
+	if raw, ok := block.S("details", "raw_body").Data().(string); ok {
+		return raw, true, nil
+	}
+	jsonObj := block.S("details", "ip_data")
+	if jsonObj == nil {
+		return "", false, nil
+	}
+	jsonObj = unwrapContainer(jsonObj)
+	if block.S("form", "value") != nil {
+		return formBody(jsonObj), true, nil
+	}
+	dst := &bytes.Buffer{}
+	if err := json.Compact(dst, []byte(jsonObj.String())); err != nil {
+		return "", false, fmt.Errorf("couldn't minify JSON: %w", err)
+	}
+	return dst.String(), true, nil
+}
+
+// formBody URL encodes the fields of a form
+func formBody(jsonObj *gabs.Container) string {
+	form := url.Values{}
+	for key, val := range jsonObj.ChildrenMap() {
+		form.Add(key, valueString(val))
+	}
+	return form.Encode()
+}
@@ -1,33 +1,183 @@
 package cmdexec
 
 import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/HexmosTech/lama2/preprocess"
 	"github.com/dop251/goja"
 	"github.com/dop251/goja_nodejs/console"
+	"github.com/dop251/goja_nodejs/eventloop"
 	"github.com/dop251/goja_nodejs/require"
 	"github.com/rs/zerolog/log"
 )
 
-// GetJSVm creates a new goja runtime instance
-// with console.log enabled
+// GetJSVm creates a new goja runtime instance with
+// console.log, the timers of the event loop (see
+// EnableEventLoop), the assertion helpers, the flow control
+// functions, the request hooks (`l2.beforeSend`), `l2.crypto`
+// and the dynamic variables (`l2.dynamic`) enabled. It
+// panics if the runtime can't be set up (see NewJSVm)
 func GetJSVm() *goja.Runtime {
-	vm := goja.New()
-	new(require.Registry).Enable(vm)
-	console.Enable(vm)
+	vm, err := NewJSVm(nil)
+	if err != nil {
+		panic(err)
+	}
 	return vm
 }
 
+// NewJSVm is GetJSVm with the `console` output sent
+// to `printer`; a nil printer logs to stderr as usual. The
+// error is that of loading the embedded helpers
+func NewJSVm(printer console.Printer) (*goja.Runtime, error) {
+	registry := new(require.Registry)
+	if printer != nil {
+		registry.RegisterNativeModule(console.ModuleName, console.RequireWithPrinter(printer))
+	}
+	// The loop creates the runtime, with `require`, `console`
+	// and the timers enabled
+	loop := eventloop.NewEventLoop(eventloop.WithRegistry(registry))
+	var vm *goja.Runtime
+	loop.Run(func(r *goja.Runtime) {
+		vm = r
+	})
+	if err := EnableAssertions(vm); err != nil {
+		return nil, err
+	}
+	EnableEventLoop(vm, loop)
+	EnableFlowControl(vm)
+	EnableHooks(vm)
+	EnableCrypto(vm)
+	preprocess.BindGenerator(vm, preprocess.NewGenerator())
+	return vm, nil
+}
+
 // RunVMCode takes in a JS snippet as a string,
 // executes the code in a JS VM, finally checks
 // whether there are any errors, and if yes,
-// logs the problem.
+// logs and returns the problem.
 // Note: the vm runtime remains modified; so if
 // you reuse the vm for other operations, the state
-// from previous invocations carry over
-func RunVMCode(jsCode string, vm *goja.Runtime) {
-	_, err := vm.RunString(jsCode)
-	if ex, ok := err.(*goja.Exception); ok {
-		log.Fatal().Str("Error executing JS processor block", ex.String()).Msg("")
+// from previous invocations carry over. The code runs on
+// the event loop of the VM: timers and `fetch()` calls are
+// waited for, and a top-level `await` is supported
+func RunVMCode(jsCode string, vm *goja.Runtime) error {
+	err := runScript(vm, jsCode)
+	if thrownValue(err) != nil {
+		err = scriptError(err)
+		log.Error().Str("Error executing JS processor block", err.Error()).Msg("")
+	}
+	return err
+}
+
+// LazyResultThreshold is the body size (in bytes) above
+// which BindResult keeps the body as a string until the
+// processor blocks first read `result`
+const LazyResultThreshold = 1 << 20
+
+// BindResult defines the "magic variable" result from
+// an HTTP response body. A body which is valid JSON is
+// parsed in Go and handed to the VM as the JS value
+// `JSON.parse` would give; otherwise it is stored as a plain
+// string. Unlike the code from GenerateChainCode, the body is
+// never compiled as JS source, so backticks or `${` in the
+// body are harmless. Bodies larger than LazyResultThreshold
+// are kept as a Go string, and only parsed on the first
+// access to `result`
+func BindResult(vm *goja.Runtime, body string) {
+	global := vm.GlobalObject()
+	global.Delete("result")
+	if len(body) <= LazyResultThreshold {
+		vm.Set("result", parseResult(vm, body))
+		return
+	}
+
+	var cached goja.Value
+	getter := vm.ToValue(func(goja.FunctionCall) goja.Value {
+		if cached == nil {
+			cached = parseResult(vm, body)
+		}
+		return cached
+	})
+	setter := vm.ToValue(func(call goja.FunctionCall) goja.Value {
+		cached = call.Argument(0)
+		return goja.Undefined()
+	})
+	global.DefineAccessorProperty("result", getter, setter, goja.FLAG_TRUE, goja.FLAG_TRUE)
+}
+
+func parseResult(vm *goja.Runtime, body string) goja.Value {
+	if val, err := parseJSON(vm, body); err == nil {
+		log.Debug().Int("Size", len(body)).Msg("Response body stored as JSON")
+		return val
+	}
+	log.Debug().Int("Size", len(body)).Msg("Response body stored as string")
+	return vm.ToValue(body)
+}
+
+// parseJSON parses `body`, which must hold exactly one
+// JSON value, as a native JS value (see decodeJSValue)
+func parseJSON(vm *goja.Runtime, body string) (goja.Value, error) {
+	dec := json.NewDecoder(strings.NewReader(body))
+	val, err := decodeJSValue(vm, dec)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		if err == nil {
+			err = fmt.Errorf("invalid character after top-level value at offset %d", dec.InputOffset())
+		}
+		return nil, err
+	}
+	return val, nil
+}
+
+// decodeJSValue reads the next JSON value of `dec` as a
+// native JS value, keeping the order of object keys
+func decodeJSValue(vm *goja.Runtime, dec *json.Decoder) (goja.Value, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch t := tok.(type) {
+	case json.Delim:
+		if t == '[' {
+			items := make([]interface{}, 0)
+			for dec.More() {
+				item, err := decodeJSValue(vm, dec)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, item)
+			}
+			if _, err := dec.Token(); err != nil {
+				return nil, err
+			}
+			return vm.NewArray(items...), nil
+		}
+		obj := vm.NewObject()
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			val, err := decodeJSValue(vm, dec)
+			if err != nil {
+				return nil, err
+			}
+			// An own property, even for `__proto__`, as with JSON.parse
+			obj.DefineDataProperty(key.(string), val, goja.FLAG_TRUE, goja.FLAG_TRUE, goja.FLAG_TRUE)
+		}
+		if _, err := dec.Token(); err != nil {
+			return nil, err
+		}
+		return obj, nil
+	case nil:
+		return goja.Null(), nil
 	}
+	return vm.ToValue(tok), nil
 }
 
 // GenerateChainCode takes in an HTTP response body
@@ -35,13 +185,20 @@ func RunVMCode(jsCode string, vm *goja.Runtime) {
 // "magic variable" result. What does the code do?
 // The result is stored as a JS object, if the input
 // value can be parsed as JSON. Otherwise the value is
-// stored as a simple string.
+// stored as a simple string. The body is embedded as a
+// quoted string literal, so it can't run as code.
+//
+// Deprecated: the body is still compiled as JS source,
+// which is slow for large bodies; use BindResult instead.
 func GenerateChainCode(httpRespBody string) string {
+	// A JSON string is a JS string literal; json.Marshal
+	// also escapes U+2028 and U+2029
+	literal, _ := json.Marshal(httpRespBody)
 	code := `try {
-		result = JSON.parse(String.raw` + "`" + httpRespBody + "`" + `)	
+		result = JSON.parse(` + string(literal) + `)
 		console.log("Stored as JSON")
 	} catch (e) {
-		result = String.raw` + "`" + httpRespBody + "`" + ` 	
+		result = ` + string(literal) + `
 		console.log(e)
 		console.log("Stored as string")
 	}`
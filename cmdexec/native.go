@@ -0,0 +1,272 @@
+package cmdexec
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/HexmosTech/gabs/v2"
+	"github.com/HexmosTech/httpie-go"
+	"github.com/HexmosTech/httpie-go/output"
+	"github.com/HexmosTech/lama2/lama2cmd"
+	"github.com/HexmosTech/lama2/utils"
+	"github.com/mattn/go-isatty"
+	"github.com/rs/zerolog/log"
+)
+
+const nativeUserAgent = "lama2"
+
+var reScheme = regexp.MustCompile(`^[a-zA-Z][a-zA-Z0-9+-.]*://`)
+
+// NativeExecutor sends requests with the standard
+// `net/http` client. The request is built straight
+// from the parsed block, so there is no intermediate
+// flattening into command line arguments
+type NativeExecutor struct {
+	Client  *http.Client
+	Out     io.Writer
+	Nocolor bool
+}
+
+// NewNativeExecutor creates a NativeExecutor which,
+// like HTTPie, does not follow redirects and prints
+// the response to stdout (unless `--quiet` is given)
+func NewNativeExecutor(o *lama2cmd.Opts) *NativeExecutor {
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+	executor := &NativeExecutor{Client: client, Out: os.Stdout, Nocolor: o.Nocolor}
+	if o.Quiet {
+		executor.Out = nil
+	}
+	return executor
+}
+
+// Execute builds an `http.Request` from `block`, sends
+// it, prints the response and returns it. The cookies of
+// the jar in `ctx` (see WithCookieJar) are sent along, and
+// those received are stored in it
+func (n *NativeExecutor) Execute(ctx context.Context, block *gabs.Container, apiDir string) (Response, error) {
+	req, err := BuildHTTPRequest(block, apiDir)
+	if err != nil {
+		return Response{}, err
+	}
+	req = req.WithContext(ctx)
+	jar := CookieJarFrom(ctx)
+	if jar != nil {
+		for _, c := range jar.Cookies(req.URL) {
+			req.AddCookie(c)
+		}
+	}
+	log.Debug().Str("Method", req.Method).Str("URL", req.URL.String()).Msg("Native executor request")
+	sent := RequestInfo{Method: req.Method, URL: req.URL.String(), Headers: req.Header.Clone(), Body: requestBody(req)}
+
+	start := time.Now()
+	resp, err := n.Client.Do(req)
+	if err != nil {
+		return Response{}, fmt.Errorf("sending HTTP request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return Response{}, fmt.Errorf("reading HTTP response: %w", err)
+	}
+	elapsed := time.Since(start)
+	n.printResponse(resp, body)
+	if jar != nil {
+		jar.SetCookies(resp.Request.URL, resp.Cookies())
+	}
+
+	return Response{
+		ExResponse: httpie.ExResponse{StatusCode: resp.StatusCode, Body: string(body), Headers: utils.FlattenHeader(resp.Header)},
+		StatusText: http.StatusText(resp.StatusCode),
+		URL:        resp.Request.URL.String(),
+		Header:     resp.Header,
+		Cookies:    resp.Cookies(),
+		Elapsed:    elapsed,
+		Request:    sent,
+	}, nil
+}
+
+// requestBody returns a copy of the body of `req`
+// without consuming it
+func requestBody(req *http.Request) string {
+	if req.GetBody == nil {
+		return ""
+	}
+	rc, err := req.GetBody()
+	if err != nil {
+		return ""
+	}
+	defer rc.Close()
+	b, _ := io.ReadAll(rc)
+	return string(b)
+}
+
+// printResponse mirrors the HTTPie output: headers and a
+// formatted body on a terminal; just the body otherwise
+func (n *NativeExecutor) printResponse(resp *http.Response, body []byte) {
+	if n.Out == nil {
+		return
+	}
+	isTerminal := false
+	if f, ok := n.Out.(*os.File); ok {
+		isTerminal = isatty.IsTerminal(f.Fd())
+	}
+	writer := bufio.NewWriter(n.Out)
+	defer writer.Flush()
+
+	options := &output.Options{
+		EnableFormat: isTerminal && !n.Nocolor,
+		EnableColor:  isTerminal && !n.Nocolor,
+	}
+	printer := output.NewPrinter(writer, options)
+	if isTerminal {
+		printer.PrintStatusLine(resp.Proto, resp.Status, resp.StatusCode)
+		printer.PrintHeader(resp.Header)
+	}
+	printer.PrintBody(bytes.NewReader(body), resp.Header.Get("Content-Type"))
+	fmt.Fprintln(writer)
+}
+
+// BuildHTTPRequest converts a parsed `Lama2File` block
+// into an `http.Request`. JSON payloads are sent as-is,
+// `form` payloads are URL encoded, and `multipart` payloads
+// attach the `@files` entries read relative to `apiDir`
+func BuildHTTPRequest(block *gabs.Container, apiDir string) (*http.Request, error) {
+	httpv := block.S("verb", "value").Data().(string)
+	rawURL := block.S("url", "value").Data().(string)
+	if !reScheme.MatchString(rawURL) {
+		rawURL = "http://" + rawURL
+	}
+
+	body, contentType, err := buildBody(block, apiDir)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(strings.ToUpper(httpv), rawURL, body)
+	if err != nil {
+		return nil, fmt.Errorf("building HTTP request: %w", err)
+	}
+
+	if headers := block.S("details", "headers"); headers != nil {
+		for key, val := range unwrapContainer(headers).ChildrenMap() {
+			req.Header.Add(key, valueString(val))
+		}
+	}
+	if contentType != "" && req.Header.Get("Content-Type") == "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if contentType == "application/json" && req.Header.Get("Accept") == "" {
+		req.Header.Set("Accept", "application/json, */*;q=0.5")
+	}
+	if req.Header.Get("User-Agent") == "" {
+		req.Header.Set("User-Agent", nativeUserAgent)
+	}
+	if host := req.Header.Get("Host"); host != "" {
+		req.Host = host
+	}
+	return req, nil
+}
+
+func buildBody(block *gabs.Container, apiDir string) (io.Reader, string, error) {
+	if block.S("multipart", "value") != nil {
+		jsonObj := block.S("details", "ip_data")
+		if jsonObj == nil {
+			return nil, "", nil
+		}
+		return buildMultipartBody(unwrapContainer(jsonObj), apiDir)
+	}
+
+	body, ok, err := bodyText(block)
+	if err != nil || !ok {
+		return nil, "", err
+	}
+	if block.S("form", "value") != nil {
+		return strings.NewReader(body), "application/x-www-form-urlencoded; charset=utf-8", nil
+	}
+	return strings.NewReader(body), "application/json", nil
+}
+
+func buildMultipartBody(jsonObj *gabs.Container, apiDir string) (io.Reader, string, error) {
+	var buffer bytes.Buffer
+	writer := multipart.NewWriter(&buffer)
+
+	fields := jsonObj.ChildrenMap()
+	for _, key := range sortedKeys(fields) {
+		if key == "@files" {
+			continue
+		}
+		if err := writer.WriteField(key, valueString(fields[key])); err != nil {
+			return nil, "", err
+		}
+	}
+
+	if files, ok := fields["@files"]; ok {
+		fileMap := unwrapContainer(files).ChildrenMap()
+		for _, key := range sortedKeys(fileMap) {
+			fpath := valueString(fileMap[key])
+			if !filepath.IsAbs(fpath) {
+				fpath = filepath.Join(apiDir, fpath)
+			}
+			content, err := os.ReadFile(fpath)
+			if err != nil {
+				return nil, "", fmt.Errorf("failed to open '%s': %w", fpath, err)
+			}
+			part, err := writer.CreateFormFile(key, filepath.Base(fpath))
+			if err != nil {
+				return nil, "", err
+			}
+			if _, err := part.Write(content); err != nil {
+				return nil, "", err
+			}
+		}
+	}
+
+	if err := writer.Close(); err != nil {
+		return nil, "", err
+	}
+	return &buffer, writer.FormDataContentType(), nil
+}
+
+// unwrapContainer strips the nested containers which
+// `utils.SetJSON` leaves behind in the parsed tree
+func unwrapContainer(c *gabs.Container) *gabs.Container {
+	for {
+		inner, ok := c.Data().(*gabs.Container)
+		if !ok {
+			return c
+		}
+		c = inner
+	}
+}
+
+func valueString(c *gabs.Container) string {
+	c = unwrapContainer(c)
+	if s, ok := c.Data().(string); ok {
+		return s
+	}
+	return c.String()
+}
+
+func sortedKeys(m map[string]*gabs.Container) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,173 @@
+package cmdexec
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/HexmosTech/httpie-go"
+	outputmanager "github.com/HexmosTech/lama2/outputManager"
+	"github.com/HexmosTech/lama2/utils"
+	"github.com/dop251/goja"
+)
+
+// RequestInfo describes the request which was
+// actually sent, after variable expansion
+type RequestInfo struct {
+	Method  string
+	URL     string
+	Headers http.Header
+	Body    string
+}
+
+// Response is returned by an Executor. Besides the
+// status, flattened headers and body of the embedded
+// `httpie.ExResponse`, it records the details which the
+// processor blocks can inspect through `response`
+type Response struct {
+	httpie.ExResponse
+	StatusText string
+	URL        string
+	Header     http.Header
+	Cookies    []*http.Cookie
+	Elapsed    time.Duration
+	Request    RequestInfo
+	// Attempts lists every try at sending the request,
+	// when it was sent under a retry policy
+	Attempts []outputmanager.Attempt
+}
+
+// NewResponse completes a response known only through
+// its `httpie.ExResponse` (such as one from the HTTPie
+// executor or a persisted stage): the multi-valued headers
+// and cookies are derived from the flattened headers (see
+// utils.FlattenHeader)
+func NewResponse(ex httpie.ExResponse) Response {
+	header := utils.UnflattenHeader(ex.Headers)
+	return Response{
+		ExResponse: ex,
+		StatusText: http.StatusText(ex.StatusCode),
+		Header:     header,
+		Cookies:    (&http.Response{Header: header}).Cookies(),
+	}
+}
+
+// headerObject exposes an `http.Header` to JS. Property
+// lookup is case-insensitive, so `headers["content-type"]`
+// and `headers["Content-Type"]` are the same. The values of a
+// repeated header are joined by commas, except Set-Cookie,
+// which is an array
+type headerObject struct {
+	vm     *goja.Runtime
+	header http.Header
+}
+
+func (h *headerObject) Get(key string) goja.Value {
+	key = http.CanonicalHeaderKey(key)
+	values, ok := h.header[key]
+	if !ok {
+		return goja.Undefined()
+	}
+	if key == "Set-Cookie" {
+		items := make([]interface{}, 0, len(values))
+		for _, v := range values {
+			items = append(items, v)
+		}
+		return h.vm.NewArray(items...)
+	}
+	return h.vm.ToValue(strings.Join(values, ", "))
+}
+
+func (h *headerObject) Set(key string, val goja.Value) bool {
+	h.header.Set(key, val.String())
+	return true
+}
+
+func (h *headerObject) Has(key string) bool {
+	_, ok := h.header[http.CanonicalHeaderKey(key)]
+	return ok
+}
+
+func (h *headerObject) Delete(key string) bool {
+	h.header.Del(key)
+	return true
+}
+
+func (h *headerObject) Keys() []string {
+	keys := make([]string, 0, len(h.header))
+	for k := range h.header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// NewHeaderObject exposes a copy of `header` to JS
+// (see headerObject)
+func NewHeaderObject(vm *goja.Runtime, header http.Header) *goja.Object {
+	clone := header.Clone()
+	if clone == nil {
+		clone = make(http.Header)
+	}
+	return vm.NewDynamicObject(&headerObject{vm: vm, header: clone})
+}
+
+// responseObject builds the JS value of `response`
+func responseObject(vm *goja.Runtime, stage int, name string, resp Response) *goja.Object {
+	obj := vm.NewObject()
+	obj.Set("stage", stage)
+	obj.Set("name", name)
+	obj.Set("status", resp.StatusCode)
+	obj.Set("statusText", resp.StatusText)
+	obj.Set("url", resp.URL)
+	obj.Set("headers", NewHeaderObject(vm, resp.Header))
+	obj.Set("elapsed", resp.Elapsed.Milliseconds())
+	obj.Set("body", resp.Body)
+
+	cookies := vm.NewObject()
+	for _, c := range resp.Cookies {
+		cookies.Set(c.Name, c.Value)
+	}
+	obj.Set("cookies", cookies)
+
+	body := resp.Body
+	obj.Set("json", func(call goja.FunctionCall) goja.Value {
+		parsed, err := parseJSON(vm, body)
+		if err != nil {
+			panic(vm.NewTypeError("response body is not valid JSON: %s", err.Error()))
+		}
+		return parsed
+	})
+
+	request := vm.NewObject()
+	request.Set("method", resp.Request.Method)
+	request.Set("url", resp.Request.URL)
+	request.Set("headers", NewHeaderObject(vm, resp.Request.Headers))
+	request.Set("body", resp.Request.Body)
+	obj.Set("request", request)
+	return obj
+}
+
+// SetResponse exposes a response as `response` without
+// recording it in `history`, e.g. for a poll predicate
+func SetResponse(vm *goja.Runtime, stage int, name string, resp Response) *goja.Object {
+	obj := responseObject(vm, stage, name, resp)
+	vm.Set("response", obj)
+	return obj
+}
+
+// BindResponse exposes a stage response to the processor
+// blocks as `response`, and appends it to the `history`
+// array holding the responses of every stage so far
+func BindResponse(vm *goja.Runtime, stage int, name string, resp Response) {
+	obj := SetResponse(vm, stage, name, resp)
+
+	history, ok := vm.Get("history").(*goja.Object)
+	if !ok || history == nil {
+		history = vm.NewArray()
+		vm.Set("history", history)
+	}
+	push, _ := goja.AssertFunction(history.Get("push"))
+	push(history, obj)
+}
@@ -15,7 +15,7 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-func assembleCmdString(httpv string, url string, jsonObj *gabs.Container, headers *gabs.Container, multipart bool, form bool, o *lama2cmd.Opts) ([]string, string) {
+func assembleCmdString(httpv string, url string, jsonObj *gabs.Container, headers *gabs.Container, multipart bool, form bool, o *lama2cmd.Opts) ([]string, string, error) {
 	command := make([]string, 0)
 	log.Info().
 		Str("Type", "Construct Command").
@@ -43,9 +43,7 @@ func assembleCmdString(httpv string, url string, jsonObj *gabs.Container, header
 	if jsonObj != nil && !multipart && !form {
 		dst := &bytes.Buffer{}
 		if err := json.Compact(dst, []byte(jsonObj.String())); err != nil {
-			log.Fatal().
-				Str("Error", err.Error()).
-				Msg("Couldn't minify JSON")
+			return nil, "", fmt.Errorf("couldn't minify JSON: %w", err)
 		}
 		jsonStr = dst.String()
 	}
@@ -96,16 +94,17 @@ func assembleCmdString(httpv string, url string, jsonObj *gabs.Container, header
 		cleanCommand = append(cleanCommand, cleanC)
 	}
 	if multipart || form {
-		return cleanCommand, ""
+		return cleanCommand, "", nil
 	}
-	return cleanCommand, jsonStr
+	return cleanCommand, jsonStr, nil
 }
 
 // ConstructCommand extracts the HTTP verb, url and other
 // API file inputs, figures out the type of target command
 // and finally generates a string representing the generated
-// command
-func ConstructCommand(parsedInput *gabs.Container, o *lama2cmd.Opts) ([]string, string) {
+// command. An error is returned if the JSON body
+// can't be minified
+func ConstructCommand(parsedInput *gabs.Container, o *lama2cmd.Opts) ([]string, string, error) {
 	log.Info().Str("ParsedInput", parsedInput.String()).Msg("")
 	httpv := parsedInput.S("verb", "value")
 	url := parsedInput.S("url", "value")
@@ -119,6 +118,26 @@ func ConstructCommand(parsedInput *gabs.Container, o *lama2cmd.Opts) ([]string,
 	form := parsedInput.S("form", "value")
 	formBool := form != nil
 
-	res, stdinBody := assembleCmdString(httpv.Data().(string), url.Data().(string), jsonObj, headers, multipartBool, formBool, o)
-	return res, stdinBody
+	// A body set by an `l2.beforeSend()` hook goes to stdin as is
+	if raw, ok := parsedInput.S("details", "raw_body").Data().(string); ok && !multipartBool {
+		command, _, err := assembleCmdString(httpv.Data().(string), url.Data().(string), nil, headers, false, false, o)
+		if err == nil && formBool && !hasHeader(headers, "Content-Type") {
+			command = append(command, "Content-Type:application/x-www-form-urlencoded; charset=utf-8")
+		}
+		return command, raw, err
+	}
+
+	return assembleCmdString(httpv.Data().(string), url.Data().(string), jsonObj, headers, multipartBool, formBool, o)
+}
+
+func hasHeader(headers *gabs.Container, name string) bool {
+	if headers == nil {
+		return false
+	}
+	for key := range headers.Data().(*gabs.Container).ChildrenMap() {
+		if strings.EqualFold(key, name) {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,166 @@
+package contoller
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/HexmosTech/gabs/v2"
+	"github.com/HexmosTech/lama2/cmdexec"
+	"github.com/HexmosTech/lama2/parser"
+	"github.com/HexmosTech/lama2/preprocess"
+	"github.com/dop251/goja"
+	"github.com/rs/zerolog/log"
+)
+
+// Capture is a `@capture NAME = expression` annotation,
+// setting the JS variable NAME from the response of its
+// block. The expression is one of:
+//
+//	$.json.token    JSONPath into the JSON body (also .json.token)
+//	header:ETag     a response header
+//	cookie:sid      a cookie set by the response
+//	status          the status code
+//	body            the whole body
+type Capture struct {
+	Name string
+	Expr string
+}
+
+func (c Capture) String() string {
+	return "@capture " + c.Name + " = " + c.Expr
+}
+
+var reCapture = regexp.MustCompile(`^([A-Za-z_$][A-Za-z0-9_$]*)\s*=\s*(.+)$`)
+
+// CapturesFor reads the `@capture` annotations of a
+// request block, in file order
+func CapturesFor(block *gabs.Container) ([]Capture, error) {
+	captures := make([]Capture, 0)
+	for _, value := range parser.GetAnnotations(block, "capture") {
+		m := reCapture.FindStringSubmatch(value)
+		if m == nil {
+			return nil, fmt.Errorf("invalid @capture '%s': expected NAME = expression", value)
+		}
+		c := Capture{Name: m[1], Expr: strings.TrimSpace(m[2])}
+		if strings.HasPrefix(c.Expr, "$") || strings.HasPrefix(c.Expr, ".") {
+			if _, err := preprocess.ParseJSONPath(c.Expr); err != nil {
+				return nil, fmt.Errorf("invalid %s: %w", c, err)
+			}
+		} else if kind, _, _ := strings.Cut(c.Expr, ":"); kind != "header" && kind != "cookie" && c.Expr != "status" && c.Expr != "body" {
+			return nil, fmt.Errorf("invalid %s: expected a JSONPath ($.key), header:<name>, cookie:<name>, status or body", c)
+		}
+		captures = append(captures, c)
+	}
+	return captures, nil
+}
+
+// CaptureNames returns the names set by the `@capture`
+// annotations of the blocks
+func CaptureNames(blocks []*gabs.Container) map[string]bool {
+	names := make(map[string]bool)
+	for _, block := range blocks {
+		if block.S("type").Data().(string) != "Lama2File" {
+			continue
+		}
+		captures, _ := CapturesFor(block)
+		for _, c := range captures {
+			names[c.Name] = true
+		}
+	}
+	return names
+}
+
+// applyCaptures evaluates the captures against a response
+// and sets the resulting JS variables, stopping at the first
+// capture which doesn't match
+func applyCaptures(vm *goja.Runtime, captures []Capture, resp cmdexec.Response) error {
+	var body interface{}
+	parsed := false
+	for _, c := range captures {
+		var val interface{}
+		switch kind, name, _ := strings.Cut(c.Expr, ":"); {
+		case c.Expr == "status":
+			val = resp.StatusCode
+		case c.Expr == "body":
+			val = resp.Body
+		case kind == "header":
+			if _, ok := resp.Header[http.CanonicalHeaderKey(name)]; !ok {
+				return fmt.Errorf("%s: no %s header in the response", c, name)
+			}
+			val = resp.Header.Get(name)
+		case kind == "cookie":
+			found := false
+			for _, cookie := range resp.Cookies {
+				if cookie.Name == name {
+					val, found = cookie.Value, true
+				}
+			}
+			if !found {
+				return fmt.Errorf("%s: no %s cookie in the response", c, name)
+			}
+		default:
+			if !parsed {
+				dec := json.NewDecoder(strings.NewReader(resp.Body))
+				dec.UseNumber()
+				if err := dec.Decode(&body); err != nil {
+					return fmt.Errorf("%s: the response body is not JSON", c)
+				}
+				parsed = true
+			}
+			path, _ := preprocess.ParseJSONPath(c.Expr)
+			var err error
+			if val, err = path.Eval(body); err != nil {
+				return fmt.Errorf("%s: %w", c, err)
+			}
+			val = jsNumbers(val)
+		}
+		vm.Set(c.Name, val)
+	}
+	return nil
+}
+
+// jsNumbers converts the numbers of JSON decoded with
+// UseNumber for the VM. Integers too large for a JS number
+// are kept as strings of their exact digits, so that
+// `/items/${ID}` sends the ID the server gave
+func jsNumbers(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			if i > 1<<53 || i < -(1<<53) {
+				return v.String()
+			}
+			return i
+		}
+		if f, err := v.Float64(); err == nil {
+			return f
+		}
+		return v.String()
+	case map[string]interface{}:
+		for key, child := range v {
+			v[key] = jsNumbers(child)
+		}
+	case []interface{}:
+		for i, child := range v {
+			v[i] = jsNumbers(child)
+		}
+	}
+	return v
+}
+
+// replayCaptures applies the captures of a stage skipped
+// through `--stage` to its replayed response, so that later
+// blocks see the same variables; a capture which doesn't
+// match is only logged
+func replayCaptures(block *gabs.Container, vm *goja.Runtime, resp cmdexec.Response) {
+	captures, err := CapturesFor(block)
+	if err == nil {
+		err = applyCaptures(vm, captures, resp)
+	}
+	if err != nil {
+		log.Warn().Str("Type", "Controller").Str("Error", err.Error()).Msg("Couldn't capture from the replayed response")
+	}
+}
@@ -0,0 +1,290 @@
+package contoller
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/HexmosTech/lama2/lama2cmd"
+	"github.com/HexmosTech/lama2/parser"
+	"github.com/HexmosTech/lama2/preprocess"
+	"github.com/HexmosTech/lama2/utils"
+	"github.com/rs/zerolog/log"
+)
+
+// IsCollection reports whether the positional argument
+// names a directory or a glob pattern, rather than a
+// single API file
+func IsCollection(target string) bool {
+	info, err := os.Stat(target)
+	if err == nil {
+		return info.IsDir()
+	}
+	return strings.ContainsAny(target, "*?[")
+}
+
+// matchesAny checks `relPath` (slash separated) and its
+// base name against each of the glob patterns
+func matchesAny(relPath string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := filepath.Match(pattern, relPath); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, filepath.Base(relPath)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// CollectAPIFiles expands `target` into a sorted list of
+// `.l2` files. The target may be a file, a directory (walked
+// recursively, skipping `.lama2` state directories) or a
+// glob pattern. Files are kept if they match one of the
+// `include` globs (when given) and none of the `exclude`
+// globs; patterns are matched against the path relative to
+// the directory being walked, as well as the file name
+func CollectAPIFiles(target string, include []string, exclude []string) ([]string, error) {
+	roots := []string{target}
+	if _, err := os.Stat(target); err != nil {
+		matches, globErr := filepath.Glob(target)
+		if globErr != nil {
+			return nil, globErr
+		}
+		if len(matches) == 0 {
+			return nil, err
+		}
+		roots = matches
+	}
+
+	seen := make(map[string]bool)
+	files := make([]string, 0)
+	keep := func(path string, rel string) {
+		if len(include) > 0 && !matchesAny(rel, include) {
+			return
+		}
+		if matchesAny(rel, exclude) || seen[path] {
+			return
+		}
+		seen[path] = true
+		files = append(files, path)
+	}
+
+	for _, root := range roots {
+		info, err := os.Stat(root)
+		if err != nil {
+			return nil, err
+		}
+		if !info.IsDir() {
+			if strings.HasSuffix(root, ".l2") || len(roots) == 1 {
+				keep(root, filepath.ToSlash(root))
+			}
+			continue
+		}
+		err = filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if d.IsDir() && d.Name() == ".lama2" {
+				return filepath.SkipDir
+			}
+			if !d.IsDir() && strings.HasSuffix(d.Name(), ".l2") {
+				rel, _ := filepath.Rel(root, path)
+				keep(path, filepath.ToSlash(rel))
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// IsolateEnvironment snapshots the process environment
+// and returns a function restoring it. Running each file
+// of a collection in between keeps the variables loaded
+// from one directory's env files from leaking into the next
+func IsolateEnvironment() func() {
+	snapshot := os.Environ()
+	return func() {
+		os.Clearenv()
+		for _, e := range snapshot {
+			if i := strings.Index(e, "="); i >= 0 {
+				os.Setenv(e[:i], e[i+1:])
+			}
+		}
+	}
+}
+
+// RunSummary summarizes one run of an API file, either
+// within a collection or as one `--data` iteration
+type RunSummary struct {
+	Label       string
+	Stages      int
+	Tests       int
+	FailedTests int
+	Elapsed     time.Duration
+	Err         error
+}
+
+// Passed reports whether the file ran without errors
+// and without failing tests
+func (f RunSummary) Passed() bool {
+	return f.Err == nil && f.FailedTests == 0
+}
+
+// ExitCode is the exit code the run would have had
+// on its own (see RunExitCode)
+func (f RunSummary) ExitCode() int {
+	if f.Err != nil {
+		return utils.ExitCode(f.Err)
+	}
+	if f.FailedTests > 0 {
+		return utils.ExitAssertion
+	}
+	return utils.ExitOK
+}
+
+// summaryExitCode returns the exit code of the
+// first failed run, or `utils.ExitOK`
+func summaryExitCode(summary []RunSummary) int {
+	for _, r := range summary {
+		if !r.Passed() {
+			return r.ExitCode()
+		}
+	}
+	return utils.ExitOK
+}
+
+// RunAPIFile loads the environment of a single API file,
+// parses and runs it within `ctx`. Errors are returned
+// rather than ending the process, so that collections
+// carry on
+func RunAPIFile(ctx context.Context, fpath string, o *lama2cmd.Opts) ([]StageResult, error) {
+	fileOpts := *o
+	fileOpts.Positional.LamaAPIFile = fpath
+
+	content, err := preprocess.GetLamaFileAsString(fpath)
+	if err != nil {
+		return nil, utils.NewExecError(utils.KindParse, 0, 0, err)
+	}
+	_, dir, _ := utils.GetFilePathComponents(fpath)
+	restore := IsolateEnvironment()
+	defer restore()
+	if err := LoadAPIEnvironment(dir, fileOpts.Env); err != nil {
+		return nil, err
+	}
+
+	parsedAPI, err := parser.NewLama2Parser().Parse(content)
+	if err != nil {
+		return nil, parseError(err)
+	}
+	return RunParsedFileWithVars(ctx, parsedAPI, &fileOpts, dir, nil)
+}
+
+func summarizeRun(label string, results []StageResult, err error, elapsed time.Duration) RunSummary {
+	fr := RunSummary{Label: label, Elapsed: elapsed, Err: err}
+	for _, r := range results {
+		if r.Stage > 0 && !r.Skipped {
+			fr.Stages++
+		}
+		for _, t := range r.Tests {
+			fr.Tests++
+			if !t.Passed {
+				fr.FailedTests++
+			}
+		}
+	}
+	return fr
+}
+
+// WriteSummary prints the pass/fail table of a collection
+// (`heading` FILE, `unit` files) or of the `--data` iterations,
+// along with the totals
+func WriteSummary(w io.Writer, heading string, unit string, results []RunSummary) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(tw, "%s\tSTATUS\tSTAGES\tTESTS\tTIME\t\n", heading)
+	passed := 0
+	var total time.Duration
+	for _, r := range results {
+		status := "FAIL"
+		if r.Passed() {
+			status = "PASS"
+			passed++
+		}
+		tests := "-"
+		if r.Tests > 0 {
+			tests = fmt.Sprintf("%d/%d", r.Tests-r.FailedTests, r.Tests)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t\n", r.Label, status, r.Stages, tests, r.Elapsed.Round(time.Millisecond))
+		total += r.Elapsed
+	}
+	tw.Flush()
+	for _, r := range results {
+		if r.Err != nil {
+			fmt.Fprintf(w, "%s: %s\n", r.Label, r.Err.Error())
+		}
+	}
+	fmt.Fprintf(w, "\n%d %s, %d passed, %d failed in %s\n", len(results), unit, passed, len(results)-passed, total.Round(time.Millisecond))
+}
+
+// RunCollection runs every API file matched by the
+// positional argument (a directory or glob) in sorted
+// order, carrying on after failures, and finishes with a
+// summary table. Returns the exit code of the first
+// failing file (see RunSummary.ExitCode). Cancelling `ctx`
+// skips the remaining files; the summary covers those run.
+// A collection has no single last response, so `-o` is
+// rejected rather than ignored
+func RunCollection(ctx context.Context, o *lama2cmd.Opts) int {
+	if o.Output != "" {
+		log.Error().Str("Type", "Controller").Str("Path", o.Positional.LamaAPIFile).Msg("-o/--output applies to single API files; it can't be used with a directory or glob")
+		return utils.ExitFailure
+	}
+	files, err := CollectAPIFiles(o.Positional.LamaAPIFile, o.Include, o.Exclude)
+	if err != nil {
+		log.Error().Str("Type", "Controller").Str("Path", o.Positional.LamaAPIFile).Str("Error", err.Error()).Msg("Couldn't collect API files")
+		return utils.ExitFailure
+	}
+	if len(files) == 0 {
+		log.Warn().Str("Type", "Controller").Str("Path", o.Positional.LamaAPIFile).Msg("No .l2 files found")
+		return 0
+	}
+
+	if o.Data != "" {
+		log.Warn().Str("Type", "Controller").Msg("--data applies to single API files; ignoring it for the collection")
+	}
+	if ctx, err = shareGenerator(ctx, o.Seed); err != nil {
+		log.Error().Str("Type", "Controller").Str("Error", err.Error()).Msg("Invalid options")
+		return utils.ExitFailure
+	}
+
+	summary := make([]RunSummary, 0, len(files))
+	for _, f := range files {
+		if ctx.Err() != nil {
+			break
+		}
+		log.Info().Str("Type", "Controller").Str("LamaFile", f).Msg("Running")
+		start := time.Now()
+		results, err := RunAPIFile(ctx, f, o)
+		fr := summarizeRun(f, results, err, time.Since(start))
+		if err != nil {
+			log.Error().Str("Type", "Controller").Str("LamaFile", f).Str("Error", err.Error()).Msg("Execution failed")
+		}
+		summary = append(summary, fr)
+	}
+	WriteSummary(os.Stdout, "FILE", "files", summary)
+	if ctx.Err() != nil {
+		return utils.ExitInterrupted
+	}
+	return summaryExitCode(summary)
+}
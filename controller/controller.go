@@ -5,12 +5,15 @@
 package contoller
 
 import (
+	"context"
+	"errors"
 	"os"
+	"os/signal"
+	"time"
 
 	"github.com/HexmosTech/gabs/v2"
 	"github.com/HexmosTech/httpie-go"
 	"github.com/HexmosTech/lama2/cmdexec"
-	"github.com/HexmosTech/lama2/cmdgen"
 	"github.com/HexmosTech/lama2/codegen"
 	"github.com/HexmosTech/lama2/lama2cmd"
 	outputmanager "github.com/HexmosTech/lama2/outputManager"
@@ -26,47 +29,237 @@ func GetParsedAPIBlocks(parsedAPI *gabs.Container) []*gabs.Container {
 	return parsedAPI.S("value").Data().(*gabs.Container).Children()
 }
 
-func ExecuteProcessorBlock(block *gabs.Container, vm *goja.Runtime) {
+// StageResult records the outcome of one requester
+// block (stage). Test results reported by the processor
+// block right after a stage are attached to that stage;
+// stage 0 collects those from the leading processor block
+type StageResult struct {
+	Stage    int
+	Name     string
+	Skipped  bool
+	Response cmdexec.Response
+	Tests    []cmdexec.TestResult
+	// Logs holds the `console` output of the processor
+	// block following the stage
+	Logs    []string
+	Elapsed time.Duration
+	// Err is the error of the stage (or of the processor
+	// block following it); with `--continue-on-error`,
+	// several stages may carry one
+	Err error
+}
+
+// TestsFailed reports whether any test in the
+// given stage results has failed
+func TestsFailed(results []StageResult) bool {
+	for _, r := range results {
+		for _, t := range r.Tests {
+			if !t.Passed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func ExecuteProcessorBlock(block *gabs.Container, vm *goja.Runtime) error {
 	b := block.S("value").Data().(*gabs.Container)
 	log.Debug().Str("Processor block incoming block", block.String()).Msg("")
 	script := b.Data().(string)
-	cmdexec.RunVMCode(script, vm)
+	return cmdexec.RunProcessorCode(script, vm)
+}
+
+// ExecuteRequestorBlock expands the variables of a requester
+// block (`vars` taking precedence over the environment), lets
+// the `l2.beforeSend()` hooks change it and sends it through
+// `executor`, bounded by `ctx` and retried according to its
+// RetryPolicy. Errors are returned as `utils.ExecError` of the
+// variable, script (for a hook) or transport kind (parse for
+// an invalid retry setting); the caller fills in the block
+// location
+func ExecuteRequestorBlock(ctx context.Context, block *gabs.Container, vm *goja.Runtime, executor cmdexec.Executor, dir string, vars ...map[string]string) (cmdexec.Response, error) {
+	if err := preprocess.ProcessVarsInBlock(block, vm, vars...); err != nil {
+		return cmdexec.Response{}, utils.NewExecError(utils.KindVariable, 0, 0, err)
+	}
+	if err := cmdexec.RunBeforeSend(vm, block); err != nil {
+		return cmdexec.Response{}, utils.NewExecError(utils.KindScript, 0, 0, err)
+	}
+	return SendRequestorBlock(ctx, block, executor, dir, vars...)
 }
 
-func ExecuteRequestorBlock(block *gabs.Container, vm *goja.Runtime, opts *lama2cmd.Opts, dir string) httpie.ExResponse {
-	preprocess.ProcessVarsInBlock(block, vm)
-	// TODO - replace stuff in headers, and varjson and json as well
-	cmd, stdinBody := cmdgen.ConstructCommand(block, opts)
-	log.Debug().Str("Stdin Body to be passed into httpie", stdinBody).Msg("")
-	resp, e1 := cmdexec.ExecCommand(cmd, stdinBody, dir)
+// SendRequestorBlock is ExecuteRequestorBlock for a block
+// whose variables were already expanded, such as a request
+// sent again while polling
+func SendRequestorBlock(ctx context.Context, block *gabs.Container, executor cmdexec.Executor, dir string, vars ...map[string]string) (cmdexec.Response, error) {
+	policy, err := RetryPolicyFor(block, vars...)
+	if err != nil {
+		return cmdexec.Response{}, utils.NewExecError(utils.KindParse, 0, 0, err)
+	}
+	resp, e1 := sendWithRetry(ctx, block, executor, dir, policy)
+	if e1 != nil {
+		return resp, utils.NewExecError(utils.KindTransport, 0, 0, e1)
+	}
 	log.Debug().Str("Response from ExecCommand", resp.Body).Msg("")
-	if e1 == nil {
-		chainCode := cmdexec.GenerateChainCode(resp.Body)
-		cmdexec.RunVMCode(chainCode, vm)
-	} else {
-		log.Fatal().Str("Error from ExecCommand", e1.Error())
-		os.Exit(1)
-	}
-	return resp
-}
-
-func HandleParsedFile(parsedAPI *gabs.Container, o *lama2cmd.Opts, dir string) {
-	parsedAPIblocks := GetParsedAPIBlocks(parsedAPI)
-	vm := cmdexec.GetJSVm()
-	var resp httpie.ExResponse
-	for i, block := range parsedAPIblocks {
-		log.Debug().Int("Block num", i).Msg("")
-		log.Debug().Str("Block getting processed", block.String()).Msg("")
-		blockType := block.S("type").Data().(string)
-		if blockType == "processor" {
-			ExecuteProcessorBlock(block, vm)
-		} else if blockType == "Lama2File" {
-			resp = ExecuteRequestorBlock(block, vm, o, dir)
+	return resp, nil
+}
+
+// blockLine returns the source line recorded
+// for a block by the parser, or 0
+func blockLine(block *gabs.Container) int {
+	if line, ok := block.S("line").Data().(float64); ok {
+		return int(line)
+	}
+	if line, ok := block.S("line").Data().(int); ok {
+		return line
+	}
+	return 0
+}
+
+// locateError tags `err` with the (1-based) block number
+// and source line it comes from, wrapping it as an
+// ExecError of `kind` unless it already is one
+func locateError(err error, kind utils.ErrorKind, blockNum int, block *gabs.Container) error {
+	var execErr *utils.ExecError
+	if !errors.As(err, &execErr) {
+		execErr = utils.NewExecError(kind, 0, 0, err)
+	}
+	execErr.Block = blockNum
+	execErr.Line = blockLine(block)
+	return execErr
+}
+
+// BindStageResponse makes the response of a stage
+// available to the processor blocks which follow, both
+// as the `result` body and as the `response` object
+// (which is also appended to `history`)
+func BindStageResponse(r StageResult, vm *goja.Runtime) {
+	cmdexec.BindResult(vm, r.Response.Body)
+	cmdexec.BindResponse(vm, r.Stage, r.Name, r.Response)
+}
+
+// ReplayStage stands in for a requester block skipped
+// through `--stage`. When the stage response was persisted
+// by an earlier run, `result` and `response` are restored
+// from it so that the processor blocks which follow see
+// the same data. Reports whether a response was replayed
+func ReplayStage(r *StageResult, persisted map[int]PersistedStage, vm *goja.Runtime) bool {
+	p, ok := persisted[r.Stage]
+	if !ok {
+		log.Info().Int("Stage", r.Stage).Msg("Skipping stage")
+		return false
+	}
+	log.Info().Int("Stage", r.Stage).Msg("Replaying persisted response of stage")
+	r.Response = cmdexec.NewResponse(httpie.ExResponse{StatusCode: p.StatusCode, Body: p.Body, Headers: p.Headers})
+	BindStageResponse(*r, vm)
+	return true
+}
+
+// RunParsedFile executes the blocks of a parsed API file
+// in order and returns the result of every stage. Execution
+// stops at the first processor or request error (see
+// `utils.ExecError`), which is returned along with the results
+// collected so far. With `--continue-on-error`, the remaining
+// blocks still run; each error is kept in its StageResult and
+// the first one is returned
+func RunParsedFile(parsedAPI *gabs.Container, o *lama2cmd.Opts, dir string) ([]StageResult, error) {
+	return RunParsedFileWithVars(context.Background(), parsedAPI, o, dir, nil)
+}
+
+// RunParsedFileWithVars is RunParsedFile bounded by `ctx`
+// and with extra variables (a `--data` row) which take
+// precedence over the environment when expanding the
+// request blocks
+func RunParsedFileWithVars(ctx context.Context, parsedAPI *gabs.Container, o *lama2cmd.Opts, dir string, vars map[string]string) ([]StageResult, error) {
+	r := &Runner{Opts: o, Dir: dir, Vars: []map[string]string{vars}}
+	return r.Run(ctx, parsedAPI)
+}
+
+// LastResponse returns the response of the final
+// stage which was actually executed
+func LastResponse(results []StageResult) cmdexec.Response {
+	for i := len(results) - 1; i > 0; i-- {
+		if !results[i].Skipped {
+			return results[i].Response
 		}
 	}
+	return cmdexec.Response{}
+}
+
+// HandleParsedFile runs the parsed API file, optionally
+// writes the last response to the `-o` output file, and
+// returns the stage results along with the run error (or
+// else the error of writing the output file). When `ctx` is
+// cancelled (e.g. on Ctrl-C), the run stops and the output
+// file receives the last response obtained so far
+func HandleParsedFile(ctx context.Context, parsedAPI *gabs.Container, o *lama2cmd.Opts, dir string) ([]StageResult, error) {
+	results, err := RunParsedFileWithVars(ctx, parsedAPI, o, dir, nil)
+	if ctx.Err() != nil {
+		log.Warn().Str("Type", "Controller").Str("LamaFile", o.Positional.LamaAPIFile).Msg("Interrupted")
+	} else if err != nil {
+		log.Error().
+			Str("Type", "Controller").
+			Str("LamaFile", o.Positional.LamaAPIFile).
+			Str("Error", err.Error()).
+			Msg("Execution failed")
+	}
 	if o.Output != "" {
-		outputmanager.WriteJSONOutput(resp, o.Output)
+		last := LastResponse(results)
+		if werr := outputmanager.WriteJSONOutput(last.ExResponse, o.Output, last.Attempts...); werr != nil {
+			log.Error().Str("Type", "Controller").Str("Error", werr.Error()).Msg("Couldn't write output")
+			if err == nil {
+				err = werr
+			}
+		}
+	}
+	return results, err
+}
+
+// RunExitCode is the process exit code of a run: that of
+// the run error (see `utils.ExitCode`) if any, otherwise
+// `utils.ExitAssertion` when a test failed
+func RunExitCode(results []StageResult, err error) int {
+	if err != nil {
+		return utils.ExitCode(err)
 	}
+	if TestsFailed(results) {
+		return utils.ExitAssertion
+	}
+	return utils.ExitOK
+}
+
+// parseError tags a parse error of the API file
+// with the parse kind and its line
+func parseError(err error) error {
+	line := 0
+	var pe *utils.ParseError
+	if errors.As(err, &pe) {
+		line = pe.LineNum
+	}
+	return utils.NewExecError(utils.KindParse, 0, line, err)
+}
+
+// LoadAPIEnvironment loads `l2config.env` and `l2.env`,
+// and the files of the named environment `env` (see
+// preprocess.EnvFiles), for an API file living in `dir`.
+// The commands within the env files run from `dir`, so
+// the CWD is switched temporarily
+func LoadAPIEnvironment(dir string, env string) error {
+	oldDir, _ := os.Getwd()
+	utils.ChangeWorkingDir(dir)
+	defer utils.ChangeWorkingDir(oldDir)
+	return preprocess.LoadEnvironments(dir, preprocess.EnvName(env))
+}
+
+// IsSubcommand reports whether `args` (as in os.Args)
+// invoke the subcommand `name`. Since `l2` also takes a file
+// or a directory, a path by that name in the working
+// directory is run as such instead
+func IsSubcommand(args []string, name string) bool {
+	if len(args) < 2 || args[1] != name {
+		return false
+	}
+	_, err := os.Stat(name)
+	return errors.Is(err, os.ErrNotExist)
 }
 
 // Process initiates the following tasks in the given order:
@@ -74,20 +267,45 @@ func HandleParsedFile(parsedAPI *gabs.Container, o *lama2cmd.Opts, dir string) {
 // 2. Read API file contents
 // 3. Expand environment variables in API file
 // 4. Parse the API contents
-// 5. Generate API request command
-// 6. Execute command & retrieve results
+// 5. Build the API request through the chosen executor
+// 6. Execute request & retrieve results
 // 7. Optionally, post-process and write results to a JSON file
+// When invoked as `l2 test ...`, the test mode runs instead
+// (see RunTestMode), and `l2 env explain ...` reports where
+// variables come from (see RunEnvCommand), unless a file or
+// directory has the name of the subcommand (see
+// IsSubcommand); a directory or glob runs every matching
+// file in turn (see RunCollection), and `--data` runs the file
+// once per data row (see RunDataIterations)
 func Process(version string) {
+	if IsSubcommand(os.Args, "test") {
+		os.Exit(RunTestMode(os.Args[1:]))
+	}
+	if IsSubcommand(os.Args, "env") {
+		os.Exit(RunEnvCommand(os.Args[1:]))
+	}
 	o := lama2cmd.GetAndValidateCmd(os.Args)
 	lama2cmd.ArgParsing(o, version)
 
-	apiContent := preprocess.GetLamaFileAsString(o.Positional.LamaAPIFile)
-	_, dir, _ := utils.GetFilePathComponents(o.Positional.LamaAPIFile)
-	oldDir, _ := os.Getwd()
-	utils.ChangeWorkingDir(dir)
+	// Ctrl-C cancels the request in flight; the partial
+	// results are still reported before exiting
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
 
-	preprocess.LoadEnvironments(dir)
-	utils.ChangeWorkingDir(oldDir)
+	if o.Convert == "" && !o.Prettify && IsCollection(o.Positional.LamaAPIFile) {
+		os.Exit(RunCollection(ctx, o))
+	}
+
+	apiContent, err := preprocess.GetLamaFileAsString(o.Positional.LamaAPIFile)
+	if err != nil {
+		log.Error().Str("Type", "Controller").Str("Error", err.Error()).Msg("Couldn't read API file")
+		os.Exit(utils.ExitParse)
+	}
+	_, dir, _ := utils.GetFilePathComponents(o.Positional.LamaAPIFile)
+	if err := LoadAPIEnvironment(dir, o.Env); err != nil {
+		log.Error().Str("Type", "Controller").Str("Error", err.Error()).Msg("Couldn't load environment")
+		os.Exit(utils.ExitFailure)
+	}
 	p := parser.NewLama2Parser()
 	parsedAPI, e := p.Parse(apiContent)
 	if o.Convert != "" {
@@ -101,12 +319,21 @@ func Process(version string) {
 	}
 
 	if e != nil {
-		log.Fatal().
+		e = parseError(e)
+		log.Error().
 			Str("Type", "Controller").
 			Str("LamaFile", o.Positional.LamaAPIFile).
 			Str("Error", e.Error()).
 			Msg("Parse Error")
+		os.Exit(utils.ExitCode(e))
 	}
 	log.Debug().Str("Parsed API", parsedAPI.String()).Msg("")
-	HandleParsedFile(parsedAPI, o, dir)
+	if o.Data != "" {
+		os.Exit(RunDataIterations(ctx, apiContent, o, dir))
+	}
+	results, err := HandleParsedFile(ctx, parsedAPI, o, dir)
+	if err == nil && TestsFailed(results) {
+		log.Error().Str("Type", "Controller").Msg("One or more tests failed")
+	}
+	os.Exit(RunExitCode(results, err))
 }
@@ -0,0 +1,304 @@
+package contoller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/HexmosTech/gabs/v2"
+	"github.com/HexmosTech/lama2/lama2cmd"
+	"github.com/HexmosTech/lama2/parser"
+	"github.com/HexmosTech/lama2/preprocess"
+	"github.com/HexmosTech/lama2/utils"
+	"github.com/rs/zerolog/log"
+)
+
+// VarSource is a place defining a variable: an env file
+// (Kind as in preprocess.EnvFile, with the File and Line),
+// `session`, `environment` for the process environment,
+// `dynamic` for the built-in generators, `stage` for a
+// reference to the response of a named stage, or `capture`
+// for a variable set by a `@capture` annotation. The Value of
+// an env file variable defined by a backtick command is the
+// output of the Command
+type VarSource struct {
+	Kind    string `json:"kind"`
+	File    string `json:"file,omitempty"`
+	Line    int    `json:"line,omitempty"`
+	Command string `json:"command,omitempty"`
+	Value   string `json:"value"`
+}
+
+func (s VarSource) String() string {
+	place := s.Kind
+	switch {
+	case s.File != "" && s.Line > 0:
+		place = fmt.Sprintf("%s:%d", s.File, s.Line)
+	case s.File != "":
+		place = s.File
+	}
+	if s.Command != "" {
+		place += " (`" + s.Command + "`)"
+	}
+	return place
+}
+
+// VarUse is a reference to a variable in a request block
+type VarUse struct {
+	Block int    `json:"block"`
+	Line  int    `json:"line"`
+	Field string `json:"field"`
+}
+
+// VarExplanation tells where the value of a variable
+// referred to by an API file comes from
+type VarExplanation struct {
+	Name string `json:"name"`
+	// Value is the resolved value, masked for secrets
+	// unless revealed; empty if Source is nil
+	Value  string     `json:"value"`
+	Masked bool       `json:"masked"`
+	Source *VarSource `json:"source"`
+	// Shadows lists the sources overridden by Source,
+	// the strongest first
+	Shadows []VarSource `json:"shadows"`
+	// Processors are the processor blocks mentioning the
+	// variable; a JS variable they set wins over any source
+	Processors []int    `json:"processorBlocks"`
+	Uses       []VarUse `json:"uses"`
+}
+
+// Explanation is the report of `l2 env explain`
+type Explanation struct {
+	File      string           `json:"file"`
+	Env       string           `json:"env,omitempty"`
+	Session   string           `json:"session,omitempty"`
+	Variables []VarExplanation `json:"variables"`
+}
+
+var reSecretName = regexp.MustCompile(`(?i)(secret|token|passw|pwd|key|auth|credential|private|cookie|session|signature)`)
+
+// IsSecretName reports whether a variable name suggests
+// a value which shouldn't be displayed
+func IsSecretName(name string) bool {
+	return reSecretName.MatchString(name)
+}
+
+// maskValue hides a secret, keeping the last 4
+// characters of long values as a hint
+func maskValue(value string) string {
+	if len(value) >= 12 {
+		return "****" + value[len(value)-4:]
+	}
+	return "****"
+}
+
+// ExplainVariables lists the variables referred to by the
+// request blocks of an API file, with the source each one
+// gets its value from and the sources it shadows, from the
+// strongest: a session variable (if `session` is given),
+// the env files of preprocess.EnvFiles from the last one, and
+// the process environment. Backtick commands of the env files
+// run as when loading them; a failing one defines nothing.
+// Secret values are masked unless `reveal` is set
+func ExplainVariables(fpath string, env string, session string, reveal bool) (*Explanation, error) {
+	content, err := preprocess.GetLamaFileAsString(fpath)
+	if err != nil {
+		return nil, err
+	}
+	parsedAPI, err := parser.NewLama2Parser().Parse(content)
+	if err != nil {
+		return nil, parseError(err)
+	}
+	_, dir, _ := utils.GetFilePathComponents(fpath)
+	env = preprocess.EnvName(env)
+	exp := &Explanation{File: fpath, Env: env, Session: session, Variables: make([]VarExplanation, 0)}
+
+	// Sources, weakest first
+	layers := make([]map[string]VarSource, 0)
+	environ := make(map[string]VarSource)
+	for _, kv := range os.Environ() {
+		if i := strings.Index(kv, "="); i > 0 {
+			environ[kv[:i]] = VarSource{Kind: "environment", Value: kv[i+1:]}
+		}
+	}
+	layers = append(layers, environ)
+	files, err := preprocess.EnvFiles(dir, env)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		entries, err := preprocess.ReadEnvFile(f.Path)
+		if err != nil {
+			continue
+		}
+		layer := make(map[string]VarSource, len(entries))
+		for _, e := range entries {
+			layer[e.Key] = VarSource{Kind: f.Source, File: displayPath(f.Path), Line: e.Line, Value: e.Value}
+		}
+		layers = append(layers, layer)
+	}
+	if session != "" {
+		path, err := SessionPath(dir, session)
+		if err != nil {
+			return nil, err
+		}
+		s, err := LoadSession(path)
+		if err != nil {
+			return nil, err
+		}
+		layer := make(map[string]VarSource)
+		for k, v := range s.Values() {
+			layer[k] = VarSource{Kind: "session", File: displayPath(path), Value: v}
+		}
+		layers = append(layers, layer)
+	}
+
+	blocks := GetParsedAPIBlocks(parsedAPI)
+	byName := make(map[string]int)
+	stageNames := make(map[string]bool)
+	captures := make(map[string]string)
+	for i, block := range blocks {
+		if block.S("type").Data().(string) != "Lama2File" {
+			continue
+		}
+		if name, ok := parser.GetAnnotation(block, "name"); ok {
+			stageNames[name] = true
+		}
+		if cs, err := CapturesFor(block); err == nil {
+			for _, c := range cs {
+				if _, ok := captures[c.Name]; !ok {
+					captures[c.Name] = fmt.Sprint(i + 1)
+				}
+			}
+		}
+		for _, ref := range preprocess.BlockReferences(block) {
+			n, ok := byName[ref.Name]
+			if !ok {
+				n = len(exp.Variables)
+				byName[ref.Name] = n
+				exp.Variables = append(exp.Variables, VarExplanation{Name: ref.Name, Shadows: []VarSource{}, Processors: []int{}})
+			}
+			exp.Variables[n].Uses = append(exp.Variables[n].Uses, VarUse{Block: i + 1, Line: blockLine(block), Field: ref.Field})
+		}
+	}
+
+	for i := range exp.Variables {
+		v := &exp.Variables[i]
+		if strings.HasPrefix(v.Name, "$") {
+			v.Source = &VarSource{Kind: "dynamic", Value: "(generated)"}
+			v.Value = v.Source.Value
+			continue
+		}
+		if blocks, ok := captures[v.Name]; ok {
+			v.Source = &VarSource{Kind: "capture", Value: "(captured by block " + blocks + ")"}
+			v.Value = v.Source.Value
+			continue
+		}
+		if stage, ok := preprocess.StageRefName(v.Name); ok && stageNames[stage] {
+			v.Source = &VarSource{Kind: "stage", Value: "(response of " + stage + ")"}
+			v.Value = v.Source.Value
+			continue
+		}
+		for j, block := range blocks {
+			if block.S("type").Data().(string) != "processor" {
+				continue
+			}
+			if script, ok := block.S("value").Data().(*gabs.Container).Data().(string); ok && preprocess.ScriptMentions(script, v.Name) {
+				v.Processors = append(v.Processors, j+1)
+			}
+		}
+		secret := IsSecretName(v.Name) && !reveal
+		for l := len(layers) - 1; l >= 0; l-- {
+			src, ok := layers[l][v.Name]
+			if !ok {
+				continue
+			}
+			// Only the values of env files (which have a line) run
+			if command, ok := preprocess.BacktickCommand(src.Value); ok && src.Line > 0 {
+				if src.Value, ok = preprocess.RunBacktickCommand(src.Value, dir); !ok {
+					continue
+				}
+				src.Command = command
+			}
+			if secret {
+				src.Value = maskValue(src.Value)
+			}
+			if v.Source == nil {
+				v.Source = &src
+				v.Value, v.Masked = src.Value, secret
+			} else {
+				v.Shadows = append(v.Shadows, src)
+			}
+		}
+	}
+	return exp, nil
+}
+
+// displayPath shortens `path` relative to the
+// working directory when it lies below it
+func displayPath(path string) string {
+	cwd, err := os.Getwd()
+	if err != nil {
+		return path
+	}
+	if rel, err := filepath.Rel(cwd, path); err == nil && !strings.HasPrefix(rel, "..") {
+		return rel
+	}
+	return path
+}
+
+// WriteExplanation prints an Explanation as a table
+func WriteExplanation(w io.Writer, exp *Explanation) {
+	header := "Variables of " + exp.File
+	if exp.Env != "" {
+		header += " (environment " + exp.Env + ")"
+	}
+	fmt.Fprintln(w, header)
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tVALUE\tSOURCE\tSHADOWS")
+	for _, v := range exp.Variables {
+		value, source := "(unset)", "-"
+		if v.Source != nil {
+			value, source = v.Value, v.Source.String()
+		}
+		shadows := make([]string, 0, len(v.Shadows))
+		for _, s := range v.Shadows {
+			shadows = append(shadows, s.String())
+		}
+		if len(v.Processors) > 0 {
+			blocks := make([]string, 0, len(v.Processors))
+			for _, b := range v.Processors {
+				blocks = append(blocks, fmt.Sprint(b))
+			}
+			source += " (may be set by processor block " + strings.Join(blocks, ", ") + ")"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", v.Name, value, source, strings.Join(shadows, ", "))
+	}
+	tw.Flush()
+}
+
+// RunEnvCommand implements `l2 env explain <file>`, which
+// prints ExplainVariables as a table, or as JSON with
+// `--json`. Returns the exit code
+func RunEnvCommand(args []string) int {
+	o := lama2cmd.GetEnvCmd(args)
+	exp, err := ExplainVariables(o.Positional.LamaAPIFile, o.Env, o.Session, o.Reveal)
+	if err != nil {
+		log.Error().Str("Type", "Controller").Str("LamaFile", o.Positional.LamaAPIFile).Str("Error", err.Error()).Msg("Couldn't explain variables")
+		return utils.ExitCode(err)
+	}
+	if o.JSON {
+		b, _ := json.MarshalIndent(exp, "", "  ")
+		fmt.Println(string(b))
+		return 0
+	}
+	WriteExplanation(os.Stdout, exp)
+	return 0
+}
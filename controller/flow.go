@@ -0,0 +1,85 @@
+package contoller
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/HexmosTech/gabs/v2"
+	"github.com/HexmosTech/lama2/parser"
+)
+
+// MaxJumps bounds the `l2.goto()` jumps of a run,
+// so that a loop which never exits fails instead
+const MaxJumps = 100
+
+// stageNumbers maps the index of every requester block
+// to its (1-based) stage number
+func stageNumbers(blocks []*gabs.Container) map[int]int {
+	stages := make(map[int]int)
+	for i, block := range blocks {
+		if block.S("type").Data().(string) == "Lama2File" {
+			stages[i] = len(stages) + 1
+		}
+	}
+	return stages
+}
+
+// findStage returns the index of the requester block
+// named `target`, or else numbered `target`
+func findStage(blocks []*gabs.Container, stages map[int]int, target string) (int, error) {
+	for i := range blocks {
+		if _, ok := stages[i]; !ok {
+			continue
+		}
+		if name, _ := parser.GetAnnotation(blocks[i], "name"); name == target {
+			return i, nil
+		}
+	}
+	if n, err := strconv.Atoi(target); err == nil {
+		for i, s := range stages {
+			if s == n {
+				return i, nil
+			}
+		}
+	}
+	return 0, fmt.Errorf("l2.goto(%q): no such stage", target)
+}
+
+// nextStage returns the index of the first requester
+// block after `i`, or -1
+func nextStage(blocks []*gabs.Container, stages map[int]int, i int) int {
+	for j := i + 1; j < len(blocks); j++ {
+		if _, ok := stages[j]; ok {
+			return j
+		}
+	}
+	return -1
+}
+
+// cloneBlock deep-copies a parsed block. Request blocks
+// are expanded in place, so a stage visited again through
+// `l2.goto()` is expanded anew from a pristine copy
+func cloneBlock(block *gabs.Container) *gabs.Container {
+	return gabs.Wrap(cloneValue(block.Data()))
+}
+
+func cloneValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case *gabs.Container:
+		return gabs.Wrap(cloneValue(t.Data()))
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			m[k] = cloneValue(val)
+		}
+		return m
+	case []interface{}:
+		s := make([]interface{}, len(t))
+		for k, val := range t {
+			s[k] = cloneValue(val)
+		}
+		return s
+	default:
+		return v
+	}
+}
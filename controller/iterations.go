@@ -0,0 +1,104 @@
+package contoller
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/HexmosTech/lama2/lama2cmd"
+	outputmanager "github.com/HexmosTech/lama2/outputManager"
+	"github.com/HexmosTech/lama2/parser"
+	"github.com/HexmosTech/lama2/preprocess"
+	"github.com/HexmosTech/lama2/utils"
+	"github.com/rs/zerolog/log"
+)
+
+const maxIterationLabel = 48
+
+// iterationLabel names an iteration by its number and
+// row, e.g. `#2 id=7 name=bob`, cut to `maxIterationLabel`
+// characters
+func iterationLabel(n int, row map[string]string) string {
+	keys := make([]string, 0, len(row))
+	for k := range row {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+row[k])
+	}
+	label := fmt.Sprintf("#%d %s", n, strings.Join(pairs, " "))
+	if runes := []rune(label); len(runes) > maxIterationLabel {
+		label = string(runes[:maxIterationLabel-3]) + "..."
+	}
+	return label
+}
+
+// RunIteration parses `apiContent` afresh (the request
+// blocks are expanded in place) and runs it with the
+// variables of one data row, within `ctx`
+func RunIteration(ctx context.Context, apiContent string, o *lama2cmd.Opts, dir string, row map[string]string) ([]StageResult, error) {
+	parsedAPI, err := parser.NewLama2Parser().Parse(apiContent)
+	if err != nil {
+		return nil, parseError(err)
+	}
+	return RunParsedFileWithVars(ctx, parsedAPI, o, dir, row)
+}
+
+// RunDataIterations implements `--data`: the API file runs
+// once per row of the CSV/JSON data file, the row columns
+// resolving `${var}` references ahead of the environment.
+// Failing iterations don't stop the others; a summary of
+// every iteration is printed at the end. Returns the exit
+// code of the first failing iteration. Cancelling `ctx`
+// skips the remaining rows
+func RunDataIterations(ctx context.Context, apiContent string, o *lama2cmd.Opts, dir string) int {
+	rows, err := preprocess.LoadDataRows(o.Data)
+	if err != nil {
+		log.Error().Str("Type", "Controller").Str("DataFile", o.Data).Str("Error", err.Error()).Msg("Couldn't load data file")
+		return utils.ExitParse
+	}
+	if len(rows) == 0 {
+		log.Warn().Str("Type", "Controller").Str("DataFile", o.Data).Msg("No rows in data file")
+		return 0
+	}
+
+	if ctx, err = shareGenerator(ctx, o.Seed); err != nil {
+		log.Error().Str("Type", "Controller").Str("Error", err.Error()).Msg("Invalid options")
+		return utils.ExitFailure
+	}
+
+	summary := make([]RunSummary, 0, len(rows))
+	var last []StageResult
+	for i, row := range rows {
+		if ctx.Err() != nil {
+			break
+		}
+		label := iterationLabel(i+1, row)
+		log.Info().Str("Type", "Controller").Str("Iteration", label).Msg("Running")
+		start := time.Now()
+		results, err := RunIteration(ctx, apiContent, o, dir, row)
+		if err != nil {
+			log.Error().Str("Type", "Controller").Str("Iteration", label).Str("Error", err.Error()).Msg("Execution failed")
+		}
+		summary = append(summary, summarizeRun(label, results, err, time.Since(start)))
+		last = results
+	}
+	WriteSummary(os.Stdout, "ITERATION", "iterations", summary)
+
+	if o.Output != "" {
+		resp := LastResponse(last)
+		if err := outputmanager.WriteJSONOutput(resp.ExResponse, o.Output, resp.Attempts...); err != nil {
+			log.Error().Str("Type", "Controller").Str("Error", err.Error()).Msg("Couldn't write output")
+			return utils.ExitFailure
+		}
+	}
+	if ctx.Err() != nil {
+		return utils.ExitInterrupted
+	}
+	return summaryExitCode(summary)
+}
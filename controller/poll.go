@@ -0,0 +1,103 @@
+package contoller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/HexmosTech/gabs/v2"
+	"github.com/HexmosTech/lama2/cmdexec"
+	"github.com/HexmosTech/lama2/parser"
+	"github.com/HexmosTech/lama2/utils"
+	"github.com/dop251/goja"
+	"github.com/rs/zerolog/log"
+)
+
+// PollSpec describes a polled request block: the request
+// is sent again every Interval until the JS predicate Until
+// holds, for at most Timeout
+type PollSpec struct {
+	Until    string
+	Interval time.Duration
+	Timeout  time.Duration
+}
+
+// Defaults for the `@poll-interval` and
+// `@poll-timeout` annotations
+const (
+	DefaultPollInterval = time.Second
+	DefaultPollTimeout  = time.Minute
+)
+
+// PollSpecFor reads the `@poll-until <js expression>`,
+// `@poll-interval` and `@poll-timeout` annotations of a
+// request block; `ok` is false for blocks which don't poll
+func PollSpecFor(block *gabs.Container) (spec PollSpec, ok bool, err error) {
+	spec = PollSpec{Interval: DefaultPollInterval, Timeout: DefaultPollTimeout}
+	spec.Until, ok = parser.GetAnnotation(block, "poll-until")
+	if !ok {
+		for _, key := range []string{"poll-interval", "poll-timeout"} {
+			if _, found := parser.GetAnnotation(block, key); found {
+				return spec, false, fmt.Errorf("@%s requires @poll-until", key)
+			}
+		}
+		return spec, false, nil
+	}
+	if spec.Until == "" {
+		return spec, false, fmt.Errorf("@poll-until requires a JS expression")
+	}
+	for key, dest := range map[string]*time.Duration{"poll-interval": &spec.Interval, "poll-timeout": &spec.Timeout} {
+		if value, found := parser.GetAnnotation(block, key); found {
+			if *dest, err = ParseTimeout(value); err != nil {
+				return spec, false, fmt.Errorf("invalid @%s: %w", key, err)
+			}
+		}
+	}
+	return spec, true, nil
+}
+
+// pollPredicate evaluates the predicate of a polled block
+// against `resp`, bound as `response` (and `result`) in the
+// shared VM
+func pollPredicate(vm *goja.Runtime, spec PollSpec, r StageResult) (bool, error) {
+	cmdexec.BindResult(vm, r.Response.Body)
+	cmdexec.SetResponse(vm, r.Stage, r.Name, r.Response)
+	val, err := vm.RunString(spec.Until)
+	if err != nil {
+		return false, utils.NewExecError(utils.KindScript, 0, 0, fmt.Errorf("@poll-until %s: %w", spec.Until, err))
+	}
+	return val.ToBoolean(), nil
+}
+
+// pollRequest sends a polled block again until its
+// predicate holds, the poll timeout runs out (a transport
+// error) or a request fails. `result` holds the first
+// response on entry, and the latest one on return
+func (r *Runner) pollRequest(ctx context.Context, spec PollSpec, block *gabs.Container, vm *goja.Runtime, executor cmdexec.Executor, defaultTimeout time.Duration, result *StageResult) error {
+	start := time.Now().Add(-result.Elapsed)
+	for polls := 1; ; polls++ {
+		done, err := pollPredicate(vm, spec, *result)
+		if err != nil || done {
+			result.Elapsed = time.Since(start)
+			return err
+		}
+		if time.Since(start)+spec.Interval > spec.Timeout {
+			result.Elapsed = time.Since(start)
+			return utils.NewExecError(utils.KindTransport, 0, 0,
+				fmt.Errorf("polling timed out after %s (%d requests): `%s` still false", spec.Timeout, polls, spec.Until))
+		}
+		log.Info().Int("Stage", result.Stage).Int("Poll", polls).Int("Status", result.Response.StatusCode).Dur("Interval", spec.Interval).Msg("Condition not met; polling again")
+
+		timer := time.NewTimer(spec.Interval)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+		if _, err := r.sendRequest(ctx, block, vm, executor, defaultTimeout, result, true); err != nil {
+			result.Elapsed = time.Since(start)
+			return err
+		}
+	}
+}
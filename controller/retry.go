@@ -0,0 +1,229 @@
+package contoller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/HexmosTech/gabs/v2"
+	"github.com/HexmosTech/lama2/cmdexec"
+	outputmanager "github.com/HexmosTech/lama2/outputManager"
+	"github.com/HexmosTech/lama2/parser"
+	"github.com/HexmosTech/lama2/preprocess"
+	"github.com/rs/zerolog/log"
+)
+
+// RetryPolicy decides whether a failed request is sent
+// again, and after how long
+type RetryPolicy struct {
+	// Attempts is the maximum number of tries; 1 means
+	// the request is never retried
+	Attempts int
+	// Backoff is the delay before the first retry; it
+	// doubles with each retry, up to MaxBackoff, and is
+	// jittered by up to half its value
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Statuses are the response codes worth retrying
+	Statuses []int
+	// Network retries requests which got no response
+	// at all (connection refused or reset, DNS failures)
+	Network bool
+}
+
+// retrySettings maps the `@retry*` annotations of a
+// request block to the `l2config.env` (or environment)
+// variables setting them for every request
+var retrySettings = []struct{ annotation, variable string }{
+	{"retry", "L2_RETRY"},
+	{"retry-backoff", "L2_RETRY_BACKOFF"},
+	{"retry-max-backoff", "L2_RETRY_MAX_BACKOFF"},
+	{"retry-on", "L2_RETRY_ON"},
+}
+
+// DefaultRetryPolicy doesn't retry; once attempts are
+// configured, it retries gateway errors, 429 and network
+// errors, starting with a 500ms backoff
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		Attempts:   1,
+		Backoff:    500 * time.Millisecond,
+		MaxBackoff: 30 * time.Second,
+		Statuses:   []int{http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout},
+		Network:    true,
+	}
+}
+
+// RetryPolicyFor returns the retry policy of a request
+// block. Each setting comes from the block annotation
+// (`@retry 3`, `@retry-backoff 1s`, `@retry-max-backoff 10s`,
+// `@retry-on 503,504,network`) if present, otherwise from the
+// matching `L2_RETRY*` variable (looked up in `vars`, then
+// the environment), otherwise from DefaultRetryPolicy
+func RetryPolicyFor(block *gabs.Container, vars ...map[string]string) (RetryPolicy, error) {
+	policy := DefaultRetryPolicy()
+	for _, s := range retrySettings {
+		value, ok := parser.GetAnnotation(block, s.annotation)
+		source := "@" + s.annotation
+		if !ok {
+			value, ok = preprocess.LookupVar(s.variable, vars...)
+			source = s.variable
+		}
+		if !ok || value == "" {
+			continue
+		}
+		if err := policy.set(s.annotation, value); err != nil {
+			return policy, fmt.Errorf("invalid %s '%s': %w", source, value, err)
+		}
+	}
+	return policy, nil
+}
+
+func (p *RetryPolicy) set(setting string, value string) error {
+	var err error
+	switch setting {
+	case "retry":
+		p.Attempts, err = strconv.Atoi(value)
+		if err == nil && p.Attempts < 1 {
+			err = errors.New("expected at least 1 attempt")
+		}
+	case "retry-backoff":
+		p.Backoff, err = ParseTimeout(value)
+	case "retry-max-backoff":
+		p.MaxBackoff, err = ParseTimeout(value)
+	case "retry-on":
+		p.Statuses, p.Network = nil, false
+		for _, v := range strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' }) {
+			if v == "network" {
+				p.Network = true
+				continue
+			}
+			status, err := strconv.Atoi(v)
+			if err != nil {
+				return errors.New("expected status codes and/or `network`")
+			}
+			p.Statuses = append(p.Statuses, status)
+		}
+	}
+	return err
+}
+
+// ShouldRetry reports whether the outcome of a try is
+// worth retrying under the policy
+func (p RetryPolicy) ShouldRetry(resp cmdexec.Response, err error) bool {
+	if err != nil {
+		var netErr net.Error
+		return p.Network && errors.As(err, &netErr)
+	}
+	for _, s := range p.Statuses {
+		if resp.StatusCode == s {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay returns how long to wait after the given (1-based)
+// try. A `Retry-After` header on the response is honoured,
+// up to MaxBackoff
+func (p RetryPolicy) Delay(attempt int, resp cmdexec.Response) time.Duration {
+	if after, ok := retryAfter(resp.Header.Get("Retry-After")); ok {
+		if p.MaxBackoff > 0 && after > p.MaxBackoff {
+			return p.MaxBackoff
+		}
+		return after
+	}
+	delay := p.Backoff
+	for i := 1; i < attempt && (p.MaxBackoff == 0 || delay < p.MaxBackoff); i++ {
+		delay *= 2
+	}
+	if p.MaxBackoff > 0 && delay > p.MaxBackoff {
+		delay = p.MaxBackoff
+	}
+	if half := int64(delay / 2); half > 0 {
+		delay = time.Duration(half + rand.Int63n(half+1))
+	}
+	return delay
+}
+
+// retryAfter reads a `Retry-After` header, given either
+// in seconds or as an HTTP date
+func retryAfter(header string) (time.Duration, bool) {
+	if header == "" {
+		return 0, false
+	}
+	if secs, err := strconv.Atoi(header); err == nil && secs >= 0 {
+		return time.Duration(secs) * time.Second, true
+	}
+	if at, err := http.ParseTime(header); err == nil {
+		if d := time.Until(at); d > 0 {
+			return d, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
+
+// sendWithRetry sends a request block through `executor`
+// until it succeeds or the policy gives up, waiting between
+// tries. Each try is bounded by the timeout of `ctx` (see
+// withAttemptTimeout); one abandoned on that deadline is
+// reported as timed out, and retried like a network error.
+// Every try is logged and recorded in the attempts of the
+// returned response
+func sendWithRetry(ctx context.Context, block *gabs.Container, executor cmdexec.Executor, dir string, policy RetryPolicy) (cmdexec.Response, error) {
+	attempts := make([]outputmanager.Attempt, 0, 1)
+	timeout := attemptTimeout(ctx)
+	for n := 1; ; n++ {
+		start := time.Now()
+		resp, err := sendAttempt(ctx, block, executor, dir, timeout)
+		attempt := outputmanager.Attempt{Status: resp.StatusCode, Elapsed: time.Since(start)}
+		if err != nil {
+			attempt.Error = err.Error()
+		}
+		retry := n < policy.Attempts && ctx.Err() == nil && policy.ShouldRetry(resp, err)
+		if retry {
+			attempt.Delay = policy.Delay(n, resp)
+		}
+		attempts = append(attempts, attempt)
+		log.Debug().
+			Int("Attempt", n).
+			Int("Status", attempt.Status).
+			Str("Error", attempt.Error).
+			Dur("Elapsed", attempt.Elapsed).
+			Msg("Request attempt")
+		if !retry {
+			resp.Attempts = attempts
+			return resp, err
+		}
+
+		log.Warn().Int("Attempt", n).Int("Status", attempt.Status).Dur("Delay", attempt.Delay).Msg("Retrying request")
+		timer := time.NewTimer(attempt.Delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return cmdexec.Response{Attempts: attempts}, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// sendAttempt is a single try of sendWithRetry
+func sendAttempt(ctx context.Context, block *gabs.Container, executor cmdexec.Executor, dir string, timeout time.Duration) (cmdexec.Response, error) {
+	if timeout <= 0 {
+		return executor.Execute(ctx, block, dir)
+	}
+	attemptCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	resp, err := executor.Execute(attemptCtx, block, dir)
+	if err != nil && ctx.Err() == nil && errors.Is(attemptCtx.Err(), context.DeadlineExceeded) {
+		err = fmt.Errorf("request timed out after %s: %w", timeout, context.DeadlineExceeded)
+	}
+	return resp, err
+}
@@ -0,0 +1,406 @@
+package contoller
+
+import (
+	"context"
+	"fmt"
+	stdlog "log"
+	"strconv"
+	"time"
+
+	"github.com/HexmosTech/gabs/v2"
+	"github.com/HexmosTech/lama2/cmdexec"
+	"github.com/HexmosTech/lama2/lama2cmd"
+	"github.com/HexmosTech/lama2/parser"
+	"github.com/HexmosTech/lama2/preprocess"
+	"github.com/HexmosTech/lama2/utils"
+	"github.com/dop251/goja"
+	"github.com/dop251/goja_nodejs/console"
+	"github.com/rs/zerolog/log"
+)
+
+// Runner holds what a run of a parsed API file needs
+// besides the blocks themselves. A Runner doesn't touch
+// the CWD or the process environment, so several runs
+// may proceed concurrently
+type Runner struct {
+	Opts *lama2cmd.Opts
+	// Dir is the directory of the API file; relative
+	// paths (such as multipart files) are resolved against it
+	Dir string
+	// Vars are variable layers, consulted in order ahead
+	// of the process environment (e.g. a `--data` row)
+	Vars []map[string]string
+	// Executor sends the requests; when nil, the one
+	// chosen through Opts is used (see cmdexec.GetExecutor)
+	Executor cmdexec.Executor
+	// Console receives the `console` output of processor
+	// blocks, which is also kept in StageResult.Logs; when
+	// nil, the output goes to stderr
+	Console console.Printer
+	// Jar holds the cookies shared by the stages; when nil,
+	// the run starts with the jar saved at `--cookie-jar`, if
+	// given, or else an empty one
+	Jar *cmdexec.CookieJar
+	// SkipHookFile ignores the `l2hooks.js` of Dir (see
+	// cmdexec.HookFile), which is only read when Dir is set
+	SkipHookFile bool
+
+	// strict refuses to send requests with undefined
+	// variables (see StrictMode)
+	strict bool
+}
+
+// runState is what a run saves once it's over
+type runState struct {
+	statePath   string
+	persisted   map[int]PersistedStage
+	jar         *cmdexec.CookieJar
+	session     *Session
+	sessionPath string
+}
+
+// Run executes the blocks of `parsedAPI` in order; see
+// RunParsedFile. Cancelling `ctx` abandons the request in
+// flight and interrupts a running processor block; the
+// results of the stages completed so far are returned with
+// the context error. Each request is also bounded by its
+// timeout (see BlockTimeout). Processor blocks may change
+// the course of the run through `l2.skipNext()`, `l2.stop()`
+// and `l2.goto()` (see cmdexec.FlowDirective)
+func (r *Runner) Run(ctx context.Context, parsedAPI *gabs.Container) ([]StageResult, error) {
+	// The variable layers grow with the session; work on a
+	// copy so that the Runner may be used again
+	runner := *r
+	r = &runner
+	o := r.Opts
+	parsedAPIblocks := GetParsedAPIBlocks(parsedAPI)
+	selected, lastStage, err := SelectStages(parsedAPIblocks, o.Stage)
+	if err != nil {
+		return nil, err
+	}
+	defaultTimeout, err := ParseTimeout(o.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	st, err := r.loadState()
+	if err != nil {
+		return nil, err
+	}
+	jar := st.jar
+	ctx = cmdexec.WithCookieJar(ctx, jar)
+
+	executor := r.Executor
+	if executor == nil {
+		executor = cmdexec.GetExecutor(o)
+	}
+	forward := r.Console
+	if forward == nil {
+		forward = console.PrinterFunc(func(s string) { stdlog.Print(s) })
+	}
+
+	results := []StageResult{{Stage: 0}}
+	vm, err := cmdexec.NewJSVm(console.PrinterFunc(func(s string) {
+		current := &results[len(results)-1]
+		current.Logs = append(current.Logs, s)
+		forward.Log(s)
+	}))
+	if err != nil {
+		return nil, utils.NewExecError(utils.KindScript, 0, 0, err)
+	}
+	cmdexec.BindCookieJar(vm, jar)
+	cmdexec.BindFetch(ctx, vm, executor, r.Dir, defaultTimeout)
+	gen := preprocess.GeneratorFrom(ctx)
+	if gen == nil {
+		if gen, err = NewGenerator(o.Seed); err != nil {
+			return nil, utils.NewExecError(utils.KindParse, 0, 0, err)
+		}
+	}
+	preprocess.BindGenerator(vm, gen)
+	if st.session != nil {
+		BindSession(vm, st.session)
+	}
+	if r.Dir != "" && !r.SkipHookFile {
+		if err := cmdexec.LoadHookFile(vm, r.Dir); err != nil {
+			return nil, utils.NewExecError(utils.KindScript, 0, 0, err)
+		}
+	}
+	finished := make(chan struct{})
+	defer close(finished)
+	interrupt := cmdexec.Interrupter(vm)
+	go func() {
+		select {
+		case <-ctx.Done():
+			interrupt(ctx.Err())
+		case <-finished:
+		}
+	}()
+	stages := stageNumbers(parsedAPIblocks)
+	if r.strict, err = StrictMode(o.Strict, r.Vars...); err != nil {
+		return nil, utils.NewExecError(utils.KindParse, 0, 0, err)
+	}
+	if r.strict {
+		if err := preflight(parsedAPIblocks, stages, selected, lastStage, vm, r.Vars...); err != nil {
+			return results, err
+		}
+	}
+	pristine := make(map[int]*gabs.Container)
+	jumps := 0
+	var firstErr error
+	for i := 0; i < len(parsedAPIblocks); i++ {
+		block := parsedAPIblocks[i]
+		if err := ctx.Err(); err != nil {
+			return results, err
+		}
+		log.Debug().Int("Block num", i).Msg("")
+		log.Debug().Str("Block getting processed", block.String()).Msg("")
+		blockType := block.S("type").Data().(string)
+		if blockType == "processor" {
+			err = ExecuteProcessorBlock(block, vm)
+			current := &results[len(results)-1]
+			current.Tests = append(current.Tests, cmdexec.CollectTestResults(vm)...)
+			if ctx.Err() != nil {
+				return results, ctx.Err()
+			}
+			if err != nil {
+				err = locateError(err, utils.KindScript, i+1, block)
+				if !o.ContinueOnError {
+					current.Err = err
+					return results, err
+				}
+				log.Error().Str("Type", "Controller").Str("Error", err.Error()).Msg("Continuing after error")
+				if current.Err == nil {
+					current.Err = err
+				}
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+
+			flow := cmdexec.TakeFlowDirective(vm)
+			switch flow.Kind {
+			case cmdexec.FlowStop:
+				log.Info().Str("Type", "Controller").Str("Reason", flow.Reason).Msg("Stopped by l2.stop()")
+				return r.finish(results, firstErr, st)
+			case cmdexec.FlowSkipNext:
+				if j := nextStage(parsedAPIblocks, stages, i); j >= 0 {
+					name, _ := parser.GetAnnotation(parsedAPIblocks[j], "name")
+					log.Info().Int("Stage", stages[j]).Msg("Skipped by l2.skipNext()")
+					results = append(results, StageResult{Stage: stages[j], Name: name, Skipped: true})
+					// Skip the processor block following the stage too
+					i = j + 1
+				}
+			case cmdexec.FlowGoto:
+				j, err := findStage(parsedAPIblocks, stages, flow.Target)
+				if err == nil && jumps >= MaxJumps {
+					err = fmt.Errorf("l2.goto(%q): more than %d jumps; stopping to avoid an endless loop", flow.Target, MaxJumps)
+				}
+				if err != nil {
+					err = locateError(err, utils.KindScript, i+1, block)
+					current := &results[len(results)-1]
+					if current.Err == nil {
+						current.Err = err
+					}
+					return results, err
+				}
+				jumps++
+				log.Debug().Str("Target", flow.Target).Int("Jump", jumps).Msg("Following l2.goto()")
+				i = j - 1
+			}
+		} else if blockType == "Lama2File" {
+			stage := stages[i]
+			if stage > lastStage {
+				break
+			}
+			if original, ok := pristine[i]; ok {
+				block = cloneBlock(original)
+			} else {
+				pristine[i] = cloneBlock(block)
+			}
+			name, _ := parser.GetAnnotation(block, "name")
+			result := StageResult{Stage: stage, Name: name}
+			if !selected[stage] {
+				if ReplayStage(&result, st.persisted, vm) {
+					replayCaptures(block, vm, result.Response)
+				}
+				result.Skipped = true
+				results = append(results, result)
+				continue
+			}
+			resp, err := r.runRequest(ctx, block, vm, executor, defaultTimeout, &result)
+			if ctx.Err() != nil {
+				return results, ctx.Err()
+			}
+			if err != nil {
+				result.Err = locateError(err, utils.KindTransport, i+1, block)
+				results = append(results, result)
+				if !o.ContinueOnError {
+					return results, result.Err
+				}
+				log.Error().Str("Type", "Controller").Str("Error", result.Err.Error()).Msg("Continuing after error")
+				if firstErr == nil {
+					firstErr = result.Err
+				}
+				// The blocks which follow shouldn't see the
+				// response of an earlier stage as this one's
+				BindStageResponse(result, vm)
+				continue
+			}
+			results = append(results, result)
+			BindStageResponse(result, vm)
+			st.persisted[stage] = toPersistedStage(block, resp.ExResponse)
+		}
+	}
+	return r.finish(results, firstErr, st)
+}
+
+// NewGenerator returns the Generator of the dynamic
+// variables for `--seed`: seeded with the given integer, or
+// unseeded if empty
+func NewGenerator(seed string) (*preprocess.Generator, error) {
+	if seed == "" {
+		return preprocess.NewGenerator(), nil
+	}
+	n, err := strconv.ParseInt(seed, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid --seed '%s': expected an integer", seed)
+	}
+	return preprocess.NewSeededGenerator(n), nil
+}
+
+// shareGenerator returns a context making the runs within
+// it share one Generator, so that a seeded sequence carries
+// on from one run to the next rather than restarting
+func shareGenerator(ctx context.Context, seed string) (context.Context, error) {
+	if seed == "" || preprocess.GeneratorFrom(ctx) != nil {
+		return ctx, nil
+	}
+	gen, err := NewGenerator(seed)
+	if err != nil {
+		return ctx, err
+	}
+	return preprocess.WithGenerator(ctx, gen), nil
+}
+
+// loadState reads what earlier runs saved: the stage
+// responses (`--persist`), the cookie jar (`--cookie-jar`,
+// or else the session) and the session (`--session`), whose
+// variables become the last layer before the environment
+func (r *Runner) loadState() (*runState, error) {
+	o := r.Opts
+	st := &runState{persisted: make(map[int]PersistedStage), jar: r.Jar}
+	if o.Persist {
+		st.statePath = RunStatePath(o.Positional.LamaAPIFile)
+		st.persisted = LoadRunState(st.statePath)
+	}
+	if o.Session != "" {
+		path, err := SessionPath(r.Dir, o.Session)
+		if err != nil {
+			return nil, err
+		}
+		if st.session, err = LoadSession(path); err != nil {
+			return nil, err
+		}
+		st.sessionPath = path
+		r.Vars = append(append([]map[string]string{}, r.Vars...), st.session.Values())
+	}
+	if st.jar == nil && o.CookieJar != "" {
+		jar, err := cmdexec.LoadCookieJar(o.CookieJar)
+		if err != nil {
+			return nil, err
+		}
+		st.jar = jar
+	} else if st.jar == nil {
+		st.jar = cmdexec.NewCookieJar()
+		if st.session != nil {
+			st.jar.Restore(st.session.Cookies)
+		}
+	}
+	return st, nil
+}
+
+// finish saves the stage responses, the cookies and the
+// session as asked to, and returns the outcome of the run
+func (r *Runner) finish(results []StageResult, firstErr error, st *runState) ([]StageResult, error) {
+	if r.Opts.Persist {
+		if err := SaveRunState(st.statePath, st.persisted); err != nil {
+			log.Error().Str("Type", "Controller").Str("Path", st.statePath).Msg("Couldn't persist stage responses")
+		}
+	}
+	if r.Opts.CookieJar != "" {
+		if err := st.jar.Save(r.Opts.CookieJar); err != nil {
+			log.Error().Str("Type", "Controller").Str("Path", r.Opts.CookieJar).Str("Error", err.Error()).Msg("Couldn't save cookie jar")
+		}
+	}
+	if st.session != nil {
+		st.session.Cookies = st.jar.All()
+		st.session.Record(results)
+		if err := st.session.Save(st.sessionPath); err != nil {
+			log.Error().Str("Type", "Controller").Str("Path", st.sessionPath).Str("Error", err.Error()).Msg("Couldn't save session")
+		}
+	}
+	return results, firstErr
+}
+
+// runRequest sends a requester block, polling it if
+// annotated with `@poll-until` (see PollSpecFor), and records
+// the final response and the elapsed time in `result`. The
+// `@capture` annotations (see CapturesFor) are then applied
+// to the final response
+func (r *Runner) runRequest(ctx context.Context, block *gabs.Container, vm *goja.Runtime, executor cmdexec.Executor, defaultTimeout time.Duration, result *StageResult) (cmdexec.Response, error) {
+	spec, poll, err := PollSpecFor(block)
+	if err != nil {
+		return cmdexec.Response{}, utils.NewExecError(utils.KindParse, 0, 0, err)
+	}
+	captures, err := CapturesFor(block)
+	if err != nil {
+		return cmdexec.Response{}, utils.NewExecError(utils.KindParse, 0, 0, err)
+	}
+	resp, err := r.sendRequest(ctx, block, vm, executor, defaultTimeout, result, false)
+	if err == nil && poll {
+		err = r.pollRequest(ctx, spec, block, vm, executor, defaultTimeout, result)
+		resp = result.Response
+	}
+	if err != nil {
+		return resp, err
+	}
+	if err := applyCaptures(vm, captures, resp); err != nil {
+		return resp, utils.NewExecError(utils.KindScript, 0, 0, err)
+	}
+	return resp, nil
+}
+
+// checkStrict refuses a request block with undefined
+// variables in strict mode
+func (r *Runner) checkStrict(block *gabs.Container, vm *goja.Runtime) error {
+	if !r.strict {
+		return nil
+	}
+	return checkResolved(block, vm, r.Vars...)
+}
+
+// sendRequest runs a requester block, with each try bounded
+// by its timeout (see withAttemptTimeout), recording the
+// response and elapsed time in `result`; `resend` skips the
+// variable expansion of a block sent before
+func (r *Runner) sendRequest(ctx context.Context, block *gabs.Container, vm *goja.Runtime, executor cmdexec.Executor, defaultTimeout time.Duration, result *StageResult, resend bool) (cmdexec.Response, error) {
+	timeout, err := BlockTimeout(block, defaultTimeout)
+	if err != nil {
+		return cmdexec.Response{}, utils.NewExecError(utils.KindParse, 0, 0, err)
+	}
+	reqCtx := withAttemptTimeout(ctx, timeout)
+	if !resend {
+		if err := r.checkStrict(block, vm); err != nil {
+			return cmdexec.Response{}, err
+		}
+	}
+	start := time.Now()
+	var resp cmdexec.Response
+	if resend {
+		resp, err = SendRequestorBlock(reqCtx, block, executor, r.Dir, r.Vars...)
+	} else {
+		resp, err = ExecuteRequestorBlock(reqCtx, block, vm, executor, r.Dir, r.Vars...)
+	}
+	result.Elapsed = time.Since(start)
+	result.Response = resp
+	return resp, err
+}
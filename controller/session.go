@@ -0,0 +1,172 @@
+package contoller
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"github.com/HexmosTech/lama2/cmdexec"
+	"github.com/HexmosTech/lama2/preprocess"
+	"github.com/HexmosTech/lama2/utils"
+	"github.com/dop251/goja"
+)
+
+var reSessionName = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// Session is the state which `--session <name>` keeps
+// between runs: the variables stored through
+// `l2.session.set()`, the cookie jar, and the latest
+// responses of the named stages
+type Session struct {
+	Vars    map[string]interface{} `json:"vars"`
+	Cookies []cmdexec.StoredCookie `json:"cookies"`
+	// Responses holds the latest response of every named
+	// stage, and Last that of the final stage of a run
+	Responses map[string]PersistedStage `json:"responses"`
+	Last      *PersistedStage           `json:"last,omitempty"`
+	Updated   time.Time                 `json:"updated"`
+
+	// values mirrors Vars as strings, for expanding `${var}`
+	values map[string]string
+}
+
+// SessionPath returns the file of the session `name` for
+// API files in `dir`: `.lama2/sessions/<name>.json` in the
+// project root (the directory holding `l2config.env`, or
+// else `dir` itself)
+func SessionPath(dir string, name string) (string, error) {
+	if !reSessionName.MatchString(name) || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid session name %q; use letters, digits, '.', '_' and '-'", name)
+	}
+	root, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	if config, err := preprocess.SearchL2ConfigEnv(root); err == nil {
+		root = filepath.Dir(config)
+	}
+	return filepath.Join(root, ".lama2", "sessions", name+".json"), nil
+}
+
+// LoadSession reads a session file; a missing
+// file yields an empty session
+func LoadSession(path string) (*Session, error) {
+	s := &Session{}
+	b, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, s); err != nil {
+			return nil, fmt.Errorf("reading session %s: %w", path, err)
+		}
+	}
+	if s.Vars == nil {
+		s.Vars = make(map[string]interface{})
+	}
+	if s.Responses == nil {
+		s.Responses = make(map[string]PersistedStage)
+	}
+	s.values = make(map[string]string, len(s.Vars))
+	for k, v := range s.Vars {
+		s.values[k] = sessionString(v)
+	}
+	return s, nil
+}
+
+// Save writes the session to `path`, creating
+// the parent directories when required
+func (s *Session) Save(path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	s.Updated = time.Now().UTC()
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, b, 0o600)
+}
+
+// Values returns the session variables as strings (JSON
+// for non-string values); the map follows later calls to
+// `l2.session.set()`, so it can serve as a variable layer
+func (s *Session) Values() map[string]string {
+	return s.values
+}
+
+func (s *Session) set(name string, value interface{}) {
+	s.Vars[name] = value
+	s.values[name] = sessionString(value)
+}
+
+func (s *Session) delete(name string) {
+	delete(s.Vars, name)
+	delete(s.values, name)
+}
+
+func sessionString(v interface{}) string {
+	if str, ok := v.(string); ok {
+		return str
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Sprint(v)
+	}
+	return string(b)
+}
+
+// Record keeps the responses of a run: those of named
+// stages by name, and the final one as Last
+func (s *Session) Record(results []StageResult) {
+	for _, r := range results {
+		if r.Stage == 0 || r.Skipped || r.Response.StatusCode == 0 {
+			continue
+		}
+		p := PersistedStage{Name: r.Name, StatusCode: r.Response.StatusCode, Body: r.Response.Body, Headers: r.Response.Headers}
+		if r.Name != "" {
+			s.Responses[r.Name] = p
+		}
+		s.Last = &p
+	}
+}
+
+// BindSession exposes the session to the processor blocks
+// as `l2.session`: `get(name)`, `set(name, value)`,
+// `delete(name)`, `vars()`, and `response(stageName)` which
+// returns a saved response (the last one without a name)
+func BindSession(vm *goja.Runtime, s *Session) {
+	obj := vm.NewObject()
+	obj.Set("get", func(name string) goja.Value {
+		v, ok := s.Vars[name]
+		if !ok {
+			return goja.Undefined()
+		}
+		return vm.ToValue(v)
+	})
+	obj.Set("set", func(name string, value goja.Value) {
+		if goja.IsUndefined(value) {
+			s.delete(name)
+			return
+		}
+		s.set(name, value.Export())
+	})
+	obj.Set("delete", func(name string) { s.delete(name) })
+	obj.Set("vars", func() goja.Value { return vm.ToValue(s.Vars) })
+	obj.Set("response", func(call goja.FunctionCall) goja.Value {
+		var p *PersistedStage
+		if name := call.Argument(0); goja.IsUndefined(name) {
+			p = s.Last
+		} else if saved, ok := s.Responses[name.String()]; ok {
+			p = &saved
+		}
+		if p == nil {
+			return goja.Undefined()
+		}
+		return vm.ToValue(map[string]interface{}{"status": p.StatusCode, "headers": cmdexec.NewHeaderObject(vm, utils.UnflattenHeader(p.Headers)), "body": p.Body})
+	})
+	vm.Get("l2").ToObject(vm).Set("session", obj)
+}
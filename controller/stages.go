@@ -0,0 +1,139 @@
+package contoller
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/HexmosTech/gabs/v2"
+	"github.com/HexmosTech/httpie-go"
+	"github.com/HexmosTech/lama2/parser"
+	"github.com/HexmosTech/lama2/utils"
+	"github.com/rs/zerolog/log"
+)
+
+var reStageRange = regexp.MustCompile(`^(\d+)-(\d*)$`)
+
+// SelectStages interprets the `--stage` specification
+// against the requester blocks (stages) of a file. Stages
+// are numbered from 1 in file order; the specification is
+// a comma separated list of numbers (`2`), ranges (`2-4`,
+// `3-`) or stage names given through `@name`. An empty
+// specification selects every stage. Along with the selection,
+// the highest selected stage number is returned.
+func SelectStages(blocks []*gabs.Container, spec string) (map[int]bool, int, error) {
+	names := make(map[string]int)
+	total := 0
+	for _, block := range blocks {
+		if block.S("type").Data().(string) != "Lama2File" {
+			continue
+		}
+		total++
+		if name, ok := parser.GetAnnotation(block, "name"); ok {
+			names[name] = total
+		}
+	}
+
+	selected := make(map[int]bool)
+	if strings.TrimSpace(spec) == "" {
+		for i := 1; i <= total; i++ {
+			selected[i] = true
+		}
+		return selected, total, nil
+	}
+
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if n, err := strconv.Atoi(item); err == nil {
+			if n < 1 || n > total {
+				return nil, 0, fmt.Errorf("stage %d out of range; file has %d stages", n, total)
+			}
+			selected[n] = true
+		} else if m := reStageRange.FindStringSubmatch(item); m != nil {
+			low, _ := strconv.Atoi(m[1])
+			high := total
+			if m[2] != "" {
+				high, _ = strconv.Atoi(m[2])
+			}
+			if low < 1 || high > total || low > high {
+				return nil, 0, fmt.Errorf("stage range %s invalid; file has %d stages", item, total)
+			}
+			for i := low; i <= high; i++ {
+				selected[i] = true
+			}
+		} else if n, ok := names[item]; ok {
+			selected[n] = true
+		} else {
+			return nil, 0, fmt.Errorf("no stage named %q", item)
+		}
+	}
+
+	last := 0
+	for n := range selected {
+		if n > last {
+			last = n
+		}
+	}
+	return selected, last, nil
+}
+
+// PersistedStage is the response of a single stage
+// as saved by `--persist`
+type PersistedStage struct {
+	Name       string            `json:"name,omitempty"`
+	StatusCode int               `json:"status"`
+	Body       string            `json:"body"`
+	Headers    map[string]string `json:"headers"`
+}
+
+// RunStatePath returns the location where `--persist`
+// saves the stage responses of the given API file; a
+// `.lama2` directory next to the file
+func RunStatePath(apiFile string) string {
+	_, dir, fname := utils.GetFilePathComponents(apiFile)
+	return filepath.Join(dir, ".lama2", fname+".json")
+}
+
+// LoadRunState reads the stage responses persisted by
+// an earlier run. A missing or unreadable state file
+// results in an empty map
+func LoadRunState(statePath string) map[int]PersistedStage {
+	state := make(map[int]PersistedStage)
+	b, err := os.ReadFile(statePath)
+	if err != nil {
+		log.Debug().Str("Type", "Controller").Str("Path", statePath).Msg("No persisted run found")
+		return state
+	}
+	if err := json.Unmarshal(b, &state); err != nil {
+		log.Warn().Str("Type", "Controller").Str("Path", statePath).Msg("Ignoring malformed persisted run")
+		return make(map[int]PersistedStage)
+	}
+	return state
+}
+
+// SaveRunState writes the stage responses to `statePath`,
+// creating the parent directory when required
+func SaveRunState(statePath string, state map[int]PersistedStage) error {
+	if err := os.MkdirAll(filepath.Dir(statePath), 0o755); err != nil {
+		return err
+	}
+	b, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(statePath, b, 0o644)
+}
+
+func toPersistedStage(block *gabs.Container, resp httpie.ExResponse) PersistedStage {
+	name, _ := parser.GetAnnotation(block, "name")
+	return PersistedStage{
+		Name:       name,
+		StatusCode: resp.StatusCode,
+		Body:       resp.Body,
+		Headers:    resp.Headers,
+	}
+}
@@ -0,0 +1,138 @@
+package contoller
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/HexmosTech/gabs/v2"
+	"github.com/HexmosTech/lama2/cmdexec"
+	"github.com/HexmosTech/lama2/parser"
+	"github.com/HexmosTech/lama2/preprocess"
+	"github.com/HexmosTech/lama2/utils"
+	"github.com/dop251/goja"
+)
+
+// UnresolvedVar is a variable which a request block
+// refers to but which isn't defined anywhere
+type UnresolvedVar struct {
+	preprocess.UnresolvedRef
+	// Block (1-based) and Line locate the request block;
+	// Block is 0 when reported for the block being sent
+	Block int
+	Line  int
+}
+
+// UnresolvedError is the error of a strict run (see
+// StrictMode) which found undefined variables; nothing
+// was sent for the blocks listed
+type UnresolvedError struct {
+	Vars []UnresolvedVar
+}
+
+func (e *UnresolvedError) Error() string {
+	spread := false
+	for _, v := range e.Vars {
+		spread = spread || v.Block != e.Vars[0].Block
+	}
+	refs := make([]string, 0, len(e.Vars))
+	for _, v := range e.Vars {
+		ref := fmt.Sprintf("${%s} in %s", v.Name, v.Field)
+		if spread {
+			ref += fmt.Sprintf(" (block %d, line %d)", v.Block, v.Line)
+		}
+		refs = append(refs, ref)
+	}
+	return fmt.Sprintf("unresolved variables, refusing to send: %s", strings.Join(refs, ", "))
+}
+
+// StrictMode reports whether requests with undefined
+// variables must be refused rather than sent with empty
+// strings in their place: set through `--strict`, or the
+// `L2_STRICT` variable (looked up in `vars`, then the
+// environment)
+func StrictMode(strict bool, vars ...map[string]string) (bool, error) {
+	if strict {
+		return true, nil
+	}
+	value, ok := preprocess.LookupVar("L2_STRICT", vars...)
+	if !ok || value == "" {
+		return false, nil
+	}
+	strict, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("invalid L2_STRICT '%s': expected true or false", value)
+	}
+	return strict, nil
+}
+
+// checkResolved returns an UnresolvedError (as a variable
+// ExecError) if a request block about to be sent refers to
+// undefined variables
+func checkResolved(block *gabs.Container, vm *goja.Runtime, vars ...map[string]string) error {
+	refs := preprocess.FindUnresolved(block, vm, vars...)
+	if len(refs) == 0 {
+		return nil
+	}
+	unresolved := &UnresolvedError{}
+	for _, ref := range refs {
+		unresolved.Vars = append(unresolved.Vars, UnresolvedVar{UnresolvedRef: ref, Line: blockLine(block)})
+	}
+	return utils.NewExecError(utils.KindVariable, 0, 0, unresolved)
+}
+
+// preflight checks the selected request blocks before
+// anything is sent, so that every undefined variable is
+// reported at once. A variable which a processor block
+// before the request declares or assigns (see
+// cmdexec.AssignedNames) may be set by then, so it's left
+// for the check made when the request is sent. So is a
+// reference to the response of a named stage, such as
+// `${login.response.status}`, or a variable set by the
+// `@capture` annotation of an earlier request block
+func preflight(blocks []*gabs.Container, stages map[int]int, selected map[int]bool, lastStage int, vm *goja.Runtime, vars ...map[string]string) error {
+	names := make(map[string]bool)
+	for _, block := range blocks {
+		if block.S("type").Data().(string) != "Lama2File" {
+			continue
+		}
+		if name, ok := parser.GetAnnotation(block, "name"); ok {
+			names[name] = true
+		}
+	}
+	assigned := make(map[string]bool)
+	// scripts holds the processor blocks which don't parse;
+	// any name they mention may be set
+	var scripts strings.Builder
+	unresolved := &UnresolvedError{}
+	for i, block := range blocks {
+		if block.S("type").Data().(string) == "processor" {
+			if script, ok := block.S("value").Data().(*gabs.Container).Data().(string); ok {
+				if set, ok := cmdexec.AssignedNames(script); ok {
+					for name := range set {
+						assigned[name] = true
+					}
+				} else {
+					scripts.WriteString(script + "\n")
+				}
+			}
+			continue
+		}
+		stage, ok := stages[i]
+		if !ok || stage > lastStage || !selected[stage] {
+			continue
+		}
+		captured := CaptureNames(blocks[:i])
+		for _, ref := range preprocess.FindUnresolved(block, vm, vars...) {
+			refStage, isRef := preprocess.StageRefName(ref.Name)
+			if !assigned[ref.Name] && !preprocess.ScriptMentions(scripts.String(), ref.Name) && !(isRef && names[refStage]) && !captured[ref.Name] {
+				unresolved.Vars = append(unresolved.Vars, UnresolvedVar{UnresolvedRef: ref, Block: i + 1, Line: blockLine(block)})
+			}
+		}
+	}
+	if len(unresolved.Vars) == 0 {
+		return nil
+	}
+	first := unresolved.Vars[0]
+	return utils.NewExecError(utils.KindVariable, first.Block, first.Line, unresolved)
+}
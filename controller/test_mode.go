@@ -0,0 +1,136 @@
+package contoller
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/HexmosTech/lama2/lama2cmd"
+	outputmanager "github.com/HexmosTech/lama2/outputManager"
+	"github.com/HexmosTech/lama2/parser"
+	"github.com/HexmosTech/lama2/preprocess"
+	"github.com/HexmosTech/lama2/utils"
+	"github.com/rs/zerolog/log"
+)
+
+func stageLabel(r StageResult) string {
+	if r.Stage == 0 {
+		return "setup"
+	}
+	if r.Name != "" {
+		return fmt.Sprintf("stage %d (%s)", r.Stage, r.Name)
+	}
+	return fmt.Sprintf("stage %d", r.Stage)
+}
+
+// runTestFile executes a single API file and converts
+// its stage results into a test suite. Parse and run
+// errors become failed cases, so the caller can move on
+// to the next file; the exit code the file would have had
+// on its own (see RunExitCode) is returned along with the
+// suite. The runs within `ctx` share a Generator (see
+// shareGenerator)
+func runTestFile(ctx context.Context, fpath string, t *lama2cmd.TestOpts) (outputmanager.TestSuite, int) {
+	suite := outputmanager.TestSuite{Name: fpath}
+	start := time.Now()
+	fail := func(name string, err error) (outputmanager.TestSuite, int) {
+		suite.Cases = append(suite.Cases, outputmanager.TestCase{Name: name, Passed: false, Message: err.Error()})
+		suite.Elapsed = time.Since(start)
+		return suite, utils.ExitCode(err)
+	}
+
+	content, err := preprocess.GetLamaFileAsString(fpath)
+	if err != nil {
+		return fail("read", utils.NewExecError(utils.KindParse, 0, 0, err))
+	}
+	_, dir, _ := utils.GetFilePathComponents(fpath)
+	restore := IsolateEnvironment()
+	defer restore()
+	if err := LoadAPIEnvironment(dir, t.Env); err != nil {
+		return fail("environment", err)
+	}
+
+	parsedAPI, err := parser.NewLama2Parser().Parse(content)
+	if err != nil {
+		return fail("parse", parseError(err))
+	}
+
+	o := &lama2cmd.Opts{Executor: t.Executor, Quiet: true, Strict: t.Strict, Seed: t.Seed}
+	o.Positional.LamaAPIFile = fpath
+	results, err := RunParsedFileWithVars(ctx, parsedAPI, o, dir, nil)
+	for _, r := range results {
+		for _, test := range r.Tests {
+			suite.Cases = append(suite.Cases, outputmanager.TestCase{
+				Name:    stageLabel(r) + ": " + test.Name,
+				Passed:  test.Passed,
+				Message: test.Error,
+				Elapsed: r.Elapsed,
+			})
+		}
+	}
+	if err != nil {
+		return fail("run", err)
+	}
+	if len(suite.Cases) == 0 {
+		suite.Cases = append(suite.Cases, outputmanager.TestCase{Name: "run", Passed: true})
+	}
+	suite.Elapsed = time.Since(start)
+	return suite, RunExitCode(results, nil)
+}
+
+// RunTestMode implements `l2 test [options] [path]`. Every
+// `.l2` file under the path runs in turn, carrying on past
+// failing files. The `expect()`/`l2.test()` outcomes are
+// reported in TAP (stdout by default) and optionally as
+// JUnit XML. The returned exit code is that of the first
+// failing file, such as `utils.ExitAssertion` for a failed
+// test, or `utils.ExitOK`
+func RunTestMode(args []string) int {
+	t := lama2cmd.GetTestCmd(args)
+	files, err := CollectAPIFiles(t.Positional.Path, t.Include, t.Exclude)
+	if err != nil {
+		log.Error().Str("Type", "Controller").Str("Path", t.Positional.Path).Str("Error", err.Error()).Msg("Couldn't collect API files")
+		return utils.ExitFailure
+	}
+
+	// A seeded sequence carries on from one file to the next,
+	// as it does within a collection
+	ctx, err := shareGenerator(context.Background(), t.Seed)
+	if err != nil {
+		log.Error().Str("Type", "Controller").Str("Error", err.Error()).Msg("Invalid seed")
+		return utils.ExitFailure
+	}
+
+	suites := make([]outputmanager.TestSuite, 0, len(files))
+	code := utils.ExitOK
+	for _, f := range files {
+		log.Info().Str("Type", "Controller").Str("LamaFile", f).Msg("Testing")
+		suite, fileCode := runTestFile(ctx, f, t)
+		if code == utils.ExitOK {
+			code = fileCode
+		}
+		suites = append(suites, suite)
+	}
+
+	tapOut := os.Stdout
+	if t.TAP != "" {
+		f, err := os.Create(t.TAP)
+		if err != nil {
+			log.Error().Str("Type", "Controller").Str("Path", t.TAP).Msg("Couldn't create TAP report")
+			return utils.ExitFailure
+		}
+		defer f.Close()
+		tapOut = f
+	}
+	outputmanager.WriteTAPReport(suites, tapOut)
+
+	if t.JUnit != "" {
+		if err := outputmanager.WriteJUnitReport(suites, t.JUnit); err != nil {
+			log.Error().Str("Type", "Controller").Str("Path", t.JUnit).Msg("Couldn't write JUnit report")
+			return utils.ExitFailure
+		}
+	}
+
+	return code
+}
@@ -0,0 +1,62 @@
+package contoller
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/HexmosTech/gabs/v2"
+	"github.com/HexmosTech/lama2/parser"
+)
+
+// ParseTimeout reads a timeout given either as a Go
+// duration (`1m30s`, `500ms`) or as a number of
+// seconds (`5`, `2.5`), which must be positive. An empty
+// string means no timeout
+func ParseTimeout(spec string) (time.Duration, error) {
+	if spec == "" {
+		return 0, nil
+	}
+	invalid := fmt.Errorf("invalid timeout '%s'; expected a duration such as 30s, 500ms or 1m", spec)
+	if secs, err := strconv.ParseFloat(spec, 64); err == nil {
+		d := secs * float64(time.Second)
+		if math.IsNaN(d) || d <= 0 || d > math.MaxInt64 {
+			return 0, invalid
+		}
+		return time.Duration(d), nil
+	}
+	d, err := time.ParseDuration(spec)
+	if err != nil || d <= 0 {
+		return 0, invalid
+	}
+	return d, nil
+}
+
+type attemptTimeoutKey struct{}
+
+// withAttemptTimeout returns a context making sendWithRetry
+// bound each try at sending a request by `timeout`, so that
+// one slow try doesn't use up the time of the retries which
+// follow. Zero means no timeout
+func withAttemptTimeout(ctx context.Context, timeout time.Duration) context.Context {
+	return context.WithValue(ctx, attemptTimeoutKey{}, timeout)
+}
+
+// attemptTimeout returns the timeout set by withAttemptTimeout
+func attemptTimeout(ctx context.Context) time.Duration {
+	timeout, _ := ctx.Value(attemptTimeoutKey{}).(time.Duration)
+	return timeout
+}
+
+// BlockTimeout returns the timeout for a requester block:
+// its `@timeout` annotation if present, `fallback` (the
+// `--timeout` option) otherwise. Zero means no timeout
+func BlockTimeout(block *gabs.Container, fallback time.Duration) (time.Duration, error) {
+	spec, ok := parser.GetAnnotation(block, "timeout")
+	if !ok {
+		return fallback, nil
+	}
+	return ParseTimeout(spec)
+}
@@ -8,4 +8,5 @@ gomarkdoc --output docs/reference/lama2cmd.md ../../lama2cmd/
 gomarkdoc --output docs/reference/outputmanager.md ../../outputManager/
 gomarkdoc --output docs/reference/preprocess.md ../../preprocess/
 gomarkdoc --output docs/reference/utils.md ../../utils/
+gomarkdoc --output docs/reference/lama2.md ../../lama2/
 poetry run mkdocs build
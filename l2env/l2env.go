@@ -1,26 +1,28 @@
 package l2env
 
 import (
-	"os"
-
 	"github.com/HexmosTech/lama2/preprocess"
 	trie "github.com/Vivino/go-autocomplete-trie"
 	"github.com/rs/zerolog/log"
 )
 
-func ProcessEnvironmentVariables(searchQuery, directory string) interface{} {
-	envMap, err := preprocess.GetL2EnvVariables(directory)
+// ProcessEnvironmentVariables returns the variables available
+// to API files in `directory` under the named environment
+// `env` (see preprocess.EnvFiles), keeping those starting
+// with `searchQuery` if given
+func ProcessEnvironmentVariables(searchQuery, directory, env string) (interface{}, error) {
+	envMap, err := preprocess.GetL2EnvVariables(directory, env)
 	if err != nil {
 		// Potential Errors:
-		// - JSON marshalling errors.
+		// - Invalid or missing named environment.
 		log.Error().Str("Type", "Preprocess").Msg(err.Error())
-		os.Exit(0)
+		return nil, err
 	}
 	if searchQuery == "" { // Handle empty searchQuery: ""
-		return envMap
+		return envMap, nil
 	}
 	// Handle non-empty searchQuery: "query"
-	return GetRelevantEnvs(envMap, searchQuery)
+	return GetRelevantEnvs(envMap, searchQuery), nil
 }
 
 func GetRelevantEnvs(envMap map[string]map[string]interface{}, searchQuery string) map[string]interface{} {
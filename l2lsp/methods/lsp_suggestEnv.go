@@ -9,6 +9,7 @@ import (
 	l2envpackege "github.com/HexmosTech/lama2/l2env"
 	"github.com/HexmosTech/lama2/l2lsp/request"
 	"github.com/HexmosTech/lama2/l2lsp/response"
+	"github.com/HexmosTech/lama2/preprocess"
 	"github.com/rs/zerolog/log"
 )
 
@@ -19,6 +20,15 @@ func getSearchQueryString(req request.JSONRPCRequest) string {
 	return ""
 }
 
+// getEnvName returns the named environment asked for, or
+// else the one selected through `L2_ENV`
+func getEnvName(req request.JSONRPCRequest) string {
+	if req.Params.Env != nil {
+		return preprocess.EnvName(*req.Params.Env)
+	}
+	return preprocess.EnvName("")
+}
+
 func getRequestURI(req request.JSONRPCRequest) (string, int, error) {
 	if req.Params.TextDocument.URI == nil {
 		return "", response.ErrInvalidURI, errors.New("URI cannot be empty. Ex: 'file:///path/to/workspace/myapi.l2'")
@@ -61,7 +71,8 @@ func SuggestEnvironmentVariables(req request.JSONRPCRequest) response.JSONRPCRes
 					"line": 1,
 					"character": 2
 				},
-				"relevantSearchString": ""
+				"relevantSearchString": "",
+				"env": "staging"
 			}
 		}
 	*/
@@ -78,6 +89,9 @@ func SuggestEnvironmentVariables(req request.JSONRPCRequest) response.JSONRPCRes
 	log.Debug().Str("Method", req.Method).Interface("uri", uri)
 	parentFolder := filepath.Dir(uri)
 	log.Debug().Str("Method", req.Method).Interface("parentFolder", parentFolder)
-	res := l2envpackege.ProcessEnvironmentVariables(searchQuery, parentFolder)
+	res, err := l2envpackege.ProcessEnvironmentVariables(searchQuery, parentFolder, getEnvName(req))
+	if err != nil {
+		return response.ErrorResp(req, response.ErrInvalidRequest, err.Error())
+	}
 	return response.CreateEnvironmentVariablesResp(req, res)
 }
@@ -0,0 +1,246 @@
+// Package lama2 runs `.l2` API files in-process. Unlike
+// the `l2` command, it doesn't read `os.Args`, change the
+// working directory, modify the process environment, print
+// responses or exit the process, so files may be run from
+// concurrent goroutines:
+//
+//	res, err := lama2.Run(ctx, "apis/login.l2", lama2.Options{
+//		Vars: map[string]string{"USER": "alice"},
+//	})
+package lama2
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/HexmosTech/lama2/cmdexec"
+	controller "github.com/HexmosTech/lama2/controller"
+	"github.com/HexmosTech/lama2/lama2cmd"
+	"github.com/HexmosTech/lama2/parser"
+	"github.com/HexmosTech/lama2/preprocess"
+	"github.com/HexmosTech/lama2/utils"
+)
+
+// Options control a run. The zero value runs every
+// stage, reading `l2config.env`/`l2.env` from the
+// directory of the API file
+type Options struct {
+	// Vars take precedence over the env files and the
+	// process environment when expanding `${var}`
+	Vars map[string]string
+	// Dir is the directory used by RunString to find env
+	// files and resolve relative paths; Run uses the
+	// directory of the API file
+	Dir string
+	// SkipEnvFiles ignores `l2config.env` and `l2.env`
+	SkipEnvFiles bool
+	// SkipHookFile ignores the `l2hooks.js` of Dir. Without
+	// a Dir, RunString reads neither env files nor hooks
+	SkipHookFile bool
+	// Env also reads the files of the named environment,
+	// as in `--env`; unlike `l2`, `L2_ENV` isn't consulted
+	Env string
+	// Stage selects the stages to run, as in `--stage`
+	Stage string
+	// ContinueOnError keeps running the remaining blocks
+	// after a failure, as in `--continue-on-error`
+	ContinueOnError bool
+	// Seed, when set, seeds the random values of the
+	// dynamic variables, as in `--seed`
+	Seed *int64
+	// Strict refuses to send requests referring to
+	// undefined variables, as in `--strict`
+	Strict bool
+	// Timeout bounds each request unless the block has a
+	// `@timeout` annotation, as in `--timeout`
+	Timeout time.Duration
+	// HTTPClient sends the requests; by default a client
+	// which doesn't follow redirects
+	HTTPClient *http.Client
+	// Session names a session to load and save, as in
+	// `--session`; runs sharing a session shouldn't overlap
+	Session string
+	// CookieJar holds the cookies set and sent by the
+	// stages; a jar may be shared by several runs. By
+	// default, each run starts with an empty jar
+	CookieJar *cmdexec.CookieJar
+}
+
+// Request is a request as it was sent, after
+// variable expansion
+type Request struct {
+	Method  string
+	URL     string
+	Headers http.Header
+	Body    string
+}
+
+// Response is the response to a stage
+type Response struct {
+	Status     int
+	StatusText string
+	URL        string
+	Headers    http.Header
+	Cookies    []*http.Cookie
+	Body       string
+	Elapsed    time.Duration
+}
+
+// TestResult is the outcome of an `l2.test()` call, or
+// of an `expect()` failing outside of one
+type TestResult struct {
+	Name   string
+	Passed bool
+	Error  string
+}
+
+// StageResult is the outcome of a requester block (a
+// stage), along with the processor block following it.
+// Stage 0 stands for the processor block at the start
+// of the file, and has no request or response
+type StageResult struct {
+	Stage   int
+	Name    string
+	Skipped bool
+	// Request and Response are nil for stage 0, for
+	// skipped stages and when the request couldn't be sent
+	Request  *Request
+	Response *Response
+	Tests    []TestResult
+	// Logs holds the `console` output of the processor block
+	Logs []string
+	// Err is a `*utils.ExecError` describing the failure of
+	// the stage or its processor block
+	Err     error
+	Elapsed time.Duration
+}
+
+// Result is the outcome of running an API file
+type Result struct {
+	Stages []StageResult
+}
+
+// TestsFailed reports whether any test has failed
+func (r *Result) TestsFailed() bool {
+	for _, s := range r.Stages {
+		for _, t := range s.Tests {
+			if !t.Passed {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Run reads, parses and runs the API file at `file`. The
+// returned error is the first failure (a `*utils.ExecError`,
+// with `utils.KindParse` if the file couldn't be read or
+// parsed) or the context error; the results of the stages run
+// so far are returned along with it
+func Run(ctx context.Context, file string, opts Options) (*Result, error) {
+	content, err := preprocess.GetLamaFileAsString(file)
+	if err != nil {
+		return &Result{}, utils.NewExecError(utils.KindParse, 0, 0, err)
+	}
+	_, dir, _ := utils.GetFilePathComponents(file)
+	opts.Dir = dir
+	return run(ctx, content, file, opts)
+}
+
+// RunString is Run for API file contents held in memory
+func RunString(ctx context.Context, content string, opts Options) (*Result, error) {
+	return run(ctx, content, "", opts)
+}
+
+func run(ctx context.Context, content string, file string, opts Options) (*Result, error) {
+	parsedAPI, err := parser.NewLama2Parser().Parse(content)
+	if err != nil {
+		line := 0
+		var pe *utils.ParseError
+		if errors.As(err, &pe) {
+			line = pe.LineNum
+		}
+		return &Result{}, utils.NewExecError(utils.KindParse, 0, line, err)
+	}
+
+	o := &lama2cmd.Opts{Quiet: true, Stage: opts.Stage, ContinueOnError: opts.ContinueOnError, Session: opts.Session, Strict: opts.Strict}
+	o.Positional.LamaAPIFile = file
+	if opts.Timeout > 0 {
+		o.Timeout = opts.Timeout.String()
+	}
+	if opts.Seed != nil {
+		o.Seed = strconv.FormatInt(*opts.Seed, 10)
+	}
+	executor := cmdexec.NewNativeExecutor(o)
+	if opts.HTTPClient != nil {
+		executor.Client = opts.HTTPClient
+	}
+
+	vars := []map[string]string{opts.Vars}
+	if !opts.SkipEnvFiles && opts.Dir != "" {
+		envVars, err := preprocess.ReadEnvironments(opts.Dir, opts.Env)
+		if err != nil {
+			return &Result{}, err
+		}
+		vars = append(vars, envVars)
+	}
+	runner := &controller.Runner{
+		Opts:         o,
+		Dir:          opts.Dir,
+		Vars:         vars,
+		Executor:     executor,
+		Console:      discardConsole{},
+		Jar:          opts.CookieJar,
+		SkipHookFile: opts.SkipHookFile,
+	}
+	stages, err := runner.Run(ctx, parsedAPI)
+	return convertResults(stages), err
+}
+
+type discardConsole struct{}
+
+func (discardConsole) Log(string)   {}
+func (discardConsole) Warn(string)  {}
+func (discardConsole) Error(string) {}
+
+func convertResults(stages []controller.StageResult) *Result {
+	res := &Result{Stages: make([]StageResult, 0, len(stages))}
+	for _, s := range stages {
+		sr := StageResult{
+			Stage:   s.Stage,
+			Name:    s.Name,
+			Skipped: s.Skipped,
+			Logs:    s.Logs,
+			Err:     s.Err,
+			Elapsed: s.Elapsed,
+		}
+		for _, t := range s.Tests {
+			sr.Tests = append(sr.Tests, TestResult{Name: t.Name, Passed: t.Passed, Error: t.Error})
+		}
+		resp := s.Response
+		if s.Stage > 0 && !s.Skipped && resp.Request.Method != "" {
+			sr.Request = &Request{
+				Method:  resp.Request.Method,
+				URL:     resp.Request.URL,
+				Headers: resp.Request.Headers,
+				Body:    resp.Request.Body,
+			}
+		}
+		if s.Stage > 0 && !s.Skipped && resp.StatusCode != 0 {
+			sr.Response = &Response{
+				Status:     resp.StatusCode,
+				StatusText: resp.StatusText,
+				URL:        resp.URL,
+				Headers:    resp.Header,
+				Cookies:    resp.Cookies,
+				Body:       resp.Body,
+				Elapsed:    resp.Elapsed,
+			}
+		}
+		res.Stages = append(res.Stages, sr)
+	}
+	return res
+}
@@ -21,20 +21,83 @@ type Opts struct {
 	Verbose  []bool `short:"v" long:"verbose" description:"Show verbose debug information"`
 	Prettify bool   `short:"b" long:"prettify" description:"Prettify specified .l2 file"`
 	// Sort     bool   `short:"s" long:"sort" description:"Sort specification into recommended order"`
-	Convert     string `short:"c" long:"convert" description:"Generate code in given language and library (ex: python.requests); reference: tinyurl.com/l2codegen"`
-	Nocolor     bool   `short:"n" long:"nocolor" description:"Disable color in httpie output"`
-	Update      bool   `short:"u" long:"update" description:"Update l2 binary to the latest released version (Linux/MacOS only)"`
-	PostmanFile string `short:"p" long:"postmanfile" description:"JSON export from Postman (Settings -> Data -> Export Data)"`
-	LamaDir     string `short:"l" long:"lama2dir" description:"Output directory to put .l2 files after conversion from Postman format"`
-	Help        bool   `short:"h" long:"help" group:"AddHelp" description:"Usage help for Lama2"`
-	Lsp         bool   `short:"z" long:"lsp" description:"Start the lsp server"`
-	Version     bool   `long:"version" description:"Print Lama2 binary version"`
+	Convert         string   `short:"c" long:"convert" description:"Generate code in given language and library (ex: python.requests); reference: tinyurl.com/l2codegen"`
+	Nocolor         bool     `short:"n" long:"nocolor" description:"Disable color in httpie output"`
+	Quiet           bool     `short:"q" long:"quiet" description:"Don't print responses (native executor only)"`
+	Executor        string   `long:"executor" choice:"native" choice:"httpie" description:"Request executor backend; native (net/http, default) or httpie"`
+	Stage           string   `long:"stage" description:"Run only the given stages; 1-based number (2), range (2-4) or @name, comma separated"`
+	Env             string   `long:"env" description:"Also load the named environment: l2config.<name>.env and l2.<name>.env; defaults to $L2_ENV"`
+	Strict          bool     `long:"strict" description:"Refuse to send requests referring to undefined variables, listing them all; also set by L2_STRICT=true"`
+	Seed            string   `long:"seed" description:"Seed the random values of dynamic variables such as ${$uuid} and ${$email}, for reproducible runs"`
+	Timeout         string   `long:"timeout" description:"Abandon each request after this long (30s, 500ms or a number of seconds); @timeout on a block overrides it"`
+	Session         string   `long:"session" description:"Keep variables set through l2.session, cookies and responses in the named session between runs"`
+	CookieJar       string   `long:"cookie-jar" description:"Load cookies from this file before the run and save them back after it (Netscape format, or JSON for a .json file)"`
+	ContinueOnError bool     `long:"continue-on-error" description:"Keep running the remaining blocks after a failing stage; the exit code reflects the first error"`
+	Persist         bool     `long:"persist" description:"Save stage responses under .lama2/ and replay them for stages skipped by --stage"`
+	Data            string   `long:"data" description:"Run the file once per row of a CSV or JSON (array of objects) file; row columns become variables"`
+	Include         []string `long:"include" description:"When running a directory or glob, only run .l2 files matching this glob (repeatable)"`
+	Exclude         []string `long:"exclude" description:"When running a directory or glob, skip .l2 files matching this glob (repeatable)"`
+	Update          bool     `short:"u" long:"update" description:"Update l2 binary to the latest released version (Linux/MacOS only)"`
+	PostmanFile     string   `short:"p" long:"postmanfile" description:"JSON export from Postman (Settings -> Data -> Export Data)"`
+	LamaDir         string   `short:"l" long:"lama2dir" description:"Output directory to put .l2 files after conversion from Postman format"`
+	Help            bool     `short:"h" long:"help" group:"AddHelp" description:"Usage help for Lama2"`
+	Lsp             bool     `short:"z" long:"lsp" description:"Start the lsp server"`
+	Version         bool     `long:"version" description:"Print Lama2 binary version"`
 
+	// LamaAPIFile may also be a directory or a glob
+	// pattern, in which case every matching .l2 file runs
 	Positional struct {
 		LamaAPIFile string
 	} `positional-args:"yes"`
 }
 
+// TestOpts stores the options of the `l2 test` mode, which
+// runs every `.l2` file under a path and reports assertions
+type TestOpts struct {
+	JUnit    string   `long:"junit" description:"Write a JUnit XML report to the given path"`
+	TAP      string   `long:"tap" description:"Write the TAP report to the given path instead of stdout"`
+	Verbose  []bool   `short:"v" long:"verbose" description:"Show verbose debug information"`
+	Executor string   `long:"executor" choice:"native" choice:"httpie" description:"Request executor backend; native (net/http, default) or httpie"`
+	Env      string   `long:"env" description:"Also load the named environment: l2config.<name>.env and l2.<name>.env; defaults to $L2_ENV"`
+	Strict   bool     `long:"strict" description:"Refuse to send requests referring to undefined variables, listing them all; also set by L2_STRICT=true"`
+	Seed     string   `long:"seed" description:"Seed the random values of dynamic variables such as ${$uuid} and ${$email}, for reproducible runs"`
+	Include  []string `long:"include" description:"Only run .l2 files matching this glob (repeatable)"`
+	Exclude  []string `long:"exclude" description:"Skip .l2 files matching this glob (repeatable)"`
+	Help     bool     `short:"h" long:"help" group:"AddHelp" description:"Usage help for l2 test"`
+
+	Positional struct {
+		Path string
+	} `positional-args:"yes"`
+}
+
+// EnvOpts are the options of `l2 env explain <file>`
+type EnvOpts struct {
+	Env     string `long:"env" description:"Explain the variables of the named environment; defaults to $L2_ENV"`
+	Session string `long:"session" description:"Also consider the variables kept by the named session"`
+	JSON    bool   `long:"json" description:"Print the explanation as JSON"`
+	Reveal  bool   `long:"reveal" description:"Show the values of secret-like variables instead of masking them"`
+	Verbose []bool `short:"v" long:"verbose" description:"Show verbose debug information"`
+	Help    bool   `short:"h" long:"help" group:"AddHelp" description:"Usage help for l2 env explain"`
+
+	Positional struct {
+		Command     string
+		LamaAPIFile string
+	} `positional-args:"yes"`
+}
+
+func configureVerbosity(verbose []bool) {
+	switch len(verbose) {
+	case 0:
+		outputmanager.ConfigureZeroLog("INFO")
+	case 1:
+		outputmanager.ConfigureZeroLog("DEBUG")
+	case 2:
+		outputmanager.ConfigureZeroLog("TRACE")
+	default:
+		outputmanager.ConfigureZeroLog("DEBUG")
+	}
+}
+
 func getParsedInput(argList []string) (Opts, []string) {
 	argList = argList[1:] // remove command name
 	o := Opts{}
@@ -55,16 +118,7 @@ func getParsedInput(argList []string) (Opts, []string) {
 			Msg("Couldn't parse argument list")
 	}
 
-	switch len(o.Verbose) {
-	case 0:
-		outputmanager.ConfigureZeroLog("INFO")
-	case 1:
-		outputmanager.ConfigureZeroLog("DEBUG")
-	case 2:
-		outputmanager.ConfigureZeroLog("TRACE")
-	default:
-		outputmanager.ConfigureZeroLog("DEBUG")
-	}
+	configureVerbosity(o.Verbose)
 
 	log.Debug().
 		Str("Type", "Preprocess").
@@ -118,3 +172,49 @@ func GetAndValidateCmd(ipArgs []string) *Opts {
 	o, _ := getParsedInput(ipArgs)
 	return &o
 }
+
+// GetTestCmd parses the arguments of `l2 test`; `argList`
+// starts with the `test` word itself. The path defaults
+// to the current directory
+func GetTestCmd(argList []string) *TestOpts {
+	o := TestOpts{}
+	_, err := flags.ParseArgs(&o, argList[1:])
+	if err != nil {
+		e, _ := err.(*flags.Error)
+		if e.Type == flags.ErrHelp {
+			os.Exit(0)
+		}
+		log.Fatal().
+			Str("Type", "Preprocess").
+			Strs("arglist", argList).
+			Msg("Couldn't parse argument list")
+	}
+	configureVerbosity(o.Verbose)
+	if o.Positional.Path == "" {
+		o.Positional.Path = "."
+	}
+	return &o
+}
+
+// GetEnvCmd parses the arguments of `l2 env`, whose
+// only subcommand is `explain <file>`
+func GetEnvCmd(argList []string) *EnvOpts {
+	o := EnvOpts{}
+	_, err := flags.ParseArgs(&o, argList[1:])
+	if err != nil {
+		e, _ := err.(*flags.Error)
+		if e.Type == flags.ErrHelp {
+			os.Exit(0)
+		}
+		log.Fatal().
+			Str("Type", "Preprocess").
+			Strs("arglist", argList).
+			Msg("Couldn't parse argument list")
+	}
+	configureVerbosity(o.Verbose)
+	if o.Positional.Command != "explain" || o.Positional.LamaAPIFile == "" {
+		log.Error().Strs("arglist", argList).Msg("Usage: l2 env explain [--env <name>] [--json] <file>")
+		os.Exit(utils.ExitFailure)
+	}
+	return &o
+}
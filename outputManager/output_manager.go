@@ -7,9 +7,12 @@ import (
 	"bytes"
 	"fmt"
 	"os"
+	"sort"
+	"time"
 
 	"github.com/HexmosTech/gabs/v2"
 	"github.com/HexmosTech/httpie-go"
+	"github.com/HexmosTech/lama2/utils"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
@@ -46,18 +49,57 @@ func wrapError(requestError string) *gabs.Container {
 	return temp
 }
 
-func ResponseToJSON(resp httpie.ExResponse) (*gabs.Container, error) {
+// Attempt records one try at sending a request: the
+// status obtained or the error, how long it took and the
+// delay before the next try (zero for the last one)
+type Attempt struct {
+	Status  int
+	Error   string
+	Elapsed time.Duration
+	Delay   time.Duration
+}
+
+func attemptsToJSON(attempts []Attempt) []interface{} {
+	res := make([]interface{}, 0, len(attempts))
+	for i, a := range attempts {
+		m := map[string]interface{}{
+			"attempt":    i + 1,
+			"status":     a.Status,
+			"elapsed_ms": a.Elapsed.Milliseconds(),
+			"delay_ms":   a.Delay.Milliseconds(),
+		}
+		if a.Error != "" {
+			m["error"] = a.Error
+		}
+		res = append(res, m)
+	}
+	return res
+}
+
+func ResponseToJSON(resp httpie.ExResponse, attempts ...Attempt) (*gabs.Container, error) {
 	body := string(resp.Body)
 
+	// One line per value, so that every Set-Cookie is kept
+	header := utils.UnflattenHeader(resp.Headers)
+	names := make([]string, 0, len(header))
+	for k := range header {
+		names = append(names, k)
+	}
+	sort.Strings(names)
 	var headerMapStr string
-	for k, v := range resp.Headers {
-		headerMapStr += k + ": " + v + "\n"
+	for _, k := range names {
+		for _, v := range header[k] {
+			headerMapStr += k + ": " + v + "\n"
+		}
 	}
 
 	temp := gabs.New()
 	temp.Set(headerMapStr, "headers")
 	temp.Set(body, "body")
 	temp.Set(LogBuff.String(), "logs")
+	if len(attempts) > 0 {
+		temp.Set(attemptsToJSON(attempts), "attempts")
+	}
 
 	return temp, nil
 }
@@ -66,11 +108,12 @@ func ResponseToJSON(resp httpie.ExResponse) (*gabs.Container, error) {
 // Extension/Integration building with external tools.
 // Extension writers may simply call `l2 -n -o /tmp/lama2.json ...`
 // to invoke WriteJSONOutput; the generated json file contains
-// three keys: `logs`, `headers`, `body`
-func WriteJSONOutput(resp httpie.ExResponse, targetPath string) {
-	temp, _ := ResponseToJSON(resp)
-	err := os.WriteFile(targetPath, []byte(temp.String()), 0o644)
-	if err != nil {
-		log.Fatal().Msg(fmt.Sprintf("Couldn't write JSON output to: %s", targetPath))
+// three keys: `logs`, `headers`, `body`, along with `attempts`
+// listing every try at sending the request when given
+func WriteJSONOutput(resp httpie.ExResponse, targetPath string, attempts ...Attempt) error {
+	temp, _ := ResponseToJSON(resp, attempts...)
+	if err := os.WriteFile(targetPath, []byte(temp.String()), 0o644); err != nil {
+		return fmt.Errorf("couldn't write JSON output to %s: %w", targetPath, err)
 	}
+	return nil
 }
@@ -0,0 +1,120 @@
+package outputmanager
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+// TestCase is a single check reported by `l2 test`
+type TestCase struct {
+	Name    string
+	Passed  bool
+	Message string
+	Elapsed time.Duration
+}
+
+// TestSuite groups the test cases of one API file
+type TestSuite struct {
+	Name    string
+	Cases   []TestCase
+	Elapsed time.Duration
+}
+
+// Failures counts the failed cases in the suite
+func (s TestSuite) Failures() int {
+	n := 0
+	for _, c := range s.Cases {
+		if !c.Passed {
+			n++
+		}
+	}
+	return n
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+}
+
+type junitSuite struct {
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Time     string      `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitSuites struct {
+	XMLName  xml.Name     `xml:"testsuites"`
+	Tests    int          `xml:"tests,attr"`
+	Failures int          `xml:"failures,attr"`
+	Suites   []junitSuite `xml:"testsuite"`
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// WriteJUnitReport stores the suites as a JUnit XML
+// document, as understood by most CI systems
+func WriteJUnitReport(suites []TestSuite, targetPath string) error {
+	report := junitSuites{}
+	for _, s := range suites {
+		js := junitSuite{Name: s.Name, Tests: len(s.Cases), Failures: s.Failures(), Time: seconds(s.Elapsed)}
+		for _, c := range s.Cases {
+			jc := junitCase{ClassName: s.Name, Name: c.Name, Time: seconds(c.Elapsed)}
+			if !c.Passed {
+				jc.Failure = &junitFailure{Message: c.Message, Text: c.Message}
+			}
+			js.Cases = append(js.Cases, jc)
+		}
+		report.Tests += js.Tests
+		report.Failures += js.Failures
+		report.Suites = append(report.Suites, js)
+	}
+
+	b, err := xml.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(targetPath, append([]byte(xml.Header), b...), 0o644)
+}
+
+// WriteTAPReport writes the suites in the Test Anything
+// Protocol (version 13) format
+func WriteTAPReport(suites []TestSuite, w io.Writer) error {
+	total := 0
+	for _, s := range suites {
+		total += len(s.Cases)
+	}
+	fmt.Fprintln(w, "TAP version 13")
+	fmt.Fprintf(w, "1..%d\n", total)
+	n := 0
+	for _, s := range suites {
+		for _, c := range s.Cases {
+			n++
+			status := "ok"
+			if !c.Passed {
+				status = "not ok"
+			}
+			fmt.Fprintf(w, "%s %d - %s: %s\n", status, n, s.Name, c.Name)
+			if !c.Passed {
+				fmt.Fprintln(w, "  ---")
+				fmt.Fprintf(w, "  message: %q\n", strings.TrimSpace(c.Message))
+				fmt.Fprintln(w, "  ...")
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package parser
+
+import (
+	"strings"
+
+	"github.com/HexmosTech/gabs/v2"
+	"github.com/HexmosTech/lama2/utils"
+	"github.com/rs/zerolog/log"
+)
+
+// Annotations matches zero or more Annotation lines
+// at the start of a requester block, and returns
+// them as an array (possibly empty)
+func (p *Lama2Parser) Annotations() (*gabs.Container, error) {
+	temp := gabs.New()
+	temp.Array()
+	for {
+		res, e := p.Match([]string{"Annotation"})
+		if e != nil {
+			break
+		}
+		temp.ArrayAppend(res)
+	}
+	return temp, nil
+}
+
+// Annotation matches a single `@key value` line. Annotations
+// precede the HTTP verb of a requester block and carry block
+// level settings; for example `@name login` names the stage.
+// The value runs till the end of the line.
+func (p *Lama2Parser) Annotation() (*gabs.Container, error) {
+	_, e := p.Keyword("@", true, false, false)
+	if e != nil {
+		return nil, e
+	}
+
+	key := make([]string, 0)
+	for {
+		c, err := p.CharClass("a-zA-Z0-9_-")
+		if err != nil {
+			break
+		}
+		key = append(key, string(c))
+	}
+	if len(key) == 0 {
+		return nil, utils.NewParseError(p.Pos+1, p.LineNum+1, "Expected annotation name after '@'", []string{})
+	}
+
+	value := make([]string, 0)
+	for p.Pos < p.TotalLen && p.Text[p.Pos+1] != '\n' {
+		value = append(value, string(p.Text[p.Pos+1]))
+		p.Pos++
+	}
+
+	temp := gabs.New()
+	temp.Set(strings.Join(key, ""), "key")
+	temp.Set(strings.TrimSpace(strings.Join(value, "")), "value")
+	log.Trace().Str("Annotation", temp.String()).Msg("")
+	return temp, nil
+}
+
+// GetAnnotations returns the values of all `@key`
+// annotations of a requester block, in file order
+func GetAnnotations(block *gabs.Container, key string) []string {
+	res := make([]string, 0)
+	annotations := block.S("annotations")
+	if annotations == nil {
+		return res
+	}
+	for _, a := range annotations.Children() {
+		if k, ok := a.S("key").Data().(string); ok && k == key {
+			res = append(res, a.S("value").Data().(string))
+		}
+	}
+	return res
+}
+
+// GetAnnotation returns the value of the first
+// `@key` annotation of a requester block
+func GetAnnotation(block *gabs.Container, key string) (string, bool) {
+	values := GetAnnotations(block, key)
+	if len(values) == 0 {
+		return "", false
+	}
+	return values[0], true
+}
@@ -33,7 +33,9 @@ func (p *Lama2Parser) L2Variable() (*gabs.Container, error) {
 	}
 	res := ""
 	for {
-		item, err := p.CharClass("a-zA-Z0-9_")
+		// Dots, dashes and brackets allow stage references
+		// such as ${login.response.body.items[0].id}
+		item, err := p.CharClass("a-zA-Z0-9_.[]-")
 		if err != nil {
 			break
 		}
@@ -39,7 +39,7 @@ func (p *Lama2Parser) Start() (*gabs.Container, error) {
 
 func (p *Lama2Parser) Lama2File() (*gabs.Container, error) {
 	// Trying to get:
-	// PSBlock? Requestor [SPSBlock Requestor]*
+	// PSBlock? Requestor [SPSBlock Requestor]* [SPBlock]?
 
 	log.Trace().Msg("Within Lama2File")
 	temp := gabs.New()
@@ -103,6 +103,10 @@ func (p *Lama2Parser) Lama2File() (*gabs.Container, error) {
 
 			tempArr.ArrayAppend(res4)
 			tempArr.ArrayAppend(res5)
+		} else if script, ok := res4.S("value").Data().(*gabs.Container).Data().(string); ok && strings.TrimSpace(script) != "" {
+			// A trailing processor post-processes (or tests)
+			// the response of the final requester block
+			tempArr.ArrayAppend(res4)
 		}
 	}
 	return tempArr, nil
@@ -111,14 +115,17 @@ func (p *Lama2Parser) Lama2File() (*gabs.Container, error) {
 func (p *Lama2Parser) Processor() (*gabs.Container, error) {
 	log.Trace().Msg("Within Processor")
 	// A Processor cannot start with any of the HTTP Verbs
-	res := p.LookAhead([]string{"HTTPVerb"})
+	// or with the annotations of a requester block
+	res := p.LookAhead([]string{"Annotation", "HTTPVerb"})
 	log.Debug().Bool("HTTPVerb LookAhead result", res)
 	if res {
 		return nil, utils.NewParseError(p.Pos+1, p.LineNum+1, "HTTPVerb found at start of block; cannot be a Requestor block", []string{})
 	}
 	temp := gabs.New()
+	line := p.lineAt(p.Pos + 1)
 	res2, _ := p.MatchUntil("\n---\n")
 	temp.Set("processor", "type")
+	temp.Set(line, "line")
 	temp.Set(res2, "value")
 	log.Debug().Str("Processor block parsed", res2.String()).Msg("")
 
@@ -137,17 +144,23 @@ func (p *Lama2Parser) Separator() (*gabs.Container, error) {
 }
 
 // Requester applies the rule:
-// HTTPVerb Multipart? TheURL Details?
+// Annotation* HTTPVerb Multipart? TheURL Details?
 func (p *Lama2Parser) Requester() (*gabs.Container, error) {
 	log.Trace().Msg("Within Requester")
+	line := p.lineAt(p.Pos + 1)
+	annotations, _ := p.Match([]string{"Annotations"})
 	res, e := p.Match([]string{"HTTPVerb"})
 	temp := gabs.New()
 	if e == nil {
 		temp.Set(res, "verb")
 		temp.Set("Lama2File", "type")
+		temp.Set(line, "line")
 	} else {
 		return nil, e
 	}
+	if len(annotations.Children()) > 0 {
+		temp.Set(annotations.Data(), "annotations")
+	}
 	res, e = p.Match([]string{"Multipart"})
 	if e == nil {
 		temp.Set(res, "multipart")
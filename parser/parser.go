@@ -119,6 +119,18 @@ func (p *Parser) eatWhitespace() {
 	}
 }
 
+// lineAt returns the 1-based source line of
+// the character at index `pos` in Text
+func (p *Parser) lineAt(pos int) int {
+	line := 1
+	for i := 0; i < pos && i < len(p.Text); i++ {
+		if p.Text[i] == '\n' {
+			line++
+		}
+	}
+	return line
+}
+
 // Method SetText is a utility used
 // primarily in testing, when we don't
 // want to call Start() automatically
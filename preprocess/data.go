@@ -0,0 +1,76 @@
+package preprocess
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// LoadDataRows reads the `--data` file of an iterated
+// run. A `.csv` file supplies one row per record, the
+// header naming the variables. A `.json` file holds an
+// array of objects; non-string values are kept in their
+// JSON form (e.g. `42`, `true`, `{"a":1}`)
+func LoadDataRows(path string) ([]map[string]string, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".csv":
+		return parseCSVRows(content)
+	case ".json":
+		return parseJSONRows(content)
+	}
+	return nil, fmt.Errorf("unsupported data file '%s'; expected .csv or .json", path)
+}
+
+func parseCSVRows(content []byte) ([]map[string]string, error) {
+	records, err := csv.NewReader(bytes.NewReader(content)).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("reading CSV data: %w", err)
+	}
+	if len(records) == 0 {
+		return nil, fmt.Errorf("CSV data has no header row")
+	}
+	header := records[0]
+	rows := make([]map[string]string, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]string, len(header))
+		for i, name := range header {
+			row[strings.TrimSpace(name)] = record[i]
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+func parseJSONRows(content []byte) ([]map[string]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var objects []map[string]interface{}
+	if err := decoder.Decode(&objects); err != nil {
+		return nil, fmt.Errorf("reading JSON data; expected an array of objects: %w", err)
+	}
+	rows := make([]map[string]string, 0, len(objects))
+	for _, obj := range objects {
+		row := make(map[string]string, len(obj))
+		for name, val := range obj {
+			switch v := val.(type) {
+			case string:
+				row[name] = v
+			case nil:
+				row[name] = ""
+			default:
+				b, _ := json.Marshal(v)
+				row[name] = string(b)
+			}
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
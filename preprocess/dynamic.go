@@ -0,0 +1,348 @@
+package preprocess
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dop251/goja"
+)
+
+// Generator produces the values of the dynamic variables
+// such as `${$uuid}` and `${$randomInt(1, 6)}`. Seeded
+// generators yield the same sequence of random values on
+// every run; timestamps follow the clock regardless. A
+// Generator is safe for concurrent use
+type Generator struct {
+	mu  sync.Mutex
+	rnd *rand.Rand
+	now func() time.Time
+}
+
+// NewGenerator returns an unseeded Generator, whose random
+// values come from crypto/rand: a `$uuid` may serve as an
+// idempotency key or a nonce
+func NewGenerator() *Generator {
+	return &Generator{rnd: rand.New(cryptoSource{}), now: time.Now}
+}
+
+// cryptoSource is a math/rand source reading crypto/rand
+type cryptoSource struct{}
+
+func (cryptoSource) Int63() int64 {
+	return int64(cryptoSource{}.Uint64() &^ (1 << 63))
+}
+
+func (cryptoSource) Uint64() uint64 {
+	var b [8]byte
+	if _, err := cryptorand.Read(b[:]); err != nil {
+		panic(fmt.Sprintf("crypto/rand: %v", err))
+	}
+	return binary.BigEndian.Uint64(b[:])
+}
+
+func (cryptoSource) Seed(int64) {}
+
+// NewSeededGenerator returns a Generator whose random
+// values are determined by `seed` (see `--seed`)
+func NewSeededGenerator(seed int64) *Generator {
+	return &Generator{rnd: rand.New(rand.NewSource(seed)), now: time.Now}
+}
+
+// defaultGenerator serves the runtimes without a
+// Generator of their own (see BindGenerator)
+var defaultGenerator = NewGenerator()
+
+type dynamicVar struct {
+	// usage lists the arguments, for error messages
+	usage string
+	// typed values are JSON numbers or booleans, handed
+	// as such to the JS functions
+	typed bool
+	gen   func(g *Generator, args []string) (string, error)
+}
+
+// dynamicVars is the registry of dynamic variables,
+// referred to as `${$name}` or `${$name(args)}`
+var dynamicVars = map[string]dynamicVar{
+	"uuid":   {gen: func(g *Generator, _ []string) (string, error) { return g.uuidV4(), nil }},
+	"uuidv4": {gen: func(g *Generator, _ []string) (string, error) { return g.uuidV4(), nil }},
+	"uuidv7": {gen: func(g *Generator, _ []string) (string, error) { return g.uuidV7(), nil }},
+	"timestamp": {usage: "(offset)", typed: true, gen: func(g *Generator, args []string) (string, error) {
+		t, err := g.offsetNow(args)
+		return strconv.FormatInt(t.Unix(), 10), err
+	}},
+	"timestampMs": {usage: "(offset)", typed: true, gen: func(g *Generator, args []string) (string, error) {
+		t, err := g.offsetNow(args)
+		return strconv.FormatInt(t.UnixMilli(), 10), err
+	}},
+	"isoTimestamp": {usage: "(offset)", gen: func(g *Generator, args []string) (string, error) {
+		t, err := g.offsetNow(args)
+		return t.UTC().Format(time.RFC3339), err
+	}},
+	"randomInt": {usage: "(min, max)", typed: true, gen: func(g *Generator, args []string) (string, error) {
+		bounds, err := intArgs(args, 0, 1000)
+		if err != nil {
+			return "", err
+		}
+		if bounds[1] < bounds[0] {
+			return "", fmt.Errorf("max %d is less than min %d", bounds[1], bounds[0])
+		}
+		return strconv.Itoa(bounds[0] + g.intn(bounds[1]-bounds[0]+1)), nil
+	}},
+	"randomString": {usage: "(length)", gen: func(g *Generator, args []string) (string, error) {
+		length, err := intArgs(args, 16)
+		if err != nil {
+			return "", err
+		}
+		if length[0] < 0 {
+			return "", fmt.Errorf("negative length %d", length[0])
+		}
+		return g.randomString(length[0], alphanumeric), nil
+	}},
+	"randomBoolean": {typed: true, gen: func(g *Generator, _ []string) (string, error) {
+		return strconv.FormatBool(g.intn(2) == 1), nil
+	}},
+	"firstName": {gen: func(g *Generator, _ []string) (string, error) { return g.pick(firstNames), nil }},
+	"lastName":  {gen: func(g *Generator, _ []string) (string, error) { return g.pick(lastNames), nil }},
+	"fullName": {gen: func(g *Generator, _ []string) (string, error) {
+		return g.pick(firstNames) + " " + g.pick(lastNames), nil
+	}},
+	"username": {gen: func(g *Generator, _ []string) (string, error) {
+		return strings.ToLower(g.pick(firstNames)) + strconv.Itoa(100+g.intn(9900)), nil
+	}},
+	"email": {gen: func(g *Generator, _ []string) (string, error) {
+		local := strings.ToLower(g.pick(firstNames) + "." + g.pick(lastNames))
+		return fmt.Sprintf("%s%d@%s", local, 100+g.intn(9900), g.pick(emailDomains)), nil
+	}},
+	"phoneNumber": {gen: func(g *Generator, _ []string) (string, error) {
+		return fmt.Sprintf("+1-%03d-555-%04d", 200+g.intn(800), g.intn(10000)), nil
+	}},
+	"streetAddress": {gen: func(g *Generator, _ []string) (string, error) {
+		return fmt.Sprintf("%d %s %s", 1+g.intn(9999), g.pick(streetNames), g.pick(streetSuffixes)), nil
+	}},
+	"city":    {gen: func(g *Generator, _ []string) (string, error) { return g.pick(cities), nil }},
+	"country": {gen: func(g *Generator, _ []string) (string, error) { return g.pick(countries), nil }},
+	"zipCode": {gen: func(g *Generator, _ []string) (string, error) {
+		return fmt.Sprintf("%05d", g.intn(100000)), nil
+	}},
+}
+
+const alphanumeric = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+var (
+	firstNames     = []string{"Alice", "Bruno", "Chen", "Divya", "Elena", "Farid", "Grace", "Hiro", "Ines", "Jonas", "Kofi", "Lena", "Mateo", "Nadia", "Oscar", "Priya", "Quinn", "Rosa", "Sven", "Tara", "Umar", "Vera", "Wei", "Yara", "Zane"}
+	lastNames      = []string{"Anderson", "Baker", "Costa", "Dubois", "Evans", "Fischer", "Garcia", "Hansen", "Ivanova", "Jensen", "Kim", "Lopez", "Moreau", "Nair", "Okafor", "Park", "Rossi", "Silva", "Tanaka", "Weber"}
+	emailDomains   = []string{"example.com", "example.org", "example.net"}
+	streetNames    = []string{"Maple", "Oak", "Cedar", "Elm", "Pine", "Lake", "Hill", "Park", "River", "Sunset", "Washington", "Church"}
+	streetSuffixes = []string{"Street", "Avenue", "Road", "Lane", "Drive", "Way", "Court", "Boulevard"}
+	cities         = []string{"Amsterdam", "Bangalore", "Berlin", "Boston", "Cape Town", "Lisbon", "Melbourne", "Montreal", "Nairobi", "Osaka", "Seoul", "Toronto", "Valencia", "Zurich"}
+	countries      = []string{"Argentina", "Australia", "Brazil", "Canada", "Germany", "India", "Japan", "Kenya", "Netherlands", "Portugal", "South Korea", "Spain", "Switzerland", "United States"}
+)
+
+// Generate returns a value of the dynamic variable `ref`,
+// given without its `$`: a name, optionally followed by
+// comma separated arguments in parentheses, as in
+// `randomInt(1, 6)`
+func (g *Generator) Generate(ref string) (string, error) {
+	name, v, args, err := parseDynamic(ref)
+	if err != nil {
+		return "", err
+	}
+	val, err := v.gen(g, args)
+	if err != nil {
+		return "", fmt.Errorf("$%s%s: %w", name, v.usage, err)
+	}
+	return val, nil
+}
+
+func parseDynamic(ref string) (string, dynamicVar, []string, error) {
+	name, args := ref, []string(nil)
+	if i := strings.IndexByte(ref, '('); i >= 0 {
+		if !strings.HasSuffix(ref, ")") {
+			return "", dynamicVar{}, nil, fmt.Errorf("$%s: missing ')'", ref)
+		}
+		name = ref[:i]
+		if inner := strings.TrimSpace(ref[i+1 : len(ref)-1]); inner != "" {
+			for _, arg := range strings.Split(inner, ",") {
+				args = append(args, strings.TrimSpace(arg))
+			}
+		}
+	}
+	v, ok := dynamicVars[name]
+	if !ok {
+		return "", dynamicVar{}, nil, fmt.Errorf("unknown dynamic variable $%s", name)
+	}
+	return name, v, args, nil
+}
+
+func (g *Generator) intn(n int) int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.rnd.Intn(n)
+}
+
+func (g *Generator) read(b []byte) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.rnd.Read(b)
+}
+
+func (g *Generator) pick(values []string) string {
+	return values[g.intn(len(values))]
+}
+
+func (g *Generator) randomString(length int, alphabet string) string {
+	b := make([]byte, length)
+	for i := range b {
+		b[i] = alphabet[g.intn(len(alphabet))]
+	}
+	return string(b)
+}
+
+func formatUUID(b []byte) string {
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// uuidV4 returns a random UUID (RFC 9562, version 4)
+func (g *Generator) uuidV4() string {
+	b := make([]byte, 16)
+	g.read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return formatUUID(b)
+}
+
+// uuidV7 returns a time-ordered UUID (RFC 9562, version 7):
+// a millisecond timestamp followed by random bits
+func (g *Generator) uuidV7() string {
+	b := make([]byte, 16)
+	g.read(b[6:])
+	ms := g.now().UnixMilli()
+	for i := 5; i >= 0; i-- {
+		b[i] = byte(ms)
+		ms >>= 8
+	}
+	b[6] = b[6]&0x0f | 0x70
+	b[8] = b[8]&0x3f | 0x80
+	return formatUUID(b)
+}
+
+// offsetNow returns the current time moved by the optional
+// offset argument: a Go duration such as `-90m` or `+1h`, or
+// a number of days such as `+7d`
+func (g *Generator) offsetNow(args []string) (time.Time, error) {
+	now := g.now()
+	if len(args) == 0 {
+		return now, nil
+	}
+	if len(args) > 1 {
+		return now, fmt.Errorf("expected at most 1 argument")
+	}
+	offset := args[0]
+	if strings.HasSuffix(offset, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(offset, "+"), "d"))
+		if err != nil {
+			return now, fmt.Errorf("invalid offset %q", offset)
+		}
+		return now.AddDate(0, 0, days), nil
+	}
+	d, err := time.ParseDuration(strings.TrimPrefix(offset, "+"))
+	if err != nil {
+		return now, fmt.Errorf("invalid offset %q", offset)
+	}
+	return now.Add(d), nil
+}
+
+// intArgs parses integer arguments, falling back on
+// `defaults` for those not given
+func intArgs(args []string, defaults ...int) ([]int, error) {
+	if len(args) > len(defaults) {
+		return nil, fmt.Errorf("expected at most %d arguments", len(defaults))
+	}
+	res := append([]int{}, defaults...)
+	for i, arg := range args {
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q", arg)
+		}
+		res[i] = n
+	}
+	return res, nil
+}
+
+// BindGenerator makes `g` produce the dynamic variables
+// of the given runtime, and exposes them to the processor
+// blocks as functions of `l2.dynamic`, such as
+// `l2.dynamic.uuid()` or `l2.dynamic.randomInt(1, 6)`. The
+// `l2` object must exist already
+func BindGenerator(vm *goja.Runtime, g *Generator) {
+	dynamic := vm.NewObject()
+	for name, v := range dynamicVars {
+		name, v := name, v
+		dynamic.Set(name, func(call goja.FunctionCall) goja.Value {
+			args := make([]string, 0, len(call.Arguments))
+			for _, arg := range call.Arguments {
+				args = append(args, arg.String())
+			}
+			val, err := v.gen(g, args)
+			if err != nil {
+				panic(vm.NewTypeError(fmt.Sprintf("l2.dynamic.%s%s: %s", name, v.usage, err)))
+			}
+			if v.typed {
+				var typed interface{}
+				if json.Unmarshal([]byte(val), &typed) == nil {
+					return vm.ToValue(typed)
+				}
+			}
+			return vm.ToValue(val)
+		})
+	}
+	dynamic.DefineDataProperty("_generator", vm.ToValue(g), goja.FLAG_FALSE, goja.FLAG_FALSE, goja.FLAG_FALSE)
+	vm.Get("l2").ToObject(vm).Set("dynamic", dynamic)
+}
+
+// generatorOf returns the Generator bound to `vm`,
+// or else the default one
+func generatorOf(vm *goja.Runtime) *Generator {
+	if vm == nil {
+		return defaultGenerator
+	}
+	l2 := vm.Get("l2")
+	if l2 == nil {
+		return defaultGenerator
+	}
+	dynamic := l2.ToObject(vm).Get("dynamic")
+	if dynamic == nil {
+		return defaultGenerator
+	}
+	if g := dynamic.ToObject(vm).Get("_generator"); g != nil {
+		if g, ok := g.Export().(*Generator); ok {
+			return g
+		}
+	}
+	return defaultGenerator
+}
+
+type generatorKey struct{}
+
+// WithGenerator returns a context making runs use `g`
+// for their dynamic variables, so that several runs (such
+// as the iterations of `--data`) share one sequence
+func WithGenerator(ctx context.Context, g *Generator) context.Context {
+	return context.WithValue(ctx, generatorKey{}, g)
+}
+
+// GeneratorFrom returns the Generator set through
+// WithGenerator, or nil
+func GeneratorFrom(ctx context.Context) *Generator {
+	g, _ := ctx.Value(generatorKey{}).(*Generator)
+	return g
+}
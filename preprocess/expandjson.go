@@ -0,0 +1,180 @@
+package preprocess
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/HexmosTech/gabs/v2"
+	"github.com/HexmosTech/lama2/utils"
+	"github.com/dop251/goja"
+	"github.com/rs/zerolog/log"
+)
+
+// unquotedPrefix and unquotedSuffix surround the name of an
+// unquoted variable in a parsed JSON body (see L2Variable)
+var (
+	unquotedPrefix = "~" + utils.UNQUOTED_VAR_MARKER + "-${"
+	unquotedSuffix = "}~"
+)
+
+// ExpandJSON expands the variables of the JSON body of a
+// request block, walking the parsed body rather than its
+// text. Within strings and keys, variables are expanded as in
+// ExpandEnv, and the results stay strings. An unquoted
+// variable such as `{"id": ${ID}}` is replaced by a value of
+// its own JSON type: a Javascript variable is converted as by
+// JSON.stringify, a stage reference keeps the type it has in
+// the response, and an environment variable must hold a
+// JSON value (`42`, `true`, `[1, 2]`), inserted as such. An
+// undefined unquoted variable is an error, as are two keys
+// of an object expanding to the same key. Errors name the
+// place in the body, such as `body.items[2].id`
+func ExpandJSON(block *gabs.Container, vm *goja.Runtime, vars ...map[string]string) error {
+	log.Debug().Str("JSON block to be expanded", block.String()).Msg("")
+	dataBlock := block.S("details", "ip_data")
+	if dataBlock == nil {
+		return nil
+	}
+	var data interface{}
+	dec := json.NewDecoder(strings.NewReader(dataBlock.String()))
+	dec.UseNumber()
+	if err := dec.Decode(&data); err != nil {
+		return fmt.Errorf("couldn't read the body: %w", err)
+	}
+	e := jsonExpander{vm: vm, mappings: append(append([]map[string]string{}, vars...), getEnvironMap())}
+	processed, err := e.expand(data, "body")
+	if err != nil {
+		return err
+	}
+	block.Delete("details", "ip_data")
+	block.Set(processed, "details", "ip_data")
+	log.Debug().Str("Processed JSON block", block.String()).Msg("")
+	return nil
+}
+
+type jsonExpander struct {
+	vm       *goja.Runtime
+	mappings []map[string]string
+}
+
+// expand returns a copy of `node` with its variables
+// expanded; `path` locates it within the body
+func (e *jsonExpander) expand(node interface{}, path string) (interface{}, error) {
+	switch v := node.(type) {
+	case map[string]interface{}:
+		res := make(map[string]interface{}, len(v))
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			child := v[key]
+			childPath := path + "." + key
+			k, err := Expand(key, e.vm, e.mappings...)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", childPath, err)
+			}
+			if _, dup := res[k]; dup {
+				return nil, fmt.Errorf("%s: the key expands to %q, which is already a key of %s", childPath, k, path)
+			}
+			if res[k], err = e.expand(child, childPath); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i, child := range v {
+			var err error
+			if res[i], err = e.expand(child, path+"["+strconv.Itoa(i)+"]"); err != nil {
+				return nil, err
+			}
+		}
+		return res, nil
+	case string:
+		if name, ok := unquotedName(v); ok {
+			val, err := e.typedValue(name)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", path, err)
+			}
+			return val, nil
+		}
+		s, err := Expand(v, e.vm, e.mappings...)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		return s, nil
+	}
+	return node, nil
+}
+
+// unquotedName returns the name of the variable if `s` is the
+// marker the parser leaves for an unquoted variable
+func unquotedName(s string) (string, bool) {
+	if !strings.HasPrefix(s, unquotedPrefix) || !strings.HasSuffix(s, unquotedSuffix) || len(s) <= len(unquotedPrefix)+len(unquotedSuffix) {
+		return "", false
+	}
+	return s[len(unquotedPrefix) : len(s)-len(unquotedSuffix)], true
+}
+
+// typedValue returns the JSON value of the unquoted
+// variable `name`
+func (e *jsonExpander) typedValue(name string) (interface{}, error) {
+	if e.vm != nil {
+		if jsVal := e.vm.Get(name); jsVal != nil {
+			return jsonOf(e.vm, name, jsVal)
+		}
+	}
+	if val, ok := lookupStage(e.vm, name); ok {
+		return val, nil
+	}
+	val, ok := lookupMappings(name, e.mappings)
+	if !ok {
+		return nil, fmt.Errorf("`%s` is undefined", name)
+	}
+	parsed, ok := decodeJSON(strings.TrimSpace(val))
+	if !ok {
+		return nil, fmt.Errorf("`%s` is %q, which isn't a JSON value; quote the variable to send it as a string", name, val)
+	}
+	return parsed, nil
+}
+
+// jsonOf converts a Javascript value through JSON.stringify
+func jsonOf(vm *goja.Runtime, name string, val goja.Value) (interface{}, error) {
+	if goja.IsUndefined(val) || goja.IsNull(val) {
+		return nil, nil
+	}
+	stringify, ok := goja.AssertFunction(vm.Get("JSON").ToObject(vm).Get("stringify"))
+	if !ok {
+		return nil, fmt.Errorf("couldn't convert `%s` to JSON", name)
+	}
+	res, err := stringify(goja.Undefined(), val)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't convert `%s` to JSON: %w", name, err)
+	}
+	if goja.IsUndefined(res) {
+		return nil, fmt.Errorf("`%s` can't be converted to JSON", name)
+	}
+	parsed, ok := decodeJSON(res.String())
+	if !ok {
+		return nil, fmt.Errorf("couldn't convert `%s` to JSON", name)
+	}
+	return parsed, nil
+}
+
+// decodeJSON parses a single JSON value, keeping
+// numbers as written
+func decodeJSON(s string) (interface{}, bool) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader([]byte(s)))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil || dec.More() {
+		return nil, false
+	}
+	return v, true
+}
@@ -7,6 +7,7 @@
 package preprocess
 
 import (
+	"fmt"
 	"os"
 	"strings"
 
@@ -15,9 +16,45 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-// Expand replaces ${var} or $var in the string based on the mapping function.
-// For example, os.ExpandEnv(s) is equivalent to os.Expand(s, os.Getenv).
-func Expand(s string, vm *goja.Runtime, mapping map[string]string) string {
+// Expand replaces ${var} or $var in the string. Variables defined in
+// the Javascript VM take precedence; otherwise the mappings are searched
+// in the given order, the first one defining the variable winning.
+//
+// As in POSIX shells, `${var:-word}` expands to `word` if var is unset
+// or empty, `${var:+word}` to `word` if it's set and not empty (and to
+// nothing otherwise), and `${var:?message}` fails with `message` if var
+// is unset or empty; `word` may itself refer to variables. `$$` stands
+// for a literal `$`. A name such as `login.response.body.token` reads
+// the response of the stage named `login` (see StageRefName), once it
+// has run. Dynamic variables such as `${$uuid}` or
+// `${$randomInt(1, 6)}` are produced by the Generator bound to the VM
+// (see BindGenerator). An undefined `${var}` is replaced by the empty
+// string, whereas an undefined bare `$var` is left as is, so that texts
+// such as `{"$gt": 1}` pass through. For the same reason, a bare `$var`
+// only refers to the Javascript variables which the processor blocks
+// assign (see MarkAssigned), not to globals such as `$Object`.
+func Expand(s string, vm *goja.Runtime, mappings ...map[string]string) (string, error) {
+	e := expander{vm: vm, mappings: mappings, missing: func(name string) {
+		log.Warn().Str("Couldn't find the variable `"+name+"`,  in both Javascript processor block and environment variables. Replacing with empty string", "").Msg("")
+	}}
+	res, err := e.expand(s)
+	if err != nil {
+		return "", err
+	}
+	return utils.RemoveUnquotedValueMarker(res), nil
+}
+
+// expander carries out Expand; `missing` is called for each
+// variable replaced by an empty string. When `collect` is
+// set, `${var:?message}` calls `missing` instead of failing
+type expander struct {
+	vm       *goja.Runtime
+	mappings []map[string]string
+	missing  func(name string)
+	collect  bool
+}
+
+func (e *expander) expand(s string) (string, error) {
 	var buf []byte
 	// ${} is all ASCII, so bytes are fine for this operation.
 	i := 0
@@ -29,39 +66,249 @@ func Expand(s string, vm *goja.Runtime, mapping map[string]string) string {
 			buf = append(buf, s[i:j]...)
 			name, w := getShellName(s[j+1:])
 			//nolint:all
-			if name == "" && w > 0 {
+			if s[j+1] == '$' {
+				// Escaped dollar
+				buf = append(buf, '$')
+				w = 1
+			} else if name == "" && w > 0 {
 				// Encountered invalid syntax; eat the
 				// characters.
 			} else if name == "" {
 				// Valid syntax, but $ was not followed by a
 				// name. Leave the dollar character untouched.
 				buf = append(buf, s[j])
+			} else if s[j+1] == '{' {
+				val, err := e.expandBraced(name)
+				if err != nil {
+					return "", err
+				}
+				buf = append(buf, val...)
+			} else if val, ok := resolveBare(name, e.vm, e.mappings); ok {
+				buf = append(buf, val...)
+			} else if isShellSpecialVar(name[0]) {
+				e.missing(name)
 			} else {
-				jsVal := vm.Get(name)
-				if jsVal != nil {
-					buf = append(buf, []byte(jsVal.String())...)
-				} else {
-					val, ok := mapping[name]
-					if ok {
-						buf = append(buf, val...)
-					} else {
-						buf = append(buf, ""...)
-						log.Warn().Str("Couldn't find the variable `"+name+"`,  in both Javascript processor block and environment variables. Replacing with empty string", "").Msg("")
-					}
+				// Undefined bare name; keep the text
+				if e.collect && looksLikeVar(name) {
+					e.missing(name)
 				}
+				buf = append(buf, s[j:j+1+w]...)
 			}
 			j += w
 			i = j + 1
 		}
 	}
-	res := ""
 	if buf == nil {
-		res = s
+		return s, nil
+	}
+	return string(buf) + s[i:], nil
+}
+
+// expandBraced expands the contents of `${...}`: a name,
+// optionally followed by a `:-`, `:+` or `:?` modifier
+func (e *expander) expandBraced(content string) (string, error) {
+	name, op, word := splitModifier(content)
+	var val string
+	var ok bool
+	if len(name) > 1 && name[0] == '$' && e.collect {
+		// Don't use up values of a seeded sequence
+		_, _, _, err := parseDynamic(name[1:])
+		if err != nil {
+			e.missing(name)
+		}
+		val, ok = name, err == nil
+	} else if len(name) > 1 && name[0] == '$' {
+		var err error
+		if val, err = generatorOf(e.vm).Generate(name[1:]); err != nil {
+			return "", err
+		}
+		ok = true
 	} else {
-		res = string(buf) + s[i:]
+		val, ok = resolveVar(name, e.vm, e.mappings)
+	}
+	set := ok && val != ""
+	switch op {
+	case "-":
+		if set {
+			return val, nil
+		}
+		return e.expand(word)
+	case "+":
+		if set {
+			return e.expand(word)
+		}
+		return "", nil
+	case "?":
+		if set {
+			return val, nil
+		}
+		if e.collect {
+			e.missing(name)
+			return "", nil
+		}
+		msg, err := e.expand(word)
+		if err != nil {
+			return "", err
+		}
+		if msg == "" {
+			msg = "parameter null or not set"
+		}
+		return "", fmt.Errorf("%s: %s", name, msg)
+	}
+	if !ok {
+		e.missing(name)
+	}
+	return val, nil
+}
+
+// splitModifier splits the contents of `${...}` at the first
+// `:-`, `:+` or `:?`, returning the name, the modifier (without
+// the colon) and its word. Without one, the whole contents are
+// the name
+func splitModifier(content string) (string, string, string) {
+	for i := 0; i+1 < len(content); i++ {
+		if content[i] == ':' && strings.IndexByte("-+?", content[i+1]) >= 0 {
+			return content[:i], content[i+1 : i+2], content[i+2:]
+		}
+	}
+	return content, "", ""
+}
+
+// resolveVar looks `name` up in the Javascript VM, then
+// among the stage responses (see StageRefName), then in
+// the mappings
+func resolveVar(name string, vm *goja.Runtime, mappings []map[string]string) (string, bool) {
+	if vm != nil {
+		if jsVal := vm.Get(name); jsVal != nil {
+			return jsVal.String(), true
+		}
+	}
+	if val, ok := lookupStage(vm, name); ok {
+		return stageString(val), true
+	}
+	return lookupMappings(name, mappings)
+}
+
+// resolveBare is resolveVar for a bare `$name`, which is
+// only looked up in the VM if a processor block assigns it
+func resolveBare(name string, vm *goja.Runtime, mappings []map[string]string) (string, bool) {
+	if vm != nil && assignedIn(vm)[name] {
+		if jsVal := vm.Get(name); jsVal != nil {
+			return jsVal.String(), true
+		}
+	}
+	return lookupMappings(name, mappings)
+}
+
+// assignedNames is the set kept by MarkAssigned
+type assignedNames struct {
+	names map[string]bool
+}
+
+// MarkAssigned records the names which a script run in `vm`
+// declares or assigns, as the bare `$name` form only refers
+// to those (see Expand). It needs the `l2` object of the VM
+func MarkAssigned(vm *goja.Runtime, names map[string]bool) {
+	l2, ok := vm.Get("l2").(*goja.Object)
+	if !ok || l2 == nil || len(names) == 0 {
+		return
 	}
-	res2 := utils.RemoveUnquotedValueMarker(res)
-	return res2
+	set := assignedSet(vm)
+	if set == nil {
+		set = &assignedNames{names: make(map[string]bool)}
+		l2.DefineDataProperty("_assigned", vm.ToValue(set), goja.FLAG_FALSE, goja.FLAG_FALSE, goja.FLAG_FALSE)
+	}
+	for name := range names {
+		set.names[name] = true
+	}
+}
+
+// assignedIn returns the names recorded by MarkAssigned
+func assignedIn(vm *goja.Runtime) map[string]bool {
+	if set := assignedSet(vm); set != nil {
+		return set.names
+	}
+	return nil
+}
+
+func assignedSet(vm *goja.Runtime) *assignedNames {
+	l2, ok := vm.Get("l2").(*goja.Object)
+	if !ok || l2 == nil {
+		return nil
+	}
+	if v := l2.Get("_assigned"); v != nil {
+		set, _ := v.Export().(*assignedNames)
+		return set
+	}
+	return nil
+}
+
+// Unresolved returns the names of the variables which
+// Expand would replace with an empty string (or fail on,
+// for `${var:?message}`), in order of appearance and
+// without duplicates. Undefined bare names which look like
+// variables (see looksLikeVar) are included too, although
+// Expand leaves them as they are
+func Unresolved(s string, vm *goja.Runtime, mappings ...map[string]string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	e := expander{vm: vm, mappings: mappings, collect: true, missing: func(name string) {
+		if !seen[name] {
+			names = append(names, name)
+			seen[name] = true
+		}
+	}}
+	e.expand(s)
+	return names
+}
+
+// Referenced returns the names of the variables which `s`
+// refers to, including those within the words of modifiers
+// and dynamic variables (with their `$`), in order of
+// appearance and without duplicates
+func Referenced(s string) []string {
+	var names []string
+	seen := make(map[string]bool)
+	var scan func(s string)
+	scan = func(s string) {
+		for j := 0; j+1 < len(s); j++ {
+			if s[j] != '$' {
+				continue
+			}
+			if s[j+1] == '$' {
+				j++
+				continue
+			}
+			name, w := getShellName(s[j+1:])
+			// Skip positional and special shell variables
+			if len(name) > 1 || (name != "" && !isShellSpecialVar(name[0])) {
+				word := ""
+				if s[j+1] == '{' {
+					name, _, word = splitModifier(name)
+					if i := strings.IndexByte(name, '('); i > 0 && name[0] == '$' {
+						name = name[:i]
+					}
+				}
+				if name != "" && !seen[name] {
+					names = append(names, name)
+					seen[name] = true
+				}
+				scan(word)
+			}
+			j += w
+		}
+	}
+	scan(s)
+	return names
+}
+
+func lookupMappings(name string, mappings []map[string]string) (string, bool) {
+	for _, mapping := range mappings {
+		if val, ok := mapping[name]; ok {
+			return val, true
+		}
+	}
+	return "", false
 }
 
 func getEnvironMap() map[string]string {
@@ -75,10 +322,36 @@ func getEnvironMap() map[string]string {
 }
 
 // ExpandEnv replaces ${var} or $var in the string according to the values
-// of the current environment variables. References to undefined
-// variables are replaced by the empty string.
-func ExpandEnv(s string, vm *goja.Runtime) string {
-	return Expand(s, vm, getEnvironMap())
+// of the current environment variables. The optional `vars` maps (such as
+// the row of a `--data` file) are consulted before the environment.
+// References to undefined variables are handled as in Expand.
+func ExpandEnv(s string, vm *goja.Runtime, vars ...map[string]string) (string, error) {
+	return Expand(s, vm, append(vars, getEnvironMap())...)
+}
+
+// LookupVar returns the value of the variable `name`
+// from the first of the `vars` maps defining it, or else
+// from the environment
+func LookupVar(name string, vars ...map[string]string) (string, bool) {
+	if val, ok := lookupMappings(name, vars); ok {
+		return val, true
+	}
+	return os.LookupEnv(name)
+}
+
+// looksLikeVar reports whether a bare `$name` is named like
+// an environment variable (`$TOKEN`, `$API_KEY`), rather than
+// being text such as the `$gt` of a query
+func looksLikeVar(name string) bool {
+	if name == "" || name[0] < 'A' || name[0] > 'Z' {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c != '_' && (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+			return false
+		}
+	}
+	return true
 }
 
 // isShellSpecialVar reports whether the character identifies a special
@@ -98,16 +371,25 @@ func isAlphaNum(c uint8) bool {
 
 // getShellName returns the name that begins the string and the number of bytes
 // consumed to extract it. If the name is enclosed in {}, it's part of a ${}
-// expansion and two more bytes are needed than the length of the name.
+// expansion and two more bytes are needed than the length of the name; the
+// name then includes any modifier, and may hold nested ${} expansions.
 func getShellName(s string) (string, int) {
 	switch {
 	case s[0] == '{':
 		if len(s) > 2 && isShellSpecialVar(s[1]) && s[2] == '}' {
 			return s[1:2], 3
 		}
-		// Scan to closing brace
+		// Scan to the matching closing brace
+		depth := 0
 		for i := 1; i < len(s); i++ {
-			if s[i] == '}' {
+			switch s[i] {
+			case '{':
+				depth++
+			case '}':
+				if depth > 0 {
+					depth--
+					continue
+				}
 				if i == 1 {
 					return "", 2 // Bad syntax; eat "${}"
 				}
@@ -120,6 +402,9 @@ func getShellName(s string) (string, int) {
 	}
 	// Scan alphanumerics.
 	var i int
+	for i < len(s) && isAlphaNum(s[i]) {
+		i++
+	}
 	return s[:i], i
 }
 
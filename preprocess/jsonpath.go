@@ -0,0 +1,162 @@
+package preprocess
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// jsonPathStep is a step of a JSONPath: a key, an index
+// (negative ones counting from the end) or a wildcard
+type jsonPathStep struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// JSONPath is a parsed path into decoded JSON (see
+// ParseJSONPath), shared by `@capture` and the stage
+// references
+type JSONPath []jsonPathStep
+
+// ParseJSONPath reads the subset of JSONPath made of `$`
+// followed by `.key`, `['key']`, `[0]`, `[-1]`, `.*` and
+// `[*]`. A leading `.` (as in jq) stands for `$.`
+func ParseJSONPath(expr string) (JSONPath, error) {
+	s := strings.TrimPrefix(expr, "$")
+	path := make(JSONPath, 0)
+	for len(s) > 0 {
+		switch {
+		case strings.HasPrefix(s, ".."):
+			return nil, fmt.Errorf("recursive descent (..) isn't supported")
+		case s == "." && expr == ".":
+			s = ""
+		case s[0] == '.':
+			end := strings.IndexAny(s[1:], ".[")
+			if end < 0 {
+				end = len(s) - 1
+			}
+			key := s[1 : end+1]
+			if key == "" {
+				return nil, fmt.Errorf("empty key in %s", expr)
+			}
+			if key == "*" {
+				path = append(path, jsonPathStep{wildcard: true})
+			} else {
+				path = append(path, jsonPathStep{key: key})
+			}
+			s = s[end+1:]
+		case s[0] == '[':
+			end := strings.IndexByte(s, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unclosed [ in %s", expr)
+			}
+			inner := strings.TrimSpace(s[1:end])
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				path = append(path, jsonPathStep{key: inner[1 : len(inner)-1]})
+			} else if inner == "*" {
+				path = append(path, jsonPathStep{wildcard: true})
+			} else if n, err := strconv.Atoi(inner); err == nil {
+				path = append(path, jsonPathStep{index: n, isIndex: true})
+			} else {
+				return nil, fmt.Errorf("invalid [%s] in %s", inner, expr)
+			}
+			s = s[end+1:]
+		default:
+			return nil, fmt.Errorf("expected . or [ at '%s' in %s", s, expr)
+		}
+	}
+	return path, nil
+}
+
+// Eval applies the path to decoded JSON. With a wildcard,
+// the matches are returned as an array. A key made of digits
+// indexes an array too, as in `items.0.id`
+func (path JSONPath) Eval(data interface{}) (interface{}, error) {
+	nodes := []interface{}{data}
+	wildcard := false
+	at := "$"
+	for _, step := range path {
+		next := make([]interface{}, 0)
+		for _, node := range nodes {
+			switch v := node.(type) {
+			case map[string]interface{}:
+				if step.wildcard {
+					keys := make([]string, 0, len(v))
+					for key := range v {
+						keys = append(keys, key)
+					}
+					sort.Strings(keys)
+					for _, key := range keys {
+						next = append(next, v[key])
+					}
+				} else if child, ok := v[step.key]; ok && !step.isIndex {
+					next = append(next, child)
+				} else if !wildcard {
+					if step.isIndex {
+						return nil, fmt.Errorf("%s is an object, not an array", at)
+					}
+					return nil, fmt.Errorf("no key `%s` at %s", step.key, at)
+				}
+			case []interface{}:
+				index, isIndex := step.index, step.isIndex
+				if n, err := strconv.Atoi(step.key); err == nil && !isIndex && !step.wildcard {
+					index, isIndex = n, true
+				}
+				i := index
+				if i < 0 {
+					i += len(v)
+				}
+				switch {
+				case step.wildcard:
+					next = append(next, v...)
+				case isIndex && i >= 0 && i < len(v):
+					next = append(next, v[i])
+				case wildcard:
+				case isIndex:
+					return nil, fmt.Errorf("index %d out of range at %s (length %d)", index, at, len(v))
+				default:
+					return nil, fmt.Errorf("%s is an array, not an object", at)
+				}
+			default:
+				if !wildcard {
+					return nil, fmt.Errorf("%s is %s, not an object or array", at, jsonKind(v))
+				}
+			}
+		}
+		nodes = next
+		wildcard = wildcard || step.wildcard
+		at += step.String()
+	}
+	if wildcard {
+		if len(nodes) == 0 {
+			return nil, fmt.Errorf("nothing matched at %s", at)
+		}
+		return nodes, nil
+	}
+	return nodes[0], nil
+}
+
+func (step jsonPathStep) String() string {
+	switch {
+	case step.wildcard:
+		return "[*]"
+	case step.isIndex:
+		return "[" + strconv.Itoa(step.index) + "]"
+	}
+	return "." + step.key
+}
+
+func jsonKind(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case string:
+		return "a string"
+	case bool:
+		return "a boolean"
+	}
+	return "a number"
+}
@@ -4,13 +4,15 @@
 package preprocess
 
 import (
-	"encoding/json"
+	"bytes"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"os"
-	"path"
+	"os/exec"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/HexmosTech/gabs/v2"
@@ -20,23 +22,116 @@ import (
 	"github.com/rs/zerolog/log"
 )
 
-func ProcessVarsInBlock(block *gabs.Container, vm *goja.Runtime) {
-	ExpandURL(block, vm)
-	ExpandHeaders(block, vm)
-	ExpandJSON(block, vm)
+// ProcessVarsInBlock expands the variables in the URL,
+// headers and body of a request block. The optional `vars`
+// maps take precedence over the environment (see ExpandEnv).
+// An error is returned if a `${var:?message}` fails, or if
+// a variable can't be inserted in the body (see ExpandJSON)
+func ProcessVarsInBlock(block *gabs.Container, vm *goja.Runtime, vars ...map[string]string) error {
+	if err := ExpandURL(block, vm, vars...); err != nil {
+		return err
+	}
+	if err := ExpandHeaders(block, vm, vars...); err != nil {
+		return err
+	}
+	return ExpandJSON(block, vm, vars...)
+}
+
+// VarRef is a variable referred to by a request block,
+// and the field it appears in: `url`, `header name`,
+// "header `Name`" or `body`
+type VarRef struct {
+	Name  string
+	Field string
+}
+
+// UnresolvedRef is a VarRef which can't be resolved
+type UnresolvedRef = VarRef
+
+type blockField struct {
+	field string
+	text  string
 }
 
-func ExpandHeaders(block *gabs.Container, vm *goja.Runtime) {
+// blockFields returns the texts of a request block in which
+// variables are expanded, in the order URL, headers, body
+func blockFields(block *gabs.Container) []blockField {
+	fields := make([]blockField, 0)
+	if url, ok := block.S("url", "value").Data().(string); ok {
+		fields = append(fields, blockField{"url", url})
+	}
+	if headerMap := block.S("details", "headers"); headerMap != nil {
+		headers := headerMap.ChildrenMap()
+		keys := make([]string, 0, len(headers))
+		for k := range headers {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			fields = append(fields, blockField{"header name", k})
+			if v, ok := headers[k].Data().(*gabs.Container); ok {
+				if val, ok := v.Data().(string); ok {
+					fields = append(fields, blockField{"header `" + k + "`", val})
+				}
+			}
+		}
+	}
+	if dataBlock := block.S("details", "ip_data"); dataBlock != nil {
+		fields = append(fields, blockField{"body", dataBlock.String()})
+	}
+	return fields
+}
+
+// FindUnresolved returns the variables of a request block
+// which ProcessVarsInBlock would replace with an empty
+// string, in the order URL, headers, body
+func FindUnresolved(block *gabs.Container, vm *goja.Runtime, vars ...map[string]string) []UnresolvedRef {
+	mappings := append(append([]map[string]string{}, vars...), getEnvironMap())
+	refs := make([]UnresolvedRef, 0)
+	for _, f := range blockFields(block) {
+		for _, name := range Unresolved(f.text, vm, mappings...) {
+			refs = append(refs, UnresolvedRef{Name: name, Field: f.field})
+		}
+	}
+	return refs
+}
+
+// BlockReferences returns every variable a request block
+// refers to (see Referenced), in the order URL, headers, body
+func BlockReferences(block *gabs.Container) []VarRef {
+	refs := make([]VarRef, 0)
+	for _, f := range blockFields(block) {
+		for _, name := range Referenced(f.text) {
+			refs = append(refs, VarRef{Name: name, Field: f.field})
+		}
+	}
+	return refs
+}
+
+// ScriptMentions reports whether the JS code of a processor
+// block mentions the identifier `name`, and so may set it
+func ScriptMentions(script string, name string) bool {
+	re, err := regexp.Compile(`(^|[^\w$])` + regexp.QuoteMeta(name) + `($|[^\w$])`)
+	return err == nil && re.MatchString(script)
+}
+
+func ExpandHeaders(block *gabs.Container, vm *goja.Runtime, vars ...map[string]string) error {
 	headerMap := block.S("details", "headers")
 	log.Debug().Str("HeaderMap", headerMap.String()).Msg("")
 	if headerMap == nil {
-		return
+		return nil
 	}
 	newHeaderMap := gabs.New()
 	for k, v := range headerMap.ChildrenMap() {
 		log.Trace().Strs("Header pair", []string{k, " = ", v.String()}).Msg("")
-		key := ExpandEnv(k, vm)
-		val := ExpandEnv(v.Data().(*gabs.Container).Data().(string), vm)
+		key, err := ExpandEnv(k, vm, vars...)
+		if err != nil {
+			return err
+		}
+		val, err := ExpandEnv(v.Data().(*gabs.Container).Data().(string), vm, vars...)
+		if err != nil {
+			return err
+		}
 		valWrap := gabs.New()
 		valWrap.Set(val)
 		newHeaderMap.Set(valWrap, key)
@@ -44,14 +139,19 @@ func ExpandHeaders(block *gabs.Container, vm *goja.Runtime) {
 	block.Delete("details", "headers")
 	block.Set(newHeaderMap, "details", "headers")
 	log.Debug().Str("Expanded Header block", block.String()).Msg("")
+	return nil
 }
 
-func ExpandURL(block *gabs.Container, vm *goja.Runtime) {
+func ExpandURL(block *gabs.Container, vm *goja.Runtime, vars ...map[string]string) error {
 	b := block.S("url", "value").Data().(string)
 	log.Debug().Str("Url block", b).Msg("")
-	url := ExpandEnv(b, vm)
+	url, err := ExpandEnv(b, vm, vars...)
+	if err != nil {
+		return err
+	}
 	block.Delete("url", "value")
 	block.Set(url, "url", "value")
+	return nil
 }
 
 func debugOp(str string) {
@@ -70,46 +170,89 @@ func debugOp(str string) {
 	fmt.Println("String written to file successfully.")
 }
 
-func escapeString(input string) string {
-	output, err := json.Marshal(input)
-	if err != nil {
-		log.Error().Str("Error marshaling JSON:", "escapeString()")
-	}
-	return string(output)
+func SearchL2ConfigEnv(dir string) (string, error) {
+	return searchUp(dir, "l2config.env")
 }
 
-func ExpandJSON(block *gabs.Container, vm *goja.Runtime) {
-	log.Debug().Str("JSON block to be expanded", block.String()).Msg("")
-	dataBlock := block.S("details", "ip_data")
-	if dataBlock == nil {
-		return
-	}
-	dataBlockStr := dataBlock.String()
-	dataBlockStr = ExpandEnv(dataBlockStr, vm)
-	// dataBlockStr = escapeString(dataBlockStr)
-	dataBlockStr = strings.ReplaceAll(dataBlockStr, "\n", "")
-	log.Debug().Str("Expanded JSON data block", dataBlockStr).Msg("")
-	processedBlock, err := gabs.ParseJSON([]byte(dataBlockStr))
+// searchUp looks for the file `name` in `dir` and then in
+// each of its parents
+func searchUp(dir string, name string) (string, error) {
+	parentDir, err := filepath.Abs(dir)
 	if err != nil {
-		log.Error().Str("Preprocess JSON block issue", "").Msg("")
-		return
+		return "", err
 	}
-	block.Delete("details", "ip_data")
-	block.Set(processedBlock, "details", "ip_data")
-	log.Debug().Str("Processed JSON block", block.String()).Msg("")
-}
-
-func SearchL2ConfigEnv(dir string) (string, error) {
-	parentDir := dir
-	for parentDir != string(filepath.Separator) {
-		l2ConfigPath := filepath.Join(parentDir, "l2config.env")
+	for {
+		l2ConfigPath := filepath.Join(parentDir, name)
 		_, err := os.Stat(l2ConfigPath)
 		if err == nil {
-			return l2ConfigPath, nil // Found the l2config.env file
+			return l2ConfigPath, nil // Found the file
+		}
+		if parentDir == filepath.Dir(parentDir) {
+			break
 		}
 		parentDir = filepath.Dir(parentDir)
 	}
-	return "", errors.New("Didn't find l2config.env in the API directory")
+	return "", errors.New("Didn't find " + name + " in the API directory")
+}
+
+var reEnvName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// EnvFile is an env file read for an API file, with
+// the source reported by GetL2EnvVariables
+type EnvFile struct {
+	Path   string
+	Source string
+}
+
+// EnvName returns the named environment to use: `name`
+// (given through `--env`) if set, otherwise `L2_ENV`
+func EnvName(name string) string {
+	if name != "" {
+		return name
+	}
+	return os.Getenv("L2_ENV")
+}
+
+// EnvFiles returns the env files which apply to an API
+// file in `dir` under the named environment `env` (none if
+// empty), lowest precedence first:
+//
+//  1. `l2config.env`, the nearest one in `dir` or a parent
+//  2. `l2config.<env>.env`, likewise
+//  3. `l2.env` in `dir`
+//  4. `l2.<env>.env` in `dir`
+//
+// Only existing files are listed. A named environment
+// must have at least one of its two files
+func EnvFiles(dir string, env string) ([]EnvFile, error) {
+	if env != "" && !reEnvName.MatchString(env) {
+		return nil, fmt.Errorf("invalid environment name %q; use letters, digits, '_' and '-'", env)
+	}
+	files := make([]EnvFile, 0, 4)
+	if l2ConfigPath, err := SearchL2ConfigEnv(dir); err == nil {
+		files = append(files, EnvFile{l2ConfigPath, "l2configenv"})
+	}
+	found := false
+	if env != "" {
+		if l2ConfigPath, err := searchUp(dir, "l2config."+env+".env"); err == nil {
+			files = append(files, EnvFile{l2ConfigPath, "l2configenv:" + env})
+			found = true
+		}
+	}
+	candidates := []EnvFile{{filepath.Join(dir, "l2.env"), "l2env"}}
+	if env != "" {
+		candidates = append(candidates, EnvFile{filepath.Join(dir, "l2."+env+".env"), "l2env:" + env})
+	}
+	for _, f := range candidates {
+		if _, err := os.Stat(f.Path); err == nil {
+			files = append(files, f)
+			found = found || f.Source != "l2env"
+		}
+	}
+	if env != "" && !found {
+		return nil, fmt.Errorf("environment %q not found: expected l2.%s.env next to the API file or l2config.%s.env above it", env, env, env)
+	}
+	return files, nil
 }
 
 func LoadEnvFile(l2path string) {
@@ -120,14 +263,72 @@ func LoadEnvFile(l2path string) {
 	}
 }
 
-func LoadEnvironments(dir string) {
-	l2ConfigPath, err := SearchL2ConfigEnv(dir)
+// LoadEnvironments loads the env files of an API file in
+// `dir` into the process environment, each overriding the
+// ones before it (see EnvFiles)
+func LoadEnvironments(dir string, env string) error {
+	files, err := EnvFiles(dir, env)
 	if err != nil {
-		log.Info().Str("Type", "Preprocess").Msg(err.Error())
-	} else {
-		LoadEnvFile(l2ConfigPath) // Loads global variables from l2config.env
+		return err
+	}
+	for _, f := range files {
+		LoadEnvFile(f.Path)
 	}
-	LoadEnvFile(path.Join(dir, "l2.env")) // Overwrites the global variables if declared again in l2.env
+	return nil
+}
+
+// ReadEnvironments returns the variables which LoadEnvironments
+// would load for an API file in `dir`, without changing the
+// process environment or the CWD. Backtick commands run
+// from `dir`
+func ReadEnvironments(dir string, env string) (map[string]string, error) {
+	files, err := EnvFiles(dir, env)
+	if err != nil {
+		return nil, err
+	}
+	envMap := make(map[string]string)
+	for _, f := range files {
+		vars, err := readFile(f.Path)
+		if err != nil {
+			continue
+		}
+		for key, value := range vars {
+			if val, ok := RunBacktickCommand(value, dir); ok {
+				envMap[key] = val
+			}
+		}
+	}
+	return envMap, nil
+}
+
+// BacktickCommand returns the command of an env file
+// value wrapped in backticks, such as `date +%s`
+func BacktickCommand(value string) (string, bool) {
+	if len(value) < 2 || value[0] != '`' || value[len(value)-1] != '`' {
+		return "", false
+	}
+	return value[1 : len(value)-1], true
+}
+
+// RunBacktickCommand mirrors the `godotenv` handling of
+// values wrapped in backticks: the command runs through
+// the shell from `dir` and its trimmed output becomes the
+// value. Other values are returned as they are. False is
+// returned if the command fails, leaving the variable
+// unset as `godotenv` does
+func RunBacktickCommand(value string, dir string) (string, bool) {
+	command, ok := BacktickCommand(value)
+	if !ok {
+		return value, true
+	}
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Dir = dir
+	out, err := cmd.Output()
+	if err != nil {
+		log.Error().Str("Type", "Preprocess").Str("Command", value).Str("Error", err.Error()).Msg("Error running command")
+		return "", false
+	}
+	return string(bytes.TrimSpace(out)), true
 }
 
 func readFile(filename string) (envMap map[string]string, err error) {
@@ -139,6 +340,42 @@ func readFile(filename string) (envMap map[string]string, err error) {
 	return godotenv.Parse(file)
 }
 
+var reEnvLine = regexp.MustCompile(`^\s*(?:export\s+)?([A-Za-z_][A-Za-z0-9_.]*)\s*[=:]`)
+
+// EnvEntry is a variable of an env file, with the
+// (1-based) line defining it
+type EnvEntry struct {
+	Key   string
+	Value string
+	Line  int
+}
+
+// ReadEnvFile returns the variables of an env file, sorted
+// by line. Values are as written: backtick commands aren't
+// run (see RunBacktickCommand). A variable defined twice is reported at the last line
+func ReadEnvFile(envPath string) ([]EnvEntry, error) {
+	vars, err := readFile(envPath)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(envPath)
+	if err != nil {
+		return nil, err
+	}
+	lines := make(map[string]int)
+	for n, line := range strings.Split(string(content), "\n") {
+		if m := reEnvLine.FindStringSubmatch(line); m != nil {
+			lines[m[1]] = n + 1
+		}
+	}
+	entries := make([]EnvEntry, 0, len(vars))
+	for key, value := range vars {
+		entries = append(entries, EnvEntry{Key: key, Value: value, Line: lines[key]})
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Line < entries[j].Line })
+	return entries, nil
+}
+
 func getEnvMap(envPath string, source string) (map[string]map[string]interface{}, error) {
 	envs, err := readFile(envPath)
 	if err != nil {
@@ -155,8 +392,8 @@ func getEnvMap(envPath string, source string) (map[string]map[string]interface{}
 }
 
 func combineEnvMaps(envMaps ...map[string]map[string]interface{}) map[string]map[string]interface{} {
-	// First l2config varibales are added to the map.
-	// Then l2env varibales, so if a variable is redeclared in l2env then it will overwritten and taken to consideration.
+	// The maps come lowest precedence first, so a variable
+	// redeclared in a later file overwrites the earlier value.
 	finalEnvMap := make(map[string]map[string]interface{})
 	for _, envMap := range envMaps {
 		for key, value := range envMap {
@@ -166,39 +403,36 @@ func combineEnvMaps(envMaps ...map[string]map[string]interface{}) map[string]map
 	return finalEnvMap
 }
 
-func GetL2EnvVariables(dir string) (map[string]map[string]interface{}, error) {
-	l2ConfigEnvMap := make(map[string]map[string]interface{})
-
-	l2ConfigPath, err := SearchL2ConfigEnv(dir)
+// GetL2EnvVariables returns the variables of the env files
+// of an API file in `dir` (see EnvFiles), each with its value
+// (`val`) and the file it comes from (`src`): `l2configenv`,
+// `l2env`, or `l2configenv:<env>` and `l2env:<env>` for the
+// files of the named environment
+func GetL2EnvVariables(dir string, env string) (map[string]map[string]interface{}, error) {
+	files, err := EnvFiles(dir, env)
 	if err != nil {
-		// If l2config file is not found, assign an empty map to l2EnvMap and continue
-		l2ConfigEnvMap = make(map[string]map[string]interface{})
-	} else {
-		l2ConfigEnvMap, err = getEnvMap(l2ConfigPath, "l2configenv")
+		return nil, err
+	}
+	envMaps := make([]map[string]map[string]interface{}, 0, len(files))
+	for _, f := range files {
+		envMap, err := getEnvMap(f.Path, f.Source)
 		if err != nil {
-			// If an error occurs, assign an empty map to l2EnvMap and continue
-			l2ConfigEnvMap = make(map[string]map[string]interface{})
+			// Skip unreadable files and continue
+			continue
 		}
+		envMaps = append(envMaps, envMap)
 	}
-
-	l2EnvPath := path.Join(dir, "l2.env")
-	l2EnvMap, err := getEnvMap(l2EnvPath, "l2env")
-	if err != nil {
-		// If an error occurs, assign an empty map to l2EnvMap and continue
-		l2EnvMap = make(map[string]map[string]interface{})
-	}
-
-	finalEnvMap := combineEnvMaps(l2ConfigEnvMap, l2EnvMap)
-
-	return finalEnvMap, nil
+	return combineEnvMaps(envMaps...), nil
 }
 
-func GetLamaFileAsString(path string) string {
+// GetLamaFileAsString reads the API file at `path`
+func GetLamaFileAsString(path string) (string, error) {
 	b, err := ioutil.ReadFile(path) // just pass the file name
 	if err != nil {
-		log.Fatal().Str("Type", "Preprocess").Msg(fmt.Sprint("Couldn't read: ", path))
+		log.Error().Str("Type", "Preprocess").Msg(fmt.Sprint("Couldn't read: ", path))
+		return "", fmt.Errorf("couldn't read %s: %w", path, err)
 	}
-	return string(b)
+	return string(b), nil
 }
 
 // LamaFile takes in a path to an API file.
@@ -208,7 +442,7 @@ func GetLamaFileAsString(path string) string {
 // Once done, it reverts back to the original directory,
 // and returns the processed l2 file.
 func LamaFile(inputFile string) (string, string) {
-	content := GetLamaFileAsString(inputFile)
+	content, _ := GetLamaFileAsString(inputFile)
 	_, dir, _ := utils.GetFilePathComponents(inputFile)
 	oldDir, _ := os.Getwd()
 
@@ -0,0 +1,122 @@
+package preprocess
+
+import (
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/dop251/goja"
+)
+
+var reStageRef = regexp.MustCompile(`^([A-Za-z0-9_-]+)\.response(?:\.(.+))?$`)
+
+// StageRefName returns the stage named by a variable such as
+// `login.response.body.token`, which refers to the response
+// of the latest run of the stage annotated `@name login`
+func StageRefName(name string) (string, bool) {
+	m := reStageRef.FindStringSubmatch(name)
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+// lookupStage resolves a stage reference (see StageRefName)
+// from the `history` of the responses bound to the VM:
+//
+//	login.response.status          status code (also statusText, url, elapsed)
+//	login.response.headers.X-Token header, case-insensitive
+//	login.response.cookies.sid     cookie set by the response
+//	login.response.body            body text
+//	login.response.body.items[0].id  value within a JSON body
+//
+// It reports false if the stage hasn't run or the value
+// doesn't exist. Values are as decoded from JSON
+func lookupStage(vm *goja.Runtime, name string) (interface{}, bool) {
+	m := reStageRef.FindStringSubmatch(name)
+	if m == nil || vm == nil {
+		return nil, false
+	}
+	resp := stageResponse(vm, m[1])
+	if resp == nil {
+		return nil, false
+	}
+	field, rest := m[2], ""
+	if i := strings.IndexAny(m[2], ".["); i >= 0 {
+		field, rest = m[2][:i], m[2][i:]
+	}
+	switch field {
+	case "status", "statusText", "url", "elapsed":
+		if rest != "" {
+			return nil, false
+		}
+		return exportValue(resp.Get(field))
+	case "headers", "cookies":
+		if !strings.HasPrefix(rest, ".") || len(rest) == 1 {
+			return nil, false
+		}
+		obj := resp.Get(field)
+		if obj == nil {
+			return nil, false
+		}
+		return exportValue(obj.ToObject(vm).Get(rest[1:]))
+	case "body":
+		body := resp.Get("body")
+		if body == nil {
+			return nil, false
+		}
+		if rest == "" {
+			return body.String(), true
+		}
+		var data interface{}
+		dec := json.NewDecoder(strings.NewReader(body.String()))
+		dec.UseNumber()
+		if dec.Decode(&data) != nil {
+			return nil, false
+		}
+		path, err := ParseJSONPath("$" + rest)
+		if err != nil {
+			return nil, false
+		}
+		val, err := path.Eval(data)
+		return val, err == nil
+	}
+	return nil, false
+}
+
+// stageResponse returns the latest `response` object
+// of the stage `name` recorded in `history`
+func stageResponse(vm *goja.Runtime, name string) *goja.Object {
+	history, ok := vm.Get("history").(*goja.Object)
+	if !ok || history == nil {
+		return nil
+	}
+	for i := history.Get("length").ToInteger() - 1; i >= 0; i-- {
+		resp, ok := history.Get(strconv.FormatInt(i, 10)).(*goja.Object)
+		if ok && resp != nil && resp.Get("name") != nil && resp.Get("name").String() == name {
+			return resp
+		}
+	}
+	return nil
+}
+
+func exportValue(v goja.Value) (interface{}, bool) {
+	if v == nil || goja.IsUndefined(v) || goja.IsNull(v) {
+		return nil, false
+	}
+	return v.Export(), true
+}
+
+// stageString renders a stage value as text: strings
+// as they are, and anything else as JSON
+func stageString(v interface{}) string {
+	if s, ok := v.(string); ok {
+		return s
+	}
+	b, err := json.Marshal(v)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
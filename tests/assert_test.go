@@ -0,0 +1,98 @@
+package tests
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/HexmosTech/lama2/cmdexec"
+	controller "github.com/HexmosTech/lama2/controller"
+	"github.com/HexmosTech/lama2/utils"
+)
+
+func TestAssertionsInTest(t *testing.T) {
+	vm := cmdexec.GetJSVm()
+	err := cmdexec.RunProcessorCode(`
+		l2.test("passes", () => { expect({a: [1, 2]}).toEqual({a: [1, 2]}) })
+		l2.test("fails", () => { expect(404).toBe(200) })
+		l2.test("negated", () => { expect("hello").not.toContain("bye") })
+	`, vm)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	results := cmdexec.CollectTestResults(vm)
+	if len(results) != 3 {
+		t.Fatalf("Expected 3 results, got %v", results)
+	}
+	if !results[0].Passed || results[1].Passed || !results[2].Passed {
+		t.Fatalf("Unexpected results: %v", results)
+	}
+	if results[1].Error != "expected 404 to be 200" {
+		t.Fatalf("Unexpected failure message: %s", results[1].Error)
+	}
+	if len(cmdexec.CollectTestResults(vm)) != 0 {
+		t.Fatalf("Expected results to be cleared once collected")
+	}
+}
+
+func TestTopLevelExpectFailure(t *testing.T) {
+	vm := cmdexec.GetJSVm()
+	err := cmdexec.RunProcessorCode(`expect(undefined).toBeDefined()`, vm)
+	if err != nil {
+		t.Fatalf("A failed expect should be recorded, not returned: %v", err)
+	}
+	results := cmdexec.CollectTestResults(vm)
+	if len(results) != 1 || results[0].Passed {
+		t.Fatalf("Expected a single failed result, got %v", results)
+	}
+
+	err = cmdexec.RunProcessorCode(`undefinedFunction()`, vm)
+	if err == nil {
+		t.Fatalf("Expected JS errors to be returned")
+	}
+}
+
+func TestTestMode(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"id": 7}`)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	good := "GET " + server.URL + "/ok\n---\nl2.test(\"id is 7\", () => expect(result.id).toBe(7))\n"
+	bad := "GET " + server.URL + "/ok\n---\nl2.test(\"id is 8\", () => expect(result.id).toBe(8))\n"
+	os.WriteFile(filepath.Join(dir, "a_good.l2"), []byte(good), 0o644)
+	os.WriteFile(filepath.Join(dir, "b_bad.l2"), []byte(bad), 0o644)
+
+	junit := filepath.Join(dir, "report.xml")
+	tap := filepath.Join(dir, "report.tap")
+	code := controller.RunTestMode([]string{"test", "--junit", junit, "--tap", tap, dir})
+	if code != utils.ExitAssertion {
+		t.Fatalf("Expected exit code %d with a failing test, got %d", utils.ExitAssertion, code)
+	}
+
+	tapContent, _ := os.ReadFile(tap)
+	if !strings.Contains(string(tapContent), "1..2") ||
+		!strings.Contains(string(tapContent), "ok 1 - ") ||
+		!strings.Contains(string(tapContent), "not ok 2 - ") {
+		t.Fatalf("Unexpected TAP report:\n%s", tapContent)
+	}
+
+	// A file which doesn't parse comes first, so its code wins
+	os.WriteFile(filepath.Join(dir, "0_broken.l2"), []byte("NOTAVERB "+server.URL+"\n"), 0o644)
+	if code := controller.RunTestMode([]string{"test", "--tap", tap, dir}); code != utils.ExitParse {
+		t.Errorf("Expected exit code %d with a parse error, got %d", utils.ExitParse, code)
+	}
+	os.Remove(filepath.Join(dir, "0_broken.l2"))
+
+	junitContent, _ := os.ReadFile(junit)
+	if !strings.Contains(string(junitContent), `<testsuites tests="2" failures="1">`) ||
+		!strings.Contains(string(junitContent), `expected 7 to be 8`) {
+		t.Fatalf("Unexpected JUnit report:\n%s", junitContent)
+	}
+}
@@ -0,0 +1,154 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/HexmosTech/lama2/cmdexec"
+	controller "github.com/HexmosTech/lama2/controller"
+	"github.com/HexmosTech/lama2/lama2cmd"
+	"github.com/HexmosTech/lama2/parser"
+	"github.com/HexmosTech/lama2/utils"
+)
+
+func tokenServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if r.URL.Path == "/token" {
+			w.Header().Set("X-Issued", "yes")
+			fmt.Fprintf(w, `{"token": "t-%s", "sent": %q}`, r.Header.Get("X-Key"), body)
+			return
+		}
+		fmt.Fprintf(w, `{"auth": %q, "trace": %q}`, r.Header.Get("Authorization"), r.Header.Get("X-Trace"))
+	}))
+}
+
+func TestAsyncProcessors(t *testing.T) {
+	server := tokenServer()
+	defer server.Close()
+
+	api := "const sleep = (ms) => new Promise((resolve) => setTimeout(resolve, ms))\n" +
+		"await sleep(5)\n" +
+		"const res = await fetch('" + server.URL + "/token', {method: 'POST', headers: {'X-Key': 'k1'}, body: JSON.stringify({a: 1})})\n" +
+		"const {token, sent} = await res.json()\n" +
+		"let ISSUED = res.ok && res.headers.get('x-issued')\n" +
+		"var order = []\n" +
+		"setTimeout(() => order.push('timer'), 1)\n" +
+		"Promise.resolve().then(() => order.push('microtask'))\n" +
+		"l2.beforeSend(async function (req) {\n" +
+		"  const r = await fetch('" + server.URL + "/token', {method: 'POST', headers: {'X-Key': 'k2'}, body: '{}'})\n" +
+		"  req.headers['X-Trace'] = (await r.json()).token\n" +
+		"})\n" +
+		"\n---\n\n" +
+		"GET " + server.URL + "/items\nAuthorization: 'Bearer ${token}'\n\n---\n\n" +
+		"l2.test('async test', async () => {\n" +
+		"  await sleep(1)\n" +
+		"  expect(order).toEqual(['microtask', 'timer'])\n" +
+		"  expect(sent).toBe('{\"a\":1}')\n" +
+		"  expect(ISSUED).toBe('yes')\n" +
+		"})\n"
+	results, err := runL2(t, api, &lama2cmd.Opts{Quiet: true}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := `{"auth": "Bearer t-k1", "trace": "t-k2"}`
+	if body := controller.LastResponse(results).Body; body != want {
+		t.Errorf("Expected %s, got %s", want, body)
+	}
+	tests := results[len(results)-1].Tests
+	if len(tests) != 1 || !tests[0].Passed {
+		t.Errorf("Expected the async test to pass, got %+v", tests)
+	}
+}
+
+func TestFetchQuiet(t *testing.T) {
+	server := tokenServer()
+	defer server.Close()
+
+	parsed, err := parser.NewLama2Parser().Parse("await fetch('" + server.URL + "/token')\n\n---\n\nGET " + server.URL + "/items\n")
+	if err != nil {
+		t.Fatalf("Error on parsing: %v", err)
+	}
+	out := &bytes.Buffer{}
+	executor := cmdexec.NewNativeExecutor(&lama2cmd.Opts{Nocolor: true})
+	executor.Out = out
+	r := &controller.Runner{Opts: &lama2cmd.Opts{}, Dir: ".", Executor: executor}
+	if _, err := r.Run(context.Background(), parsed); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if strings.Contains(out.String(), "token") || !strings.Contains(out.String(), "auth") {
+		t.Errorf("Expected only the requester block's response to be printed, got %s", out.String())
+	}
+}
+
+func TestAsyncProcessorErrors(t *testing.T) {
+	server := tokenServer()
+	defer server.Close()
+	o := &lama2cmd.Opts{Quiet: true}
+
+	cases := []struct {
+		script  string
+		message string
+	}{
+		{"await Promise.reject(new Error('denied'))", "Error: denied"},
+		{"setTimeout(() => { throw new Error('late') }, 1)", "Error: late"},
+		{"await new Promise(() => {})", "awaiting a promise which never settles"},
+		{"await fetch('" + server.URL + "', {body: 'x'})", "fetch: a GET request can't have a body"},
+		{"await fetch('http://127.0.0.1:1/')", "fetch failed: sending HTTP request"},
+	}
+	for _, c := range cases {
+		_, err := runL2(t, "GET "+server.URL+"\n\n---\n\n"+c.script+"\n", o, nil)
+		expectExecError(t, err, utils.KindScript, 2, 5)
+		if !strings.Contains(err.Error(), c.message) {
+			t.Errorf("%s: expected %q, got %v", c.script, c.message, err)
+		}
+	}
+}
+
+func TestAsyncFailedBlockTimers(t *testing.T) {
+	server := tokenServer()
+	defer server.Close()
+
+	api := "setTimeout(() => { LEAKED = 'timer' }, 10)\nfetch('" + server.URL + "/token').then(() => { LEAKED = 'fetch' })\nthrow new Error('boom')\n\n---\n\n" +
+		"GET " + server.URL + "/items\n\n---\n\n" +
+		"await new Promise((resolve) => setTimeout(resolve, 50))\nl2.test('no leak', () => expect(typeof LEAKED).toBe('undefined'))\n"
+	results, err := runL2(t, api, &lama2cmd.Opts{Quiet: true, ContinueOnError: true}, nil)
+	expectExecError(t, err, utils.KindScript, 1, 1)
+	tests := results[len(results)-1].Tests
+	if len(tests) != 1 || !tests[0].Passed {
+		t.Errorf("Expected the timers of the failed block to be dropped, got %+v", tests)
+	}
+}
+
+func TestFetchTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(300 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	_, err := runL2(t, "await fetch('"+server.URL+"')\n\n---\n\nGET "+server.URL+"\n", &lama2cmd.Opts{Quiet: true, Timeout: "50ms"}, nil)
+	expectExecError(t, err, utils.KindScript, 1, 1)
+	if !strings.Contains(err.Error(), "fetch failed: request timed out after 50ms") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
+
+func TestAsyncInterrupted(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := runL2Context(t, ctx, "setTimeout(() => {}, 60000)\n\n---\n\nGET http://127.0.0.1:1/\n")
+	if err != context.DeadlineExceeded {
+		t.Errorf("Expected the deadline to stop the run, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Expected the pending timer to be abandoned, waited %v", elapsed)
+	}
+}
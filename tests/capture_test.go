@@ -0,0 +1,94 @@
+package tests
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	controller "github.com/HexmosTech/lama2/controller"
+	"github.com/HexmosTech/lama2/lama2cmd"
+	"github.com/HexmosTech/lama2/utils"
+)
+
+func captureServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			w.Header().Set("ETag", `"v1"`)
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: "s3ss"})
+			w.Write([]byte(`{"json": {"Token": "t0k3n", "items": [{"id": 1}, {"id": 2}], "meta": {"page": 3}}}`))
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, `{"auth": %q, "match": %q, "body": %s}`, r.Header.Get("Authorization"), r.Header.Get("If-Match"), body)
+	}))
+}
+
+func TestCapture(t *testing.T) {
+	server := captureServer()
+	defer server.Close()
+
+	api := "@capture TOKEN = $.json.Token\n@capture ETAG = header:etag\n@capture SID = cookie:sid\n@capture IDS = $.json.items[*].id\n@capture LAST = .json.items[-1]\n@capture PAGE = $['json']['meta'].page\n@capture CODE = status\n" +
+		"POST " + server.URL + "/login\n\n{}\n\n---\n\nconsole.log(TOKEN)\n\n---\n\n" +
+		"POST " + server.URL + "/items\nAuthorization: 'Bearer ${TOKEN}'\nIf-Match: '${ETAG}'\n\n{\"ids\": ${IDS}, \"last\": ${LAST}, \"page\": ${PAGE}, \"code\": ${CODE}, \"sid\": \"${SID}\"}\n"
+	results, err := runL2(t, api, &lama2cmd.Opts{Quiet: true, Strict: true}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := `{"auth": "Bearer t0k3n", "match": "\"v1\"", "body": {"code":200,"ids":[1,2],"last":{"id":2},"page":3,"sid":"s3ss"}}`
+	if body := controller.LastResponse(results).Body; body != want {
+		t.Errorf("Expected %s, got %s", want, body)
+	}
+}
+
+func TestCaptureErrors(t *testing.T) {
+	server := captureServer()
+	defer server.Close()
+	o := &lama2cmd.Opts{Quiet: true}
+
+	cases := []struct {
+		capture string
+		kind    utils.ErrorKind
+		message string
+	}{
+		{"TOKEN = $.json.Missing", utils.KindScript, "@capture TOKEN = $.json.Missing: no key `Missing` at $.json"},
+		{"TOKEN = $.json.items[5]", utils.KindScript, "index 5 out of range at $.json.items (length 2)"},
+		{"TOKEN = $.json.Token.value", utils.KindScript, "$.json.Token is a string, not an object or array"},
+		{"TOKEN = header:X-Missing", utils.KindScript, "no X-Missing header in the response"},
+		{"TOKEN $.json.Token", utils.KindParse, "expected NAME = expression"},
+		{"TOKEN = json.Token", utils.KindParse, "expected a JSONPath"},
+	}
+	for _, c := range cases {
+		_, err := runL2(t, "@capture "+c.capture+"\nPOST "+server.URL+"/login\n\n{}\n", o, nil)
+		expectExecError(t, err, c.kind, 1, 1)
+		if !strings.Contains(err.Error(), c.message) {
+			t.Errorf("%s: expected %q, got %v", c.capture, c.message, err)
+		}
+	}
+}
+
+func TestCaptureLargeNumbers(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"id": 9007199254740993, "ratio": 1.5, "path": %q}`, r.URL.Path)
+	}))
+	defer server.Close()
+
+	api := "@name a\n@capture ID = $.id\n@capture RATIO = $.ratio\nGET " + server.URL + "/a\n\n---\n\nl2.test('ratio', () => expect(RATIO * 2).toBe(3))\n\n---\n\n" +
+		"GET " + server.URL + "/c/${ID}/${a.response.body.id}\n"
+	results, err := runL2(t, api, &lama2cmd.Opts{Quiet: true}, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if body := controller.LastResponse(results).Body; !strings.Contains(body, `"path": "/c/9007199254740993/9007199254740993"`) {
+		t.Errorf("Expected the exact ID, got %s", body)
+	}
+	for _, r := range results {
+		for _, test := range r.Tests {
+			if !test.Passed {
+				t.Errorf("Unexpected failed test: %+v", test)
+			}
+		}
+	}
+}
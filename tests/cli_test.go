@@ -1,9 +1,11 @@
 package tests
 
 import (
+	"os"
 	"reflect"
 	"testing"
 
+	controller "github.com/HexmosTech/lama2/controller"
 	"github.com/HexmosTech/lama2/lama2cmd"
 )
 
@@ -27,3 +29,19 @@ func TestCmdBasic(t *testing.T) {
 		t.Errorf("Unsuccessful parsing basic CLI options.\nExpected:\n%v\nGot:\n%v", expected, o)
 	}
 }
+
+func TestSubcommandOrPath(t *testing.T) {
+	cwd, _ := os.Getwd()
+	defer os.Chdir(cwd)
+	os.Chdir(t.TempDir())
+
+	if !controller.IsSubcommand([]string{"l2", "test", "--tap", "out.tap"}, "test") {
+		t.Errorf("Expected `l2 test` to run the test mode")
+	}
+	// A directory or file by that name is run instead
+	os.Mkdir("test", 0o755)
+	os.WriteFile("env", []byte("GET http://example.com\n"), 0o644)
+	if controller.IsSubcommand([]string{"l2", "test"}, "test") || controller.IsSubcommand([]string{"l2", "env"}, "env") {
+		t.Errorf("Expected the existing paths to be run as API files")
+	}
+}
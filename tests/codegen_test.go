@@ -40,7 +40,7 @@ func TestGenerateMultiStage(t *testing.T) {
 	nowPwd, _ := os.Getwd()
 	utils.ChangeWorkingDir(dir)
 	defer utils.ChangeWorkingDir(nowPwd)
-	preprocess.LoadEnvironments(dir)
+	preprocess.LoadEnvironments(dir, "")
 	p := parser.NewLama2Parser()
 	parsedAPI, _ := p.Parse(string(apiContent))
 	fmt.Println(parsedAPI)
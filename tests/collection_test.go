@@ -0,0 +1,97 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	controller "github.com/HexmosTech/lama2/controller"
+	"github.com/HexmosTech/lama2/lama2cmd"
+	"github.com/HexmosTech/lama2/utils"
+)
+
+func writeCollection(t *testing.T, files map[string]string) string {
+	dir := t.TempDir()
+	for name, content := range files {
+		fpath := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(fpath), 0o755)
+		if err := os.WriteFile(fpath, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestCollectAPIFiles(t *testing.T) {
+	dir := writeCollection(t, map[string]string{
+		"b.l2":              "GET http://localhost",
+		"a.l2":              "GET http://localhost",
+		"users/list.l2":     "GET http://localhost",
+		"users/slow.l2":     "GET http://localhost",
+		"notes.txt":         "not an API file",
+		".lama2/state.l2":   "GET http://localhost",
+		"admin/internal.l2": "GET http://localhost",
+	})
+
+	files, err := controller.CollectAPIFiles(dir, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"a.l2", "admin/internal.l2", "b.l2", "users/list.l2", "users/slow.l2"}
+	if len(files) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, files)
+	}
+	for i, e := range expected {
+		if files[i] != filepath.Join(dir, e) {
+			t.Fatalf("Expected %s at position %d, got %s", e, i, files[i])
+		}
+	}
+
+	files, _ = controller.CollectAPIFiles(dir, []string{"users/*"}, []string{"slow.l2"})
+	if len(files) != 1 || files[0] != filepath.Join(dir, "users", "list.l2") {
+		t.Fatalf("Unexpected filtered files: %v", files)
+	}
+
+	files, _ = controller.CollectAPIFiles(filepath.Join(dir, "*.l2"), nil, nil)
+	if len(files) != 2 {
+		t.Fatalf("Expected the glob to match 2 files, got %v", files)
+	}
+}
+
+func TestRunCollection(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"ok": true}`)
+	}))
+	defer server.Close()
+
+	dir := writeCollection(t, map[string]string{
+		"1_good.l2":   "GET " + server.URL + "/one\n",
+		"2_broken.l2": "NOTAVERB " + server.URL + "\n",
+		"3_good.l2":   "GET " + server.URL + "/three\n",
+	})
+
+	o := &lama2cmd.Opts{Quiet: true}
+	o.Positional.LamaAPIFile = dir
+	if code := controller.RunCollection(context.Background(), o); code != utils.ExitParse {
+		t.Fatalf("Expected the parse error exit code when a file fails to parse, got %d", code)
+	}
+
+	o.Exclude = []string{"*broken*"}
+	if code := controller.RunCollection(context.Background(), o); code != 0 {
+		t.Fatalf("Expected exit code 0 once the broken file is excluded, got %d", code)
+	}
+
+	out := filepath.Join(t.TempDir(), "out.json")
+	o.Output = out
+	if code := controller.RunCollection(context.Background(), o); code != utils.ExitFailure {
+		t.Fatalf("Expected -o to be rejected for a collection, got exit code %d", code)
+	}
+	if _, err := os.Stat(out); !os.IsNotExist(err) {
+		t.Fatalf("Expected no output file for a rejected collection run, got %v", err)
+	}
+}
@@ -27,7 +27,10 @@ func TestConstruct(t *testing.T) {
 	}
 	blocks := contoller.GetParsedAPIBlocks(res)
 	for _, block := range blocks {
-		r2, body := cmdgen.ConstructCommand(block, opts)
+		r2, body, err := cmdgen.ConstructCommand(block, opts)
+		if err != nil {
+			t.Fatalf("Error constructing command: %v", err)
+		}
 		log.Debug().Strs("Constructed command", r2).Msg("")
 		log.Debug().Str("Constructed body: ", body).Msg("")
 	}
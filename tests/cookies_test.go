@@ -0,0 +1,104 @@
+package tests
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/HexmosTech/lama2/cmdexec"
+	controller "github.com/HexmosTech/lama2/controller"
+	"github.com/HexmosTech/lama2/lama2cmd"
+)
+
+// sessionServer sets a `session` cookie on `/login` and
+// echoes the cookies it receives on other paths
+func sessionServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/", MaxAge: 3600})
+			http.SetCookie(w, &http.Cookie{Name: "theme", Value: "dark"})
+		}
+		fmt.Fprintf(w, `{"cookie": %q}`, r.Header.Get("Cookie"))
+	}))
+}
+
+func TestCookieJarAcrossStages(t *testing.T) {
+	server := sessionServer()
+	defer server.Close()
+
+	api := "GET " + server.URL + "/login\n\n---\n\n" +
+		"l2.test(\"jar\", () => expect(l2.cookies.get(\"session\")).toBe(\"abc\"))\n\n---\n\n" +
+		"GET " + server.URL + "/me\n\n---\n\n" +
+		"l2.test(\"sent\", () => expect(result.cookie).toContain(\"session=abc\"))\nl2.cookies.clear()\n\n---\n\n" +
+		"GET " + server.URL + "/me\n\n---\n\n" +
+		"l2.test(\"cleared\", () => expect(result.cookie).toBe(\"\"))\n"
+	results, err := runL2(t, api, &lama2cmd.Opts{Quiet: true}, nil)
+	if err != nil || controller.TestsFailed(results) {
+		t.Fatalf("Expected the cookies to be shared across stages, got %v, %+v", err, results)
+	}
+}
+
+func TestCookieJarFile(t *testing.T) {
+	server := sessionServer()
+	defer server.Close()
+
+	for _, name := range []string{"cookies.txt", "cookies.json"} {
+		path := filepath.Join(t.TempDir(), name)
+		o := &lama2cmd.Opts{Quiet: true, CookieJar: path}
+		if _, err := runL2(t, "GET "+server.URL+"/login\n", o, nil); err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		saved, _ := os.ReadFile(path)
+		if !strings.Contains(string(saved), "session") || !strings.Contains(string(saved), "theme") {
+			t.Fatalf("Expected the cookies in %s, got %s", name, saved)
+		}
+
+		for _, executor := range []string{"native", "httpie"} {
+			o.Executor = executor
+			results, err := runL2(t, "GET "+server.URL+"/me\n", o, nil)
+			if err != nil || !strings.Contains(results[1].Response.Body, "session=abc") {
+				t.Fatalf("Expected the saved cookies to be sent by the %s executor, got %v, %s", executor, err, results[1].Response.Body)
+			}
+		}
+	}
+}
+
+func TestCookieJarRules(t *testing.T) {
+	jar := cmdexec.NewCookieJar()
+	u, _ := url.Parse("https://api.example.com/v1/login")
+	jar.SetCookies(u, []*http.Cookie{
+		{Name: "host", Value: "1"},
+		{Name: "domain", Value: "2", Domain: ".example.com", Path: "/"},
+		{Name: "secure", Value: "3", Path: "/", Secure: true},
+		{Name: "foreign", Value: "4", Domain: "other.com"},
+	})
+	names := func(raw string) string {
+		target, _ := url.Parse(raw)
+		res := make([]string, 0)
+		for _, c := range jar.Cookies(target) {
+			res = append(res, c.Name)
+		}
+		return strings.Join(res, ",")
+	}
+	if got := names("https://api.example.com/v1/users"); got != "host,domain,secure" {
+		t.Fatalf("Unexpected cookies %s", got)
+	}
+	if got := names("http://www.example.com/"); got != "domain" {
+		t.Fatalf("Unexpected cookies for a subdomain over http: %s", got)
+	}
+
+	jar.SetCookies(u, []*http.Cookie{{Name: "domain", Domain: ".example.com", Path: "/", MaxAge: -1}})
+	path := filepath.Join(t.TempDir(), "jar.txt")
+	if err := jar.Save(path); err != nil {
+		t.Fatalf("Couldn't save the jar: %v", err)
+	}
+	loaded, err := cmdexec.LoadCookieJar(path)
+	if err != nil || len(loaded.All()) != 2 {
+		t.Fatalf("Expected the two remaining cookies to round-trip, got %+v (%v)", loaded.All(), err)
+	}
+}
@@ -0,0 +1,111 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+
+	controller "github.com/HexmosTech/lama2/controller"
+	"github.com/HexmosTech/lama2/lama2cmd"
+	"github.com/HexmosTech/lama2/preprocess"
+	"github.com/HexmosTech/lama2/utils"
+)
+
+func TestLoadDataRows(t *testing.T) {
+	dir := t.TempDir()
+	csvPath := filepath.Join(dir, "rows.csv")
+	jsonPath := filepath.Join(dir, "rows.json")
+	os.WriteFile(csvPath, []byte("id,name\n1,alice\n2,\"bob, jr\"\n"), 0o644)
+	os.WriteFile(jsonPath, []byte(`[{"id": 1, "name": "alice", "admin": true}, {"id": 2.5, "tags": ["a"]}]`), 0o644)
+
+	rows, err := preprocess.LoadDataRows(csvPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0]["id"] != "1" || rows[1]["name"] != "bob, jr" {
+		t.Fatalf("Unexpected CSV rows: %v", rows)
+	}
+
+	rows, err = preprocess.LoadDataRows(jsonPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0]["id"] != "1" || rows[0]["admin"] != "true" ||
+		rows[1]["id"] != "2.5" || rows[1]["tags"] != `["a"]` {
+		t.Fatalf("Unexpected JSON rows: %v", rows)
+	}
+
+	if _, err := preprocess.LoadDataRows(filepath.Join(dir, "rows.txt")); err == nil {
+		t.Fatalf("Expected an error for an unsupported data file")
+	}
+}
+
+func TestRunDataIterations(t *testing.T) {
+	var mu sync.Mutex
+	paths := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"ok": %t}`, r.URL.Path != "/users/2")
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	dataPath := filepath.Join(dir, "rows.csv")
+	os.WriteFile(dataPath, []byte("id\n1\n2\n3\n"), 0o644)
+	os.Setenv("id", "from-env")
+	defer os.Unsetenv("id")
+
+	api := "GET " + server.URL + "/users/${id}\n---\nl2.test(\"ok\", () => expect(result.ok).toBe(true))\n"
+	o := &lama2cmd.Opts{Quiet: true, Data: dataPath}
+	code := controller.RunDataIterations(context.Background(), api, o, dir)
+	if code != utils.ExitAssertion {
+		t.Fatalf("Expected exit code %d with a failing iteration, got %d", utils.ExitAssertion, code)
+	}
+	if len(paths) != 3 || paths[0] != "/users/1" || paths[1] != "/users/2" || paths[2] != "/users/3" {
+		t.Fatalf("Expected one request per row, got %v", paths)
+	}
+}
+
+func TestIterationLabelTruncation(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	dataPath := filepath.Join(dir, "rows.csv")
+	// The label is cut within the run of multi-byte characters
+	os.WriteFile(dataPath, []byte("name\n"+strings.Repeat("é", 60)+"\n"), 0o644)
+
+	stdout := os.Stdout
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Stdout = w
+	o := &lama2cmd.Opts{Quiet: true, Data: dataPath}
+	code := controller.RunDataIterations(context.Background(), "GET "+server.URL+"\n", o, dir)
+	os.Stdout = stdout
+	w.Close()
+	out, _ := io.ReadAll(r)
+
+	if code != utils.ExitOK {
+		t.Fatalf("Expected exit code 0, got %d", code)
+	}
+	if !utf8.Valid(out) {
+		t.Fatalf("Expected the summary to be valid UTF-8, got %q", out)
+	}
+	label := "#1 name=" + strings.Repeat("é", 37) + "..."
+	if !strings.Contains(string(out), label+" ") {
+		t.Fatalf("Expected the summary to hold the label %q, got:\n%s", label, out)
+	}
+}
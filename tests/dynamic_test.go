@@ -0,0 +1,141 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	controller "github.com/HexmosTech/lama2/controller"
+	"github.com/HexmosTech/lama2/lama2cmd"
+	"github.com/HexmosTech/lama2/parser"
+	"github.com/HexmosTech/lama2/preprocess"
+	"github.com/HexmosTech/lama2/utils"
+)
+
+func TestDynamicVariables(t *testing.T) {
+	g := preprocess.NewGenerator()
+	patterns := map[string]string{
+		"uuid":             `^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`,
+		"uuidv7":           `^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`,
+		"isoTimestamp":     `^\d{4}-\d\d-\d\dT\d\d:\d\d:\d\dZ$`,
+		"randomString(8)":  `^[A-Za-z0-9]{8}$`,
+		"randomBoolean":    `^(true|false)$`,
+		"email":            `^[a-z]+\.[a-z]+\d+@example\.(com|org|net)$`,
+		"fullName":         `^[A-Z][a-z]+ [A-Z][a-z]+$`,
+		"zipCode":          `^\d{5}$`,
+		"randomInt(5, 5)":  `^5$`,
+		"randomInt(-3,-1)": `^-[123]$`,
+	}
+	for ref, pattern := range patterns {
+		val, err := g.Generate(ref)
+		if err != nil || !regexp.MustCompile(pattern).MatchString(val) {
+			t.Errorf("$%s: unexpected value %q, %v", ref, val, err)
+		}
+	}
+
+	hour, _ := g.Generate("timestamp(+1h)")
+	week, _ := g.Generate("timestamp(-7d)")
+	now := time.Now().Unix()
+	if h, _ := strconv.ParseInt(hour, 10, 64); h < now+3590 || h > now+3610 {
+		t.Errorf("Expected an hour from now, got %s", hour)
+	}
+	if w, _ := strconv.ParseInt(week, 10, 64); w < now-7*86400-10 || w > now-7*86400+10 {
+		t.Errorf("Expected a week ago, got %s", week)
+	}
+
+	for _, ref := range []string{"nope", "randomInt(a)", "randomInt(5,1)", "timestamp(soon)", "randomInt(1"} {
+		if _, err := g.Generate(ref); err == nil {
+			t.Errorf("$%s: expected an error", ref)
+		}
+	}
+
+	a, b := preprocess.NewSeededGenerator(7), preprocess.NewSeededGenerator(7)
+	for _, ref := range []string{"uuid", "email", "randomInt", "streetAddress"} {
+		va, _ := a.Generate(ref)
+		vb, _ := b.Generate(ref)
+		if va != vb {
+			t.Errorf("$%s: expected seeded generators to agree, got %q and %q", ref, va, vb)
+		}
+	}
+}
+
+func TestDynamicVariablesInRun(t *testing.T) {
+	var bodies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.Write(body)
+	}))
+	defer server.Close()
+
+	api := "POST " + server.URL + "\nIdempotency-Key: '${$uuid}'\n\n{\"email\": \"${$email}\", \"n\": \"${$randomInt(1, 100)}\"}\n\n---\n\n" +
+		"l2.test('js', () => {\n  expect(typeof l2.dynamic.randomInt(1, 6)).toBe('number')\n  expect(l2.dynamic.uuidv7().length).toBe(36)\n})\n"
+	run := func(seed string) {
+		parsed, err := parser.NewLama2Parser().Parse(api)
+		if err != nil {
+			t.Fatalf("Error on parsing: %v", err)
+		}
+		results, err := controller.RunParsedFileWithVars(context.Background(), parsed, &lama2cmd.Opts{Quiet: true, Seed: seed}, t.TempDir(), nil)
+		if err != nil || controller.TestsFailed(results) {
+			t.Fatalf("Unexpected failure: %v, %+v", err, results)
+		}
+	}
+	run("42")
+	run("42")
+	run("43")
+	if bodies[0] != bodies[1] || bodies[0] == bodies[2] {
+		t.Errorf("Expected the same seed to give the same values: %v", bodies)
+	}
+	var sent map[string]string
+	json.Unmarshal([]byte(bodies[0]), &sent)
+	if !strings.Contains(sent["email"], "@example.") || sent["n"] == "" {
+		t.Errorf("Unexpected body %s", bodies[0])
+	}
+
+	parsed, _ := parser.NewLama2Parser().Parse("GET " + server.URL + "/${$nope}\n")
+	_, err := controller.RunParsedFileWithVars(context.Background(), parsed, &lama2cmd.Opts{Quiet: true}, t.TempDir(), nil)
+	if utils.ExitCode(err) != utils.ExitVariable {
+		t.Errorf("Expected a variable error for an unknown dynamic variable, got %v", err)
+	}
+	if _, err := controller.RunParsedFileWithVars(context.Background(), parsed, &lama2cmd.Opts{Quiet: true, Seed: "x"}, t.TempDir(), nil); err == nil {
+		t.Errorf("Expected an error for an invalid seed")
+	}
+}
+
+func TestDynamicSeededTestMode(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.URL.Path)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	api := "GET " + server.URL + "/${$uuid}\n"
+	os.WriteFile(filepath.Join(dir, "a.l2"), []byte(api), 0o644)
+	os.WriteFile(filepath.Join(dir, "b.l2"), []byte(api), 0o644)
+	run := func() []string {
+		paths = nil
+		if code := controller.RunTestMode([]string{"test", "--seed", "7", "--tap", filepath.Join(dir, "report.tap"), dir}); code != 0 {
+			t.Fatalf("Expected exit code 0, got %d", code)
+		}
+		return paths
+	}
+	first := run()
+	// The files share one seeded sequence, so the values
+	// differ between files but not between runs
+	if len(first) != 2 || first[0] == first[1] {
+		t.Fatalf("Expected the second file to carry on the sequence, got %v", first)
+	}
+	if second := run(); strings.Join(second, ",") != strings.Join(first, ",") {
+		t.Errorf("Expected the same values on every run, got %v and %v", first, second)
+	}
+}
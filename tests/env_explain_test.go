@@ -0,0 +1,121 @@
+package tests
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	controller "github.com/HexmosTech/lama2/controller"
+	testutils "github.com/HexmosTech/lama2/tests/utils"
+)
+
+// explainTree adds an API file and a secret to namedEnvTree
+func explainTree(t *testing.T) string {
+	dir := namedEnvTree(t)
+	os.WriteFile(filepath.Join(dir, "l2.staging.env"), []byte("D=l2env-staging\nexport API_TOKEN=\"abcdefgh12345678\"\n"), 0o644)
+	api := "POST https://example.com/${A}/${B}\nAuthorization: 'Bearer ${API_TOKEN}'\n\n{\"c\": \"${C}\", \"d\": \"${D:-none}\", \"id\": \"${$uuid}\", \"x\": \"${EXPLAIN_UNSET}\"}\n\n---\n\nlet C = result.c\n"
+	os.WriteFile(filepath.Join(dir, "api.l2"), []byte(api), 0o644)
+	return filepath.Join(dir, "api.l2")
+}
+
+func TestEnvExplain(t *testing.T) {
+	fpath := explainTree(t)
+	exp, err := controller.ExplainVariables(fpath, "staging", "", false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	vars := make(map[string]controller.VarExplanation)
+	names := make([]string, 0)
+	for _, v := range exp.Variables {
+		vars[v.Name] = v
+		names = append(names, v.Name)
+	}
+	if got := strings.Join(names, " "); got != "A B API_TOKEN C D $uuid EXPLAIN_UNSET" {
+		t.Errorf("Unexpected variables: %s", got)
+	}
+
+	d := vars["D"]
+	if d.Value != "l2env-staging" || d.Source.Kind != "l2env:staging" || d.Source.Line != 1 || filepath.Base(d.Source.File) != "l2.staging.env" {
+		t.Errorf("Unexpected source of D: %+v", d.Source)
+	}
+	kinds := make([]string, 0)
+	for _, s := range d.Shadows {
+		kinds = append(kinds, s.Kind)
+	}
+	if got := strings.Join(kinds, " "); got != "l2env l2configenv:staging l2configenv" {
+		t.Errorf("Unexpected shadows of D: %s", got)
+	}
+	if b := vars["B"]; b.Value != "config-staging" || len(b.Shadows) != 1 || b.Shadows[0].Value != "config" {
+		t.Errorf("Unexpected explanation of B: %+v", b)
+	}
+	if c := vars["C"]; len(c.Processors) != 1 || c.Processors[0] != 2 || c.Uses[0].Field != "body" || c.Uses[0].Block != 1 {
+		t.Errorf("Expected C to be mentioned by processor block 2, got %+v", c)
+	}
+
+	token := vars["API_TOKEN"]
+	if !token.Masked || token.Value != "****5678" || token.Source.Line != 2 {
+		t.Errorf("Expected the token to be masked, got %+v", token)
+	}
+	if v := vars["$uuid"]; v.Source == nil || v.Source.Kind != "dynamic" {
+		t.Errorf("Expected $uuid to be dynamic, got %+v", v)
+	}
+	if v := vars["EXPLAIN_UNSET"]; v.Source != nil {
+		t.Errorf("Expected EXPLAIN_UNSET to be unset, got %+v", v.Source)
+	}
+
+	exp, _ = controller.ExplainVariables(fpath, "staging", "", true)
+	for _, v := range exp.Variables {
+		if v.Name == "API_TOKEN" && (v.Masked || v.Value != "abcdefgh12345678") {
+			t.Errorf("Expected --reveal to show the token, got %+v", v)
+		}
+	}
+}
+
+func TestEnvExplainCommand(t *testing.T) {
+	fpath := explainTree(t)
+	output, err := testutils.RunL2CommandAndGetOutput("env", "explain", "--env", "staging", "--json", fpath)
+	if err != nil {
+		t.Fatalf("Error running l2 env explain: %v\n%s", err, output)
+	}
+	var exp controller.Explanation
+	if err := json.Unmarshal([]byte(output), &exp); err != nil {
+		t.Fatalf("Couldn't parse the output: %v\n%s", err, output)
+	}
+	if exp.Env != "staging" || len(exp.Variables) != 7 || exp.Variables[0].Source.Kind != "l2configenv" {
+		t.Errorf("Unexpected explanation: %+v", exp)
+	}
+	if strings.Contains(output, "abcdefgh") {
+		t.Errorf("Expected the token to be masked:\n%s", output)
+	}
+}
+
+func TestEnvExplainBacktickCommand(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "l2.env"), []byte("SEGMENT=`echo users`\nSECRET_TOKEN=`echo abcdefgh12345678`\nBROKEN=`exit 1`\n"), 0o644)
+	fpath := filepath.Join(dir, "api.l2")
+	os.WriteFile(fpath, []byte("GET https://example.com/${SEGMENT}/${BROKEN}\nX-Token: '${SECRET_TOKEN}'\n"), 0o644)
+
+	exp, err := controller.ExplainVariables(fpath, "", "", false)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	vars := make(map[string]controller.VarExplanation)
+	for _, v := range exp.Variables {
+		vars[v.Name] = v
+	}
+	segment := vars["SEGMENT"]
+	if segment.Value != "users" || segment.Source.Command != "echo users" || segment.Source.Value != "users" {
+		t.Errorf("Expected the output of the command as the value of SEGMENT, got %+v", segment.Source)
+	}
+	if src := segment.Source.String(); !strings.HasSuffix(src, "l2.env:1 (`echo users`)") {
+		t.Errorf("Expected the command in the source of SEGMENT, got %s", src)
+	}
+	if token := vars["SECRET_TOKEN"]; !token.Masked || token.Value != "****5678" {
+		t.Errorf("Expected the output of the command to be masked, got %+v", token)
+	}
+	if broken := vars["BROKEN"]; broken.Source != nil {
+		t.Errorf("Expected a failing command to leave BROKEN unset, got %+v", broken.Source)
+	}
+}
@@ -0,0 +1,105 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	controller "github.com/HexmosTech/lama2/controller"
+	"github.com/HexmosTech/lama2/lama2cmd"
+	"github.com/HexmosTech/lama2/parser"
+	"github.com/HexmosTech/lama2/utils"
+)
+
+func runL2(t *testing.T, api string, o *lama2cmd.Opts, vars map[string]string) ([]controller.StageResult, error) {
+	parsed, err := parser.NewLama2Parser().Parse(api)
+	if err != nil {
+		t.Fatalf("Error on parsing: %v", err)
+	}
+	return controller.RunParsedFileWithVars(context.Background(), parsed, o, ".", vars)
+}
+
+func expectExecError(t *testing.T, err error, kind utils.ErrorKind, block int, line int) {
+	var execErr *utils.ExecError
+	if !errors.As(err, &execErr) {
+		t.Fatalf("Expected an ExecError, got %v", err)
+	}
+	if execErr.Kind != kind || execErr.Block != block || execErr.Line != line {
+		t.Fatalf("Expected a %s error in block %d, line %d; got %s", kind, block, line, err.Error())
+	}
+	if utils.ExitCode(err) != kind.ExitCode() {
+		t.Fatalf("Unexpected exit code %d for %s", utils.ExitCode(err), err.Error())
+	}
+}
+
+func TestExecErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"ok": true}`)
+	}))
+	defer server.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	o := &lama2cmd.Opts{Quiet: true}
+	_, err := runL2(t, "GET "+server.URL+"\n\n---\n\nnotDefined()\n", o, nil)
+	expectExecError(t, err, utils.KindScript, 2, 5)
+
+	_, err = runL2(t, "GET "+closed.URL+"\n", o, nil)
+	expectExecError(t, err, utils.KindTransport, 1, 1)
+
+	_, err = runL2(t, "POST "+server.URL+"\n\n{\"a\": ${N}}\n", o, map[string]string{"N": "1 2"})
+	expectExecError(t, err, utils.KindVariable, 1, 1)
+
+	if utils.ExitCode(utils.NewParseError(1, 1, "bad", []string{})) != utils.ExitParse {
+		t.Fatalf("Expected parse errors to exit with ExitParse")
+	}
+}
+
+func TestOutputWriteError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"ok": true}`)
+	}))
+	defer server.Close()
+
+	parsed, err := parser.NewLama2Parser().Parse("GET " + server.URL + "\n")
+	if err != nil {
+		t.Fatalf("Error on parsing: %v", err)
+	}
+	o := &lama2cmd.Opts{Quiet: true, Output: filepath.Join(t.TempDir(), "missing", "out.json")}
+	_, err = controller.HandleParsedFile(context.Background(), parsed, o, ".")
+	if err == nil || utils.ExitCode(err) != utils.ExitFailure {
+		t.Fatalf("Expected the output error to be returned, got %v", err)
+	}
+}
+
+func TestContinueOnError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"ok": true}`)
+	}))
+	defer server.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	api := "GET " + closed.URL + "\n\n---\n\nl2.test(\"no response\", () => expect(response.status).toBe(0))\n\n---\n\nGET " + server.URL + "\n"
+	results, err := runL2(t, api, &lama2cmd.Opts{Quiet: true}, nil)
+	expectExecError(t, err, utils.KindTransport, 1, 1)
+	if len(results) != 2 {
+		t.Fatalf("Expected the run to stop after the first stage, got %d results", len(results))
+	}
+
+	results, err = runL2(t, api, &lama2cmd.Opts{Quiet: true, ContinueOnError: true}, nil)
+	expectExecError(t, err, utils.KindTransport, 1, 1)
+	if len(results) != 3 || results[1].Err == nil || results[2].Err != nil || results[2].Response.StatusCode != 200 {
+		t.Fatalf("Expected the second stage to run after the first failed, got %+v", results)
+	}
+	if controller.TestsFailed(results) {
+		t.Fatalf("Expected a failed stage to leave an empty response behind")
+	}
+	if controller.RunExitCode(results, err) != utils.ExitTransport {
+		t.Fatalf("Expected the exit code of the first error")
+	}
+}
@@ -1,7 +1,9 @@
 package tests
 
 import (
+	"context"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/HexmosTech/gabs/v2"
@@ -21,14 +23,16 @@ func TestExec(t *testing.T) {
 	if e != nil {
 		t.Fatalf("Error on parsing")
 	}
-	controller.HandleParsedFile(res, opts, fdir)
+	controller.HandleParsedFile(context.Background(), res, opts, fdir)
 	// log.Debug().Strs("Generated command", r2).Msg("")
 	// r3, _ := cmdexec.ExecCommand(r2, body, apiDir)
 	// log.Debug().Str("Execution result", r3).Msg("")
 }
 
 func Test404(t *testing.T) {
-	fname := "404.json"
+	// Process exits before the test ends, so the output
+	// goes to a temporary directory rather than the tree
+	fname := filepath.Join(t.TempDir(), "404.json")
 	fpath := "../elfparser/ElfTestSuite/n_0003_404.l2"
 	// fdir := "../elfparser/ElfTestSuite/"
 	os.Args = []string{"l2", "-o", fname, fpath}
@@ -0,0 +1,134 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/HexmosTech/lama2/cmdexec"
+	controller "github.com/HexmosTech/lama2/controller"
+	"github.com/HexmosTech/lama2/lama2cmd"
+	"github.com/HexmosTech/lama2/parser"
+)
+
+// echoServer responds with a JSON document describing
+// the request it received
+func echoServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		echo := map[string]string{
+			"method":       r.Method,
+			"path":         r.URL.Path,
+			"content_type": r.Header.Get("Content-Type"),
+			"x_custom":     r.Header.Get("X-Custom"),
+			"body":         string(body),
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(echo)
+	}))
+}
+
+func executeFirstBlock(t *testing.T, l2Content string) map[string]string {
+	lp := parser.NewLama2Parser()
+	parsed, e := lp.Parse(l2Content)
+	if e != nil {
+		t.Fatalf("Error on parsing: %v", e)
+	}
+	block := controller.GetParsedAPIBlocks(parsed)[0]
+	executor := cmdexec.NewNativeExecutor(&lama2cmd.Opts{})
+	executor.Out = io.Discard
+	resp, err := executor.Execute(context.Background(), block, "../elfparser/ElfTestSuite")
+	if err != nil {
+		t.Fatalf("Native executor failed: %v", err)
+	}
+	echo := make(map[string]string)
+	if err := json.Unmarshal([]byte(resp.Body), &echo); err != nil {
+		t.Fatalf("Couldn't parse echo response: %v", err)
+	}
+	return echo
+}
+
+func TestNativeExecutorJSON(t *testing.T) {
+	server := echoServer()
+	defer server.Close()
+
+	echo := executeFirstBlock(t, "POST "+server.URL+"/post\nX-Custom: yes\n\n{\"a\": 1}\n")
+	if echo["method"] != "POST" {
+		t.Fatalf("Expected POST, got %s", echo["method"])
+	}
+	if echo["content_type"] != "application/json" {
+		t.Fatalf("Expected JSON content type, got %s", echo["content_type"])
+	}
+	if echo["x_custom"] != "yes" {
+		t.Fatalf("Expected custom header to be forwarded, got %s", echo["x_custom"])
+	}
+	if echo["body"] != `{"a":1}` {
+		t.Fatalf("Expected minified JSON body, got %s", echo["body"])
+	}
+}
+
+func TestNativeExecutorForm(t *testing.T) {
+	server := echoServer()
+	defer server.Close()
+
+	echo := executeFirstBlock(t, "POST\nFORM\n"+server.URL+"/form\n\nname=lama\n")
+	if !strings.HasPrefix(echo["content_type"], "application/x-www-form-urlencoded") {
+		t.Fatalf("Expected urlencoded content type, got %s", echo["content_type"])
+	}
+	if echo["body"] != "name=lama" {
+		t.Fatalf("Expected urlencoded body, got %s", echo["body"])
+	}
+}
+
+func TestNativeExecutorMultipart(t *testing.T) {
+	server := echoServer()
+	defer server.Close()
+
+	echo := executeFirstBlock(t, "POST\nMULTIPART\n"+server.URL+"/upload\n\nfirst=second\nimg@image.jpeg\n")
+	if !strings.HasPrefix(echo["content_type"], "multipart/form-data") {
+		t.Fatalf("Expected multipart content type, got %s", echo["content_type"])
+	}
+	if !strings.Contains(echo["body"], `name="img"; filename="image.jpeg"`) {
+		t.Fatalf("Expected file part in multipart body")
+	}
+	if !strings.Contains(echo["body"], `name="first"`) {
+		t.Fatalf("Expected field part in multipart body")
+	}
+}
+
+func TestHTTPieExecutorAbandoned(t *testing.T) {
+	var active, overlaps int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&active, 1) > 1 {
+			atomic.AddInt32(&overlaps, 1)
+		}
+		time.Sleep(100 * time.Millisecond)
+		atomic.AddInt32(&active, -1)
+	}))
+	defer server.Close()
+
+	parsed, err := parser.NewLama2Parser().Parse("GET " + server.URL + "\n")
+	if err != nil {
+		t.Fatalf("Error on parsing: %v", err)
+	}
+	block := controller.GetParsedAPIBlocks(parsed)[0]
+	executor := &cmdexec.HTTPieExecutor{Opts: &lama2cmd.Opts{}}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := executor.Execute(ctx, block, "."); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the deadline to abandon the request, got %v", err)
+	}
+	// The next request waits for the abandoned one
+	if _, err := executor.Execute(context.Background(), block, "."); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if overlaps != 0 {
+		t.Errorf("Expected the requests to be sent one at a time")
+	}
+}
@@ -0,0 +1,83 @@
+package tests
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	controller "github.com/HexmosTech/lama2/controller"
+	"github.com/HexmosTech/lama2/lama2cmd"
+	"github.com/HexmosTech/lama2/utils"
+)
+
+// pathRecorder answers `{"n": <page>, "next": <page+1>}`
+// for `/page/<page>` (up to page 3) and records the paths
+func pathRecorder() (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		paths = append(paths, r.URL.Path)
+		mu.Unlock()
+		var n int
+		if _, err := fmt.Sscanf(r.URL.Path, "/page/%d", &n); err == nil && n < 3 {
+			fmt.Fprintf(w, `{"n": %d, "next": %d}`, n, n+1)
+			return
+		}
+		fmt.Fprint(w, `{"valid": true}`)
+	}))
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), paths...)
+	}
+}
+
+func TestFlowSkipNextAndStop(t *testing.T) {
+	server, paths := pathRecorder()
+	defer server.Close()
+
+	api := "GET " + server.URL + "/token\n\n---\n\nif (result.valid) l2.skipNext()\n\n---\n\n" +
+		"GET " + server.URL + "/refresh\n\n---\n\nrefreshed = true\n\n---\n\n" +
+		"GET " + server.URL + "/query\n\n---\n\nl2.test(\"not refreshed\", () => expect(typeof refreshed).toBe(\"undefined\"))\n"
+	results, err := runL2(t, api, &lama2cmd.Opts{Quiet: true}, nil)
+	if err != nil || controller.TestsFailed(results) || len(results) != 4 || !results[2].Skipped {
+		t.Fatalf("Expected the refresh stage to be skipped, got %v, %+v", err, results)
+	}
+	if got := strings.Join(paths(), ","); got != "/token,/query" {
+		t.Fatalf("Unexpected requests %s", got)
+	}
+
+	api = "GET " + server.URL + "/error\n\n---\n\nl2.stop(\"error payload\")\n\n---\n\nGET " + server.URL + "/never\n"
+	results, err = runL2(t, api, &lama2cmd.Opts{Quiet: true}, nil)
+	if err != nil || len(results) != 2 {
+		t.Fatalf("Expected the run to stop cleanly after the first stage, got %v, %+v", err, results)
+	}
+}
+
+func TestFlowGoto(t *testing.T) {
+	server, paths := pathRecorder()
+	defer server.Close()
+
+	api := "let n = 1\n\n---\n\n@name page\nGET " + server.URL + "/page/${n}\n\n---\n\n" +
+		"if (result.next) { n = result.next; l2.goto(\"page\") }\n\n---\n\nGET " + server.URL + "/done\n"
+	results, err := runL2(t, api, &lama2cmd.Opts{Quiet: true}, nil)
+	if err != nil || len(results) != 5 {
+		t.Fatalf("Expected three pages and a final stage, got %v, %+v", err, results)
+	}
+	if got := strings.Join(paths(), ","); got != "/page/1,/page/2,/page/3,/done" {
+		t.Fatalf("Expected the stage to be expanded anew on every visit, got %s", got)
+	}
+
+	_, err = runL2(t, "@name loop\nGET "+server.URL+"/loop\n\n---\n\nl2.goto(\"loop\")\n", &lama2cmd.Opts{Quiet: true}, nil)
+	expectExecError(t, err, utils.KindScript, 2, 6)
+	if !strings.Contains(err.Error(), "more than 100 jumps") {
+		t.Fatalf("Expected the loop guard to stop the run, got %v", err)
+	}
+
+	_, err = runL2(t, "GET "+server.URL+"/x\n\n---\n\nl2.goto(\"nowhere\")\n", &lama2cmd.Opts{Quiet: true}, nil)
+	expectExecError(t, err, utils.KindScript, 2, 5)
+}
@@ -0,0 +1,92 @@
+package tests
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/HexmosTech/lama2/cmdexec"
+	controller "github.com/HexmosTech/lama2/controller"
+	"github.com/HexmosTech/lama2/lama2cmd"
+	"github.com/HexmosTech/lama2/parser"
+	"github.com/HexmosTech/lama2/utils"
+)
+
+// signingServer checks the X-Signature header against
+// the HMAC of the exact bytes received
+func signingServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("s3cret"))
+		mac.Write([]byte(r.Method + "\n" + r.URL.Path + "\n" + string(body)))
+		valid := hex.EncodeToString(mac.Sum(nil)) == r.Header.Get("X-Signature")
+		fmt.Fprintf(w, `{"method": %q, "path": %q, "body": %q, "valid": %t, "trace": %q}`, r.Method, r.URL.Path, body, valid, r.Header.Get("X-Trace"))
+	}))
+}
+
+const signingHook = `l2.beforeSend(function (req) {
+  var path = req.url.replace(/^https?:\/\/[^\/]+/, '')
+  req.headers['X-Signature'] = l2.crypto.hmac('sha256', 's3cret', req.method + '\n' + path + '\n' + (req.body || ''))
+})
+`
+
+func TestBeforeSend(t *testing.T) {
+	server := signingServer()
+	defer server.Close()
+
+	// The first hook rewrites the body; the second one signs
+	// the request as it will be sent
+	api := "l2.beforeSend(function (req) {\n  req.method = 'PUT'\n  req.url = req.url + '/v2'\n  req.body = req.body.replace('}', ', \"ts\":  42}')\n  delete req.headers['X-Drop']\n})\n" + signingHook +
+		"\n---\n\nPOST " + server.URL + "/items\nX-Drop: 'yes'\n\n{\"name\": \"${NAME}\"}\n"
+	parsed, err := parser.NewLama2Parser().Parse(api)
+	if err != nil {
+		t.Fatalf("Error on parsing: %v", err)
+	}
+	results, err := controller.RunParsedFileWithVars(context.Background(), parsed, &lama2cmd.Opts{Quiet: true}, t.TempDir(), map[string]string{"NAME": "lama"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := `{"method": "PUT", "path": "/items/v2", "body": "{\"name\":\"lama\", \"ts\":  42}", "valid": true, "trace": ""}`
+	resp := controller.LastResponse(results)
+	if resp.Body != want {
+		t.Errorf("Expected %s, got %s", want, resp.Body)
+	}
+	if resp.Request.Headers.Get("X-Drop") != "" {
+		t.Errorf("Expected X-Drop to be removed, got %v", resp.Request.Headers)
+	}
+}
+
+func TestHookFile(t *testing.T) {
+	server := signingServer()
+	defer server.Close()
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, cmdexec.HookFile), []byte(signingHook+"l2.beforeSend(function (req) { req.headers['X-Trace'] = 'from-file' })\n"), 0o644)
+
+	parsed, err := parser.NewLama2Parser().Parse("GET " + server.URL + "/ping\n")
+	if err != nil {
+		t.Fatalf("Error on parsing: %v", err)
+	}
+	results, err := controller.RunParsedFileWithVars(context.Background(), parsed, &lama2cmd.Opts{Quiet: true}, dir, nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if body := controller.LastResponse(results).Body; !strings.Contains(body, `"valid": true, "trace": "from-file"`) {
+		t.Errorf("Expected a signed request from the hook file, got %s", body)
+	}
+
+	os.WriteFile(filepath.Join(dir, cmdexec.HookFile), []byte("l2.beforeSend(function (req) { throw new Error('no key') })\n"), 0o644)
+	_, err = controller.RunParsedFileWithVars(context.Background(), parsed, &lama2cmd.Opts{Quiet: true}, dir, nil)
+	expectExecError(t, err, utils.KindScript, 1, 1)
+	if !strings.Contains(err.Error(), "l2.beforeSend: Error: no key") {
+		t.Errorf("Unexpected error: %v", err)
+	}
+}
@@ -2,6 +2,7 @@ package tests
 
 import (
 	"fmt"
+	"strconv"
 	"strings"
 	"testing"
 
@@ -36,4 +37,59 @@ func TestGenerateChainCode(t *testing.T) {
 	} else {
 		t.Fatalf("TestGenerateChain doesn't start with a try")
 	}
+
+	vm := cmdexec.GetJSVm()
+	if _, err := vm.RunString(cmdexec.GenerateChainCode("` + \"${injected}\" + `")); err != nil {
+		t.Fatalf("Expected the body to be quoted, got %v", err)
+	}
+	if got := vm.Get("result").String(); got != "` + \"${injected}\" + `" {
+		t.Fatalf("Expected the body to be stored verbatim, got %s", got)
+	}
+}
+
+func TestBindResult(t *testing.T) {
+	vm := cmdexec.GetJSVm()
+	cmdexec.BindResult(vm, "not json with a ` backtick and ${injected()}")
+	if got := vm.Get("result").String(); got != "not json with a ` backtick and ${injected()}" {
+		t.Fatalf("Expected the body to be stored verbatim, got %s", got)
+	}
+
+	cmdexec.BindResult(vm, `{"code": "${x}", "n": 2}`)
+	val, err := vm.RunString("result.code + result.n")
+	if err != nil || val.String() != "${x}2" {
+		t.Fatalf("Expected a JSON object, got %v (%v)", val, err)
+	}
+
+	// The value matches the one of JSON.parse, key order included
+	body := `{"z": [1, {"b": null, "a": true}], "__proto__": {"polluted": 1}, "y": 1.5}`
+	cmdexec.BindResult(vm, body)
+	val, err = vm.RunString("JSON.stringify(result) === JSON.stringify(JSON.parse(" + strconv.Quote(body) + ")) && Array.isArray(result.z) && result.polluted === undefined")
+	if err != nil || !val.ToBoolean() {
+		t.Fatalf("Expected the value of JSON.parse, got %v (%v)", vm.Get("result"), err)
+	}
+	cmdexec.BindResult(vm, `{} trailing`)
+	if got := vm.Get("result").String(); got != "{} trailing" {
+		t.Fatalf("Expected a body with trailing text to be stored as a string, got %s", got)
+	}
+}
+
+func TestBindResultLazy(t *testing.T) {
+	vm := cmdexec.GetJSVm()
+	large := `{"items": ["` + strings.Repeat("x", cmdexec.LazyResultThreshold) + `"], "total": 1}`
+	cmdexec.BindResult(vm, large)
+	val, err := vm.RunString("result.total")
+	if err != nil || val.ToInteger() != 1 {
+		t.Fatalf("Expected the lazy result to parse on access, got %v (%v)", val, err)
+	}
+	if _, err := vm.RunString("result = 5"); err != nil {
+		t.Fatalf("Expected the lazy result to be assignable: %v", err)
+	}
+	if val, _ := vm.RunString("result"); val.ToInteger() != 5 {
+		t.Fatalf("Expected the assigned value, got %v", val)
+	}
+
+	cmdexec.BindResult(vm, `[1, 2, 3]`)
+	if val, _ := vm.RunString("result.length"); val.ToInteger() != 3 {
+		t.Fatalf("Expected a small body to replace the lazy result, got %v", val)
+	}
 }
@@ -0,0 +1,87 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	controller "github.com/HexmosTech/lama2/controller"
+	"github.com/HexmosTech/lama2/lama2cmd"
+	"github.com/HexmosTech/lama2/parser"
+	"github.com/HexmosTech/lama2/utils"
+)
+
+func TestTypedJSONInterpolation(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(w, r.Body)
+	}))
+	defer server.Close()
+
+	api := "GET " + server.URL + "\n\n---\n\n" +
+		"var COUNT = 42\nvar FLAG = false\nvar TAGS = ['a', 'b']\nvar USER = {name: 'lama', id: 7}\nvar QUOTE = 'say \"hi\"\\nbye'\n\n---\n\n" +
+		"POST " + server.URL + "\n\n{\"$Object\": \"$JSON\", \"count\": ${COUNT}, \"flag\": ${FLAG}, \"tags\": ${TAGS}, \"user\": ${USER}, \"quote\": \"${QUOTE}\", \"label\": \"n=${COUNT}\", \"env\": [${ENV_NUM}, \"${ENV_TEXT}\"]}\n"
+	parsed, err := parser.NewLama2Parser().Parse(api)
+	if err != nil {
+		t.Fatalf("Error on parsing: %v", err)
+	}
+	vars := map[string]string{"ENV_NUM": "12.50", "ENV_TEXT": "plain text"}
+	results, err := controller.RunParsedFileWithVars(context.Background(), parsed, &lama2cmd.Opts{Quiet: true}, t.TempDir(), vars)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := `{"$Object":"$JSON","count":42,"env":[12.50,"plain text"],"flag":false,"label":"n=42","quote":"say \"hi\"\nbye","tags":["a","b"],"user":{"id":7,"name":"lama"}}`
+	if body := controller.LastResponse(results).Body; body != want {
+		t.Errorf("Expected %s, got %s", want, body)
+	}
+}
+
+func TestTypedJSONInterpolationError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	api := "GET " + server.URL + "\n\n---\n\nvar HANDLER = function() {}\n\n---\n\nPOST " + server.URL + "\n\n{\"items\": [1, {\"run\": ${HANDLER}}]}\n"
+	parsed, err := parser.NewLama2Parser().Parse(api)
+	if err != nil {
+		t.Fatalf("Error on parsing: %v", err)
+	}
+	_, err = controller.RunParsedFileWithVars(context.Background(), parsed, &lama2cmd.Opts{Quiet: true}, t.TempDir(), nil)
+	var execErr *utils.ExecError
+	if !errors.As(err, &execErr) || execErr.Kind != utils.KindVariable || execErr.Block != 3 || execErr.Line != 9 {
+		t.Fatalf("Expected a variable error at block 3, line 9, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "body.items[1].run: `HANDLER` can't be converted to JSON") {
+		t.Errorf("Expected the error to name the place in the body, got %v", err)
+	}
+
+	// An undefined unquoted variable isn't sent as null
+	parsed, err = parser.NewLama2Parser().Parse("POST " + server.URL + "\n\n{\"user\": {\"id\": ${NOT_SET_ANYWHERE}}}\n")
+	if err != nil {
+		t.Fatalf("Error on parsing: %v", err)
+	}
+	_, err = controller.RunParsedFileWithVars(context.Background(), parsed, &lama2cmd.Opts{Quiet: true}, t.TempDir(), nil)
+	if !errors.As(err, &execErr) || execErr.Kind != utils.KindVariable {
+		t.Fatalf("Expected a variable error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "body.user.id: `NOT_SET_ANYWHERE` is undefined") {
+		t.Errorf("Expected the error to name the place in the body, got %v", err)
+	}
+
+	// Keys expanding to the same key don't overwrite each other
+	parsed, err = parser.NewLama2Parser().Parse("POST " + server.URL + "\n\n{\"user\": {\"${FIELD}\": 1, \"name\": 2}}\n")
+	if err != nil {
+		t.Fatalf("Error on parsing: %v", err)
+	}
+	_, err = controller.RunParsedFileWithVars(context.Background(), parsed, &lama2cmd.Opts{Quiet: true}, t.TempDir(), map[string]string{"FIELD": "name"})
+	if !errors.As(err, &execErr) || execErr.Kind != utils.KindVariable {
+		t.Fatalf("Expected a variable error, got %v", err)
+	}
+	if !strings.Contains(err.Error(), `the key expands to "name", which is already a key of body.user`) {
+		t.Errorf("Expected the error to name the duplicate key, got %v", err)
+	}
+}
@@ -0,0 +1,123 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/HexmosTech/lama2/cmdexec"
+	"github.com/HexmosTech/lama2/lama2"
+	"github.com/HexmosTech/lama2/utils"
+)
+
+func TestLibraryRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"user": "%s", "env": "%s"}`, r.URL.Query().Get("user"), r.Header.Get("X-Env"))
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "l2.env"), []byte("export ENVNAME=staging\nexport WHO=`echo from-env`\n"), 0o644)
+	api := "@name whoami\nGET " + server.URL + "/?user=${WHO}\nX-Env: '${ENVNAME}'\n\n---\n\nconsole.log('user', result.user)\nl2.test('env header', () => expect(result.env).toBe('staging'))\n"
+	fpath := filepath.Join(dir, "whoami.l2")
+	os.WriteFile(fpath, []byte(api), 0o644)
+
+	cwd, _ := os.Getwd()
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			opts := lama2.Options{}
+			want := "from-env"
+			if i%2 == 0 {
+				want = fmt.Sprintf("user%d", i)
+				opts.Vars = map[string]string{"WHO": want}
+			}
+			res, err := lama2.Run(context.Background(), fpath, opts)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if len(res.Stages) != 2 || res.TestsFailed() {
+				errs <- fmt.Errorf("unexpected stages: %+v", res.Stages)
+				return
+			}
+			stage := res.Stages[1]
+			if stage.Name != "whoami" || stage.Response.Status != 200 || stage.Request.Headers.Get("X-Env") != "staging" {
+				errs <- fmt.Errorf("unexpected stage: %+v", stage)
+				return
+			}
+			if len(stage.Logs) != 1 || stage.Logs[0] != "user "+want {
+				errs <- fmt.Errorf("expected the log of %s, got %v", want, stage.Logs)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+	if _, ok := os.LookupEnv("ENVNAME"); ok {
+		t.Errorf("Expected the process environment to be left alone")
+	}
+	if now, _ := os.Getwd(); now != cwd {
+		t.Errorf("Expected the working directory to be left alone")
+	}
+}
+
+func TestLibraryErrors(t *testing.T) {
+	_, err := lama2.RunString(context.Background(), "NOTAVERB http://localhost\n", lama2.Options{})
+	var execErr *utils.ExecError
+	if !errors.As(err, &execErr) || execErr.Kind != utils.KindParse {
+		t.Fatalf("Expected a parse error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = lama2.RunString(ctx, "GET http://localhost\n", lama2.Options{})
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the context error, got %v", err)
+	}
+}
+
+func TestLibraryHookFile(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"trace": %q}`, r.Header.Get("X-Trace"))
+	}))
+	defer server.Close()
+	hook := []byte("l2.beforeSend(function (req) { req.headers['X-Trace'] = 'hooked' })\n")
+	api := "GET " + server.URL + "\n"
+
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, cmdexec.HookFile), hook, 0o644)
+	// Without a Dir, the hook file of the working directory is ignored
+	os.WriteFile(cmdexec.HookFile, hook, 0o644)
+	defer os.Remove(cmdexec.HookFile)
+
+	cases := []struct {
+		opts lama2.Options
+		want string
+	}{
+		{lama2.Options{Dir: dir}, `{"trace": "hooked"}`},
+		{lama2.Options{Dir: dir, SkipHookFile: true}, `{"trace": ""}`},
+		{lama2.Options{}, `{"trace": ""}`},
+	}
+	for _, c := range cases {
+		res, err := lama2.RunString(context.Background(), api, c.opts)
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if body := res.Stages[len(res.Stages)-1].Response.Body; body != c.want {
+			t.Errorf("%+v: expected %s, got %s", c.opts, c.want, body)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	controller "github.com/HexmosTech/lama2/controller"
+	"github.com/HexmosTech/lama2/lama2"
+	"github.com/HexmosTech/lama2/preprocess"
+	testutils "github.com/HexmosTech/lama2/tests/utils"
+)
+
+// namedEnvTree creates a project with an `api` directory
+// and env files at both levels for the `staging` environment
+func namedEnvTree(t *testing.T) string {
+	root := t.TempDir()
+	dir := filepath.Join(root, "api")
+	os.MkdirAll(dir, 0o755)
+	files := map[string]string{
+		filepath.Join(root, "l2config.env"):         "A=config\nB=config\nC=config\nD=config\n",
+		filepath.Join(root, "l2config.staging.env"): "B=config-staging\nC=config-staging\nD=config-staging\n",
+		filepath.Join(dir, "l2.env"):                "C=l2env\nD=l2env\n",
+		filepath.Join(dir, "l2.staging.env"):        "D=l2env-staging\n",
+	}
+	for path, content := range files {
+		os.WriteFile(path, []byte(content), 0o644)
+	}
+	return dir
+}
+
+func TestNamedEnvPrecedence(t *testing.T) {
+	dir := namedEnvTree(t)
+
+	envMap, err := preprocess.GetL2EnvVariables(dir, "staging")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := map[string][2]string{
+		"A": {"config", "l2configenv"},
+		"B": {"config-staging", "l2configenv:staging"},
+		"C": {"l2env", "l2env"},
+		"D": {"l2env-staging", "l2env:staging"},
+	}
+	for key, w := range want {
+		if envMap[key]["val"] != w[0] || envMap[key]["src"] != w[1] {
+			t.Errorf("%s: expected %v, got %v", key, w, envMap[key])
+		}
+	}
+
+	envMap, _ = preprocess.GetL2EnvVariables(dir, "")
+	if envMap["B"]["val"] != "config" || envMap["D"]["val"] != "l2env" {
+		t.Errorf("Expected the staging files to be ignored without --env, got %v", envMap)
+	}
+
+	vars, err := preprocess.ReadEnvironments(dir, "staging")
+	if err != nil || vars["B"] != "config-staging" || vars["D"] != "l2env-staging" {
+		t.Errorf("Unexpected variables: %v, %v", vars, err)
+	}
+
+	if _, err := preprocess.EnvFiles(dir, "prod"); err == nil {
+		t.Errorf("Expected an error for an environment without files")
+	}
+	if _, err := preprocess.EnvFiles(dir, "../staging"); err == nil {
+		t.Errorf("Expected an error for an invalid environment name")
+	}
+
+	t.Setenv("L2_ENV", "staging")
+	if preprocess.EnvName("") != "staging" || preprocess.EnvName("prod") != "prod" {
+		t.Errorf("Expected --env to take precedence over L2_ENV")
+	}
+}
+
+func TestNamedEnvRun(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"tier": %q}`, r.URL.Query().Get("tier"))
+	}))
+	defer server.Close()
+
+	dir := namedEnvTree(t)
+	fpath := filepath.Join(dir, "tier.l2")
+	os.WriteFile(fpath, []byte("GET "+server.URL+"/?tier=${D}\n"), 0o644)
+
+	for env, want := range map[string]string{"": "l2env", "staging": "l2env-staging"} {
+		res, err := lama2.Run(context.Background(), fpath, lama2.Options{Env: env})
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if body := res.Stages[len(res.Stages)-1].Response.Body; body != fmt.Sprintf(`{"tier": %q}`, want) {
+			t.Errorf("env %q: unexpected body %s", env, body)
+		}
+	}
+	if _, err := lama2.Run(context.Background(), fpath, lama2.Options{Env: "prod"}); err == nil {
+		t.Errorf("Expected an error for an unknown environment")
+	}
+}
+
+func TestNamedEnvLSP(t *testing.T) {
+	stdin, stdout, err := startLSPServer()
+	if err != nil {
+		t.Fatalf("Failed to start LSP server: %v", err)
+	}
+	defer stdin.Close()
+	fpath := filepath.Join(namedEnvTree(t), "tier.l2")
+
+	req := fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"method":"suggest/environmentVariables","params":{"textDocument":{"uri":"file://%s"},"searchQuery":"","env":"staging"}}`, fpath)
+	if _, err := stdin.Write([]byte(req + "\n")); err != nil {
+		t.Fatalf("Failed to write to LSP server stdin: %v", err)
+	}
+	buffer := make([]byte, 2048)
+	n, err := stdout.Read(buffer)
+	if err != nil {
+		t.Fatalf("Failed to read from LSP server stdout: %v", err)
+	}
+	var rawResponse RawJSONRPCResponse
+	if err := json.Unmarshal(buffer[:n], &rawResponse); err != nil {
+		t.Fatalf("Failed to unmarshal LSP raw response: %v", err)
+	}
+	var envMap map[string]testutils.EnvData
+	if err := json.Unmarshal(rawResponse.Result, &envMap); err != nil {
+		t.Fatalf("Failed to unmarshal LSP response result: %v", err)
+	}
+	if envMap["D"].Val != "l2env-staging" || envMap["D"].Src != "l2env:staging" || envMap["B"].Src != "l2configenv:staging" {
+		t.Errorf("Unexpected suggestions: %v", envMap)
+	}
+}
+
+func TestFailingBacktickCommand(t *testing.T) {
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "l2.env"), []byte("FAILED_CMD=`exit 1`\nGOOD_CMD=`echo hi`\n"), 0o644)
+
+	vars, err := preprocess.ReadEnvironments(dir, "")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if _, ok := vars["FAILED_CMD"]; ok || vars["GOOD_CMD"] != "hi" {
+		t.Errorf("Expected a failing command to leave its variable unset, got %v", vars)
+	}
+
+	restore := controller.IsolateEnvironment()
+	defer restore()
+	if err := preprocess.LoadEnvironments(dir, ""); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if val, ok := os.LookupEnv("FAILED_CMD"); ok || os.Getenv("GOOD_CMD") != "hi" {
+		t.Errorf("Expected LoadEnvironments to leave FAILED_CMD unset too, got %q", val)
+	}
+}
@@ -0,0 +1,45 @@
+package tests
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	controller "github.com/HexmosTech/lama2/controller"
+	"github.com/HexmosTech/lama2/lama2cmd"
+	"github.com/HexmosTech/lama2/utils"
+)
+
+func TestPollUntil(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		state := "running"
+		if atomic.AddInt32(&calls, 1) >= 3 {
+			state = "done"
+		}
+		fmt.Fprintf(w, `{"state": "%s"}`, state)
+	}))
+	defer server.Close()
+
+	api := "@poll-until response.json().state === \"done\"\n@poll-interval 10ms\nGET " + server.URL + "\n\n---\n\n" +
+		"l2.test(\"done\", () => { expect(result.state).toBe(\"done\"); expect(history).toHaveLength(1) })\n"
+	results, err := runL2(t, api, &lama2cmd.Opts{Quiet: true}, nil)
+	if err != nil || controller.TestsFailed(results) || atomic.LoadInt32(&calls) != 3 {
+		t.Fatalf("Expected polling to stop once done after 3 requests, got %d requests (%v, %+v)", calls, err, results)
+	}
+
+	_, err = runL2(t, "@poll-until false\n@poll-interval 20ms\n@poll-timeout 50ms\nGET "+server.URL+"\n", &lama2cmd.Opts{Quiet: true}, nil)
+	expectExecError(t, err, utils.KindTransport, 1, 1)
+	if !strings.Contains(err.Error(), "polling timed out after 50ms") {
+		t.Fatalf("Expected a polling timeout, got %v", err)
+	}
+
+	_, err = runL2(t, "@poll-until notDefined()\nGET "+server.URL+"\n", &lama2cmd.Opts{Quiet: true}, nil)
+	expectExecError(t, err, utils.KindScript, 1, 1)
+
+	_, err = runL2(t, "@poll-interval 1s\nGET "+server.URL+"\n", &lama2cmd.Opts{Quiet: true}, nil)
+	expectExecError(t, err, utils.KindParse, 1, 1)
+}
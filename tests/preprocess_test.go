@@ -1,9 +1,20 @@
 package tests
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
 	"testing"
 
+	"github.com/HexmosTech/lama2/cmdexec"
+	controller "github.com/HexmosTech/lama2/controller"
+	"github.com/HexmosTech/lama2/lama2cmd"
+	"github.com/HexmosTech/lama2/parser"
 	"github.com/HexmosTech/lama2/preprocess"
+	"github.com/HexmosTech/lama2/utils"
 	"github.com/rs/zerolog/log"
 )
 
@@ -11,3 +22,73 @@ func TestPreprocessBasic(_ *testing.T) {
 	op, _ := preprocess.LamaFile("../elfparser/ElfTestSuite/env1/sample.l2")
 	log.Debug().Str("Preprocessed string", op).Msg("")
 }
+
+func TestExpandModifiers(t *testing.T) {
+	vm := cmdexec.GetJSVm()
+	cmdexec.RunVMCode("let JSVAR = 'js'", vm)
+	vars := map[string]string{"HOST": "example.com", "EMPTY": "", "PORT": "8080"}
+	cases := []struct{ in, want string }{
+		{"https://$HOST:$PORT/", "https://example.com:8080/"},
+		{"${HOST}/$JSVAR", "example.com/js"},
+		{"${NOPE:-localhost}", "localhost"},
+		{"${EMPTY:-fallback}", "fallback"},
+		{"${HOST:-fallback}", "example.com"},
+		{"${NOPE:-${HOST}:${PORT}}", "example.com:8080"},
+		{"a${PORT:+:$PORT}b", "a:8080b"},
+		{"a${NOPE:+:$PORT}b", "ab"},
+		{"${HOST:?needs a host}", "example.com"},
+		{"price: $$5, $$HOST", "price: $5, $HOST"},
+		{`{"$gt": 1, "x": "$NOPE"}`, `{"$gt": 1, "x": "$NOPE"}`},
+		{`{"$Object": {"$JSON": "$Math $undefined $console"}}`, `{"$Object": {"$JSON": "$Math $undefined $console"}}`},
+		{"${NOPE}-$", "-$"},
+	}
+	for _, c := range cases {
+		got, err := preprocess.Expand(c.in, vm, vars)
+		if err != nil || got != c.want {
+			t.Errorf("Expand(%q) = %q, %v; expected %q", c.in, got, err, c.want)
+		}
+	}
+
+	if _, err := preprocess.Expand("Bearer ${TOKEN:?log in first}", vm, vars); err == nil || err.Error() != "TOKEN: log in first" {
+		t.Errorf("Expected the ${TOKEN:?} message, got %v", err)
+	}
+	if _, err := preprocess.Expand("${EMPTY:?}", vm, vars); err == nil || err.Error() != "EMPTY: parameter null or not set" {
+		t.Errorf("Expected the default ${EMPTY:?} message, got %v", err)
+	}
+
+	got := preprocess.Unresolved("${A} ${B:-$C} ${B:-${D}} ${E:+${F}} ${G:?} $H ${HOST}", vm, vars)
+	if strings.Join(got, ",") != "A,C,D,G,H" {
+		t.Errorf("Unexpected unresolved variables: %v", got)
+	}
+}
+
+func TestExpandModifiersInRequest(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, `{"path": %q, "auth": %q, "body": %s}`, r.URL.Path, r.Header.Get("Authorization"), body)
+	}))
+	defer server.Close()
+
+	api := "POST " + server.URL + "/${VERSION:-v1}/users\nAuthorization: '${TOKEN:+Bearer $TOKEN}'\n\n{\"name\": \"${NAME:-anonymous}\", \"cost\": \"$$5\"}\n"
+	parsed, err := parser.NewLama2Parser().Parse(api)
+	if err != nil {
+		t.Fatalf("Error on parsing: %v", err)
+	}
+	results, err := controller.RunParsedFileWithVars(context.Background(), parsed, &lama2cmd.Opts{Quiet: true}, t.TempDir(), map[string]string{"TOKEN": "t0k3n"})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := `{"path": "/v1/users", "auth": "Bearer t0k3n", "body": {"cost":"$5","name":"anonymous"}}`
+	if body := controller.LastResponse(results).Body; body != want {
+		t.Errorf("Expected %s, got %s", want, body)
+	}
+
+	parsed, err = parser.NewLama2Parser().Parse("GET " + server.URL + "/users/${ID}\nX-Trace: '${ID:?pass an ID with --data}'\n")
+	if err != nil {
+		t.Fatalf("Error on parsing: %v", err)
+	}
+	_, err = controller.RunParsedFileWithVars(context.Background(), parsed, &lama2cmd.Opts{Quiet: true}, t.TempDir(), nil)
+	if utils.ExitCode(err) != utils.ExitVariable || !strings.Contains(err.Error(), "ID: pass an ID with --data") {
+		t.Errorf("Expected a variable error, got %v", err)
+	}
+}
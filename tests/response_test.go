@@ -0,0 +1,160 @@
+package tests
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/HexmosTech/lama2/cmdexec"
+	controller "github.com/HexmosTech/lama2/controller"
+	"github.com/HexmosTech/lama2/lama2cmd"
+	"github.com/HexmosTech/lama2/parser"
+)
+
+func TestResponseObjectAndHistory(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc"})
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Request-Id", "req-"+r.URL.Path[1:])
+		if r.URL.Path == "/missing" {
+			w.WriteHeader(http.StatusNotFound)
+		}
+		fmt.Fprintf(w, `{"path": "%s", "z": 1, "a": 2}`, r.URL.Path)
+	}))
+	defer server.Close()
+
+	api := `@name login
+POST
+` + server.URL + `/login
+X-Token: t1
+
+{"user": "me"}
+
+---
+
+l2.test("status and headers", () => {
+  expect(response.status).toBe(200)
+  expect(response.statusText).toBe("OK")
+  expect(response.headers["x-request-id"]).toBe("req-login")
+  expect(response.headers["X-REQUEST-ID"]).toBe("req-login")
+  expect(response.headers["x-missing"]).toBeUndefined()
+  expect(response.cookies.session).toBe("abc")
+  expect(response.json().path).toBe("/login")
+  expect(Object.keys(response.json()).join()).toBe("path,z,a")
+  expect(JSON.stringify(response.json())).toBe(JSON.stringify(result))
+  expect(response.elapsed).toBeGreaterThanOrEqual(0)
+})
+
+l2.test("request that was sent", () => {
+  expect(response.request.method).toBe("POST")
+  expect(response.request.headers["x-token"]).toBe("t1")
+  expect(JSON.parse(response.request.body).user).toBe("me")
+})
+
+---
+
+GET
+` + server.URL + `/missing
+
+---
+
+l2.test("history keeps earlier responses", () => {
+  expect(response.status).toBe(404)
+  expect(response.statusText).toBe("Not Found")
+  expect(history).toHaveLength(2)
+  expect(history[0].name).toBe("login")
+  expect(history[0].json().path).toBe("/login")
+  expect(history[1].stage).toBe(2)
+})
+`
+	parsed, err := parser.NewLama2Parser().Parse(api)
+	if err != nil {
+		t.Fatalf("Error on parsing: %v", err)
+	}
+	results, err := controller.RunParsedFile(parsed, &lama2cmd.Opts{Quiet: true}, ".")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	tests := 0
+	for _, r := range results {
+		for _, tr := range r.Tests {
+			tests++
+			if !tr.Passed {
+				t.Errorf("%s failed: %s", tr.Name, tr.Error)
+			}
+		}
+	}
+	if tests != 3 {
+		t.Fatalf("Expected 3 tests, got %d", tests)
+	}
+}
+
+func TestRepeatedResponseHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "a", Value: "1"})
+		http.SetCookie(w, &http.Cookie{Name: "b", Value: "2"})
+		w.Header().Add("X-Multi", "one")
+		w.Header().Add("X-Multi", "two")
+		fmt.Fprint(w, "ok")
+	}))
+	defer server.Close()
+
+	api := "GET " + server.URL + `
+
+---
+
+l2.test("repeated headers", () => {
+  expect(response.headers["x-multi"]).toBe("one, two")
+  expect(response.headers["set-cookie"]).toHaveLength(2)
+  expect(response.headers["set-cookie"][1]).toBe("b=2")
+  expect(response.cookies.a).toBe("1")
+  expect(response.cookies.b).toBe("2")
+})
+`
+	parsed, err := parser.NewLama2Parser().Parse(api)
+	if err != nil {
+		t.Fatalf("Error on parsing: %v", err)
+	}
+	out := filepath.Join(t.TempDir(), "out.json")
+	o := &lama2cmd.Opts{Quiet: true, Output: out}
+	results, err := controller.HandleParsedFile(context.Background(), parsed, o, ".")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	for _, r := range results {
+		for _, tr := range r.Tests {
+			if !tr.Passed {
+				t.Errorf("%s failed: %s", tr.Name, tr.Error)
+			}
+		}
+	}
+
+	// A response known only by its flattened headers, such
+	// as a persisted one, keeps both cookies
+	replayed := cmdexec.NewResponse(controller.LastResponse(results).ExResponse)
+	if len(replayed.Cookies) != 2 || replayed.Header.Get("X-Multi") != "one, two" {
+		t.Errorf("Expected the flattened headers to keep every value, got %v", replayed.Header)
+	}
+
+	b, err := os.ReadFile(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var written struct {
+		Headers string `json:"headers"`
+	}
+	if err := json.Unmarshal(b, &written); err != nil {
+		t.Fatalf("Couldn't parse the output: %v", err)
+	}
+	for _, line := range []string{"Set-Cookie: a=1\n", "Set-Cookie: b=2\n", "X-Multi: one, two\n"} {
+		if !strings.Contains(written.Headers, line) {
+			t.Errorf("Expected %q in the output headers, got %q", line, written.Headers)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/HexmosTech/lama2/cmdexec"
+	controller "github.com/HexmosTech/lama2/controller"
+	"github.com/HexmosTech/lama2/lama2cmd"
+	"github.com/HexmosTech/lama2/parser"
+	"github.com/HexmosTech/lama2/utils"
+)
+
+// flakyServer answers 503 to the first `failures` requests
+func flakyServer(failures int32) (*httptest.Server, *int32) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"ok": true}`)
+	}))
+	return server, &calls
+}
+
+func TestRetry(t *testing.T) {
+	server, calls := flakyServer(2)
+	defer server.Close()
+
+	api := "@retry 3\n@retry-backoff 1ms\nGET " + server.URL + "\n"
+	results, err := runL2(t, api, &lama2cmd.Opts{Quiet: true}, nil)
+	if err != nil || results[1].Response.StatusCode != 200 {
+		t.Fatalf("Expected the request to succeed on the third attempt, got %v", err)
+	}
+	attempts := results[1].Response.Attempts
+	if len(attempts) != 3 || attempts[0].Status != 503 || attempts[1].Delay == 0 || attempts[2].Status != 200 || attempts[2].Delay != 0 {
+		t.Fatalf("Unexpected attempts %+v", attempts)
+	}
+
+	atomic.StoreInt32(calls, 0)
+	results, _ = runL2(t, "GET "+server.URL+"\n", &lama2cmd.Opts{Quiet: true}, nil)
+	if results[1].Response.StatusCode != 503 || len(results[1].Response.Attempts) != 1 {
+		t.Fatalf("Expected no retries by default, got %+v", results[1].Response.Attempts)
+	}
+
+	atomic.StoreInt32(calls, 0)
+	global := map[string]string{"L2_RETRY": "2", "L2_RETRY_BACKOFF": "1ms", "L2_RETRY_ON": "502"}
+	results, _ = runL2(t, "GET "+server.URL+"\n", &lama2cmd.Opts{Quiet: true}, global)
+	if len(results[1].Response.Attempts) != 1 {
+		t.Fatalf("Expected 503 not to be retried with L2_RETRY_ON=502, got %+v", results[1].Response.Attempts)
+	}
+	results, _ = runL2(t, "@retry-on 503\nGET "+server.URL+"\n", &lama2cmd.Opts{Quiet: true}, global)
+	if len(results[1].Response.Attempts) != 2 || results[1].Response.StatusCode != 200 {
+		t.Fatalf("Expected @retry-on to override L2_RETRY_ON, got %+v", results[1].Response.Attempts)
+	}
+
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+	results, err = runL2(t, "GET "+closed.URL+"\n", &lama2cmd.Opts{Quiet: true}, global)
+	expectExecError(t, err, utils.KindTransport, 1, 1)
+	if len(results[1].Response.Attempts) != 1 {
+		t.Fatalf("Expected network errors not to be retried without `network`, got %+v", results[1].Response.Attempts)
+	}
+	results, err = runL2(t, "@retry-on network\nGET "+closed.URL+"\n", &lama2cmd.Opts{Quiet: true}, global)
+	expectExecError(t, err, utils.KindTransport, 1, 1)
+	if len(results[1].Response.Attempts) != 2 {
+		t.Fatalf("Expected the network error to be retried, got %+v", results[1].Response.Attempts)
+	}
+	results, err = runL2(t, "@retry-on network\nGET "+closed.URL+"\n", &lama2cmd.Opts{Quiet: true, Executor: "httpie"}, global)
+	expectExecError(t, err, utils.KindTransport, 1, 1)
+	if len(results[1].Response.Attempts) != 2 {
+		t.Fatalf("Expected the network error of HTTPie to be retried, got %+v", results[1].Response.Attempts)
+	}
+
+	_, err = runL2(t, "@retry often\nGET "+server.URL+"\n", &lama2cmd.Opts{Quiet: true}, nil)
+	expectExecError(t, err, utils.KindParse, 1, 1)
+}
+
+func TestRetryDelay(t *testing.T) {
+	policy := controller.DefaultRetryPolicy()
+	policy.Backoff = 100 * time.Millisecond
+	policy.MaxBackoff = time.Second
+	if d := policy.Delay(3, cmdexec.Response{}); d < 200*time.Millisecond || d > 400*time.Millisecond {
+		t.Fatalf("Expected a jittered 400ms backoff, got %s", d)
+	}
+	if d := policy.Delay(10, cmdexec.Response{}); d < 500*time.Millisecond || d > time.Second {
+		t.Fatalf("Expected the backoff to be capped, got %s", d)
+	}
+
+	resp := cmdexec.Response{Header: http.Header{"Retry-After": {"1"}}}
+	if d := policy.Delay(1, resp); d != time.Second {
+		t.Fatalf("Expected Retry-After to be honoured, got %s", d)
+	}
+	resp.Header.Set("Retry-After", time.Now().Add(time.Hour).UTC().Format(http.TimeFormat))
+	if d := policy.Delay(1, resp); d != time.Second {
+		t.Fatalf("Expected Retry-After to be capped by the maximum backoff, got %s", d)
+	}
+}
+
+func TestRetryOutput(t *testing.T) {
+	server, _ := flakyServer(1)
+	defer server.Close()
+
+	parsed, err := parser.NewLama2Parser().Parse("@retry 2\n@retry-backoff 1ms\nGET " + server.URL + "\n")
+	if err != nil {
+		t.Fatalf("Error on parsing: %v", err)
+	}
+	out := filepath.Join(t.TempDir(), "out.json")
+	if _, err := controller.HandleParsedFile(context.Background(), parsed, &lama2cmd.Opts{Quiet: true, Output: out}, "."); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	written, _ := os.ReadFile(out)
+	if !strings.Contains(string(written), `"attempts":[{"attempt":1,`) || !strings.Contains(string(written), `"status":503`) {
+		t.Fatalf("Expected the attempts in the output file, got %s", written)
+	}
+}
@@ -0,0 +1,64 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	controller "github.com/HexmosTech/lama2/controller"
+	"github.com/HexmosTech/lama2/lama2cmd"
+	"github.com/HexmosTech/lama2/parser"
+)
+
+func TestSession(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			http.SetCookie(w, &http.Cookie{Name: "sid", Value: "s1", Path: "/"})
+			fmt.Fprint(w, `{"token": "t0k3n"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"auth": %q, "cookie": %q}`, r.Header.Get("Authorization"), r.Header.Get("Cookie"))
+	}))
+	defer server.Close()
+
+	root := t.TempDir()
+	dir := filepath.Join(root, "apis")
+	os.MkdirAll(dir, 0o755)
+	os.WriteFile(filepath.Join(root, "l2config.env"), []byte(""), 0o644)
+	run := func(api string) []controller.StageResult {
+		parsed, err := parser.NewLama2Parser().Parse(api)
+		if err != nil {
+			t.Fatalf("Error on parsing: %v", err)
+		}
+		results, err := controller.RunParsedFileWithVars(context.Background(), parsed, &lama2cmd.Opts{Quiet: true, Session: "dev"}, dir, nil)
+		if err != nil || controller.TestsFailed(results) {
+			t.Fatalf("Unexpected failure: %v, %+v", err, results)
+		}
+		return results
+	}
+
+	run("@name login\nGET " + server.URL + "/login\n\n---\n\nl2.session.set(\"TOKEN\", result.token)\nl2.session.set(\"LIMITS\", {max: 2})\n")
+	if _, err := os.Stat(filepath.Join(root, ".lama2", "sessions", "dev.json")); err != nil {
+		t.Fatalf("Expected the session file in the project root: %v", err)
+	}
+
+	results := run("GET " + server.URL + "/me\nAuthorization: 'Bearer ${TOKEN}'\nX-Limits: '${LIMITS}'\n\n---\n\n" +
+		"l2.test(\"session\", () => {\n" +
+		"  expect(result.auth).toBe(\"Bearer t0k3n\")\n" +
+		"  expect(result.cookie).toBe(\"sid=s1\")\n" +
+		"  expect(l2.session.get(\"LIMITS\").max).toBe(2)\n" +
+		"  expect(l2.session.response(\"login\").status).toBe(200)\n" +
+		"})\n")
+	if got := results[1].Response.Request.Headers.Get("X-Limits"); got != `{"max":2}` {
+		t.Fatalf("Expected non-string session values to expand as JSON, got %s", got)
+	}
+
+	_, err := controller.SessionPath(dir, "../escape")
+	if err == nil {
+		t.Fatalf("Expected an error for a session name with a path")
+	}
+}
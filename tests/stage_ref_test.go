@@ -0,0 +1,57 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	controller "github.com/HexmosTech/lama2/controller"
+	"github.com/HexmosTech/lama2/lama2cmd"
+	"github.com/HexmosTech/lama2/parser"
+)
+
+func TestStageReferences(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/login" {
+			w.Header().Set("X-Request-Id", "req-1")
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(`{"token": "t0k3n", "user": {"id": 7, "roles": ["admin", "dev"]}}`))
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprintf(w, `{"path": %q, "auth": %q, "body": %s}`, r.URL.Path, r.Header.Get("Authorization"), body)
+	}))
+	defer server.Close()
+
+	api := "@name login\nPOST " + server.URL + "/login\n\n{}\n\n---\n\nconsole.log('logged in')\n\n---\n\n" +
+		"POST " + server.URL + "/users/${login.response.body.user.id}\nAuthorization: 'Bearer ${login.response.body.token}'\n\n" +
+		"{\"roles\": ${login.response.body.user.roles}, \"first\": \"${login.response.body.user.roles[0]}\", \"status\": ${login.response.status}, \"trace\": \"${login.response.headers.x-request-id}\", \"none\": \"${login.response.body.missing}\"}\n"
+	parsed, err := parser.NewLama2Parser().Parse(api)
+	if err != nil {
+		t.Fatalf("Error on parsing: %v", err)
+	}
+	results, err := controller.RunParsedFileWithVars(context.Background(), parsed, &lama2cmd.Opts{Quiet: true}, t.TempDir(), nil)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	want := `{"path": "/users/7", "auth": "Bearer t0k3n", "body": {"first":"admin","none":"","roles":["admin","dev"],"status":201,"trace":"req-1"}}`
+	if body := controller.LastResponse(results).Body; body != want {
+		t.Errorf("Expected %s, got %s", want, body)
+	}
+
+	// The references are only checked once the stage has run;
+	// a missing value is still reported
+	parsed, _ = parser.NewLama2Parser().Parse(api)
+	_, err = controller.RunParsedFileWithVars(context.Background(), parsed, &lama2cmd.Opts{Quiet: true, Strict: true}, t.TempDir(), nil)
+	if err == nil {
+		t.Fatalf("Expected the missing value to be reported")
+	}
+	want = "${login.response.body.missing} in body"
+	if msg := err.Error(); !strings.Contains(msg, want) || strings.Contains(msg, "body.token") {
+		t.Errorf("Expected only %s to be reported, got %s", want, msg)
+	}
+}
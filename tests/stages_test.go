@@ -0,0 +1,108 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	controller "github.com/HexmosTech/lama2/controller"
+	"github.com/HexmosTech/lama2/lama2cmd"
+	"github.com/HexmosTech/lama2/parser"
+)
+
+const stagedL2 = `@name login
+POST %[1]s/login
+user=lama
+---
+TOKEN = result.token
+---
+@name query
+GET %[1]s/query?token=${TOKEN}
+---
+console.log("done")
+---
+GET %[1]s/last
+`
+
+func TestSelectStages(t *testing.T) {
+	p := parser.NewLama2Parser()
+	parsed, e := p.Parse(fmt.Sprintf(stagedL2, "http://localhost"))
+	if e != nil {
+		t.Fatalf("Error on parsing: %v", e)
+	}
+	blocks := controller.GetParsedAPIBlocks(parsed)
+
+	cases := map[string][]int{
+		"":        {1, 2, 3},
+		"2":       {2},
+		"query":   {2},
+		"1,last":  nil,
+		"2-3":     {2, 3},
+		"2-":      {2, 3},
+		"login,3": {1, 3},
+	}
+	for spec, want := range cases {
+		selected, last, err := controller.SelectStages(blocks, spec)
+		if want == nil {
+			if err == nil {
+				t.Errorf("Expected error for stage spec %q", spec)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("Unexpected error for stage spec %q: %v", spec, err)
+			continue
+		}
+		got := make(map[int]bool)
+		for _, n := range want {
+			got[n] = true
+		}
+		if !reflect.DeepEqual(selected, got) || last != want[len(want)-1] {
+			t.Errorf("Stage spec %q: expected %v, got %v (last %d)", spec, want, selected, last)
+		}
+	}
+}
+
+func TestStageReplayFromPersistedRun(t *testing.T) {
+	hits := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits = append(hits, r.URL.RequestURI())
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"token": "abc"}`)
+	}))
+	defer server.Close()
+
+	dir := t.TempDir()
+	fpath := filepath.Join(dir, "staged.l2")
+	content := fmt.Sprintf(stagedL2, server.URL)
+	os.WriteFile(fpath, []byte(content), 0o644)
+
+	run := func(args ...string) {
+		opts := lama2cmd.GetAndValidateCmd(append(append([]string{"l2"}, args...), fpath))
+		p := parser.NewLama2Parser()
+		parsed, e := p.Parse(content)
+		if e != nil {
+			t.Fatalf("Error on parsing: %v", e)
+		}
+		controller.HandleParsedFile(context.Background(), parsed, opts, dir)
+	}
+
+	run("--persist")
+	if len(hits) != 3 {
+		t.Fatalf("Expected all 3 stages to run, got %v", hits)
+	}
+	if _, err := os.Stat(controller.RunStatePath(fpath)); err != nil {
+		t.Fatalf("Expected persisted run at %s", controller.RunStatePath(fpath))
+	}
+
+	hits = hits[:0]
+	run("--persist", "--stage", "query")
+	if !reflect.DeepEqual(hits, []string{"/query?token=abc"}) {
+		t.Fatalf("Expected only the query stage with replayed token, got %v", hits)
+	}
+}
@@ -0,0 +1,154 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	controller "github.com/HexmosTech/lama2/controller"
+	"github.com/HexmosTech/lama2/lama2cmd"
+	"github.com/HexmosTech/lama2/parser"
+	"github.com/HexmosTech/lama2/preprocess"
+	"github.com/HexmosTech/lama2/utils"
+)
+
+func TestStrictPreflight(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte(`{}`))
+	}))
+	defer server.Close()
+
+	// LATER may be set by the processor block, so it's only
+	// checked once the second request is about to be sent
+	api := "GET " + server.URL + "/${PATH_A}\n\n---\n\nlet LATER = 'x'\n\n---\n\nPOST " + server.URL + "/${LATER}\nAuthorization: 'Bearer ${TOKEN}'\n\n{\"id\": \"${ID}\", \"name\": \"${NAME}\"}\n"
+	parsed, err := parser.NewLama2Parser().Parse(api)
+	if err != nil {
+		t.Fatalf("Error on parsing: %v", err)
+	}
+	vars := map[string]string{"NAME": "lama"}
+
+	_, err = controller.RunParsedFileWithVars(context.Background(), parsed, &lama2cmd.Opts{Quiet: true, Strict: true}, t.TempDir(), vars)
+	var unresolved *controller.UnresolvedError
+	if !errors.As(err, &unresolved) || utils.ExitCode(err) != utils.ExitVariable {
+		t.Fatalf("Expected an unresolved variable error, got %v", err)
+	}
+	if hits != 0 {
+		t.Errorf("Expected nothing to be sent, got %d requests", hits)
+	}
+	want := []controller.UnresolvedVar{
+		{UnresolvedRef: preprocess.UnresolvedRef{Name: "PATH_A", Field: "url"}, Block: 1, Line: 1},
+		{UnresolvedRef: preprocess.UnresolvedRef{Name: "TOKEN", Field: "header `Authorization`"}, Block: 3, Line: 9},
+		{UnresolvedRef: preprocess.UnresolvedRef{Name: "ID", Field: "body"}, Block: 3, Line: 9},
+	}
+	if len(unresolved.Vars) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, unresolved.Vars)
+	}
+	for i := range want {
+		if unresolved.Vars[i] != want[i] {
+			t.Errorf("Expected %+v, got %+v", want[i], unresolved.Vars[i])
+		}
+	}
+
+	// Without --strict, the requests go out with empty strings
+	if _, err := controller.RunParsedFileWithVars(context.Background(), parsed, &lama2cmd.Opts{Quiet: true}, t.TempDir(), vars); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if hits != 2 {
+		t.Errorf("Expected 2 requests, got %d", hits)
+	}
+}
+
+func TestStrictAfterProcessor(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+		w.Write([]byte(`{"id": 7}`))
+	}))
+	defer server.Close()
+
+	// MISSING would only be set for larger ids
+	api := "GET " + server.URL + "\n\n---\n\nlet ID = result.id\nif (ID > 100) { globalThis.MISSING = 'x' }\n\n---\n\nGET " + server.URL + "/${ID}/${MISSING}\n"
+	parsed, err := parser.NewLama2Parser().Parse(api)
+	if err != nil {
+		t.Fatalf("Error on parsing: %v", err)
+	}
+	// Strict mode may also come from the env files
+	vars := map[string]string{"L2_STRICT": "true"}
+	results, err := controller.RunParsedFileWithVars(context.Background(), parsed, &lama2cmd.Opts{Quiet: true}, t.TempDir(), vars)
+	var unresolved *controller.UnresolvedError
+	if !errors.As(err, &unresolved) || len(unresolved.Vars) != 1 || unresolved.Vars[0].Name != "MISSING" {
+		t.Fatalf("Expected MISSING to be reported, got %v", err)
+	}
+	var execErr *utils.ExecError
+	if !errors.As(err, &execErr) || execErr.Block != 3 || execErr.Line != 10 {
+		t.Errorf("Expected the error to point at block 3, line 10, got %v", err)
+	}
+	if hits != 1 || len(results) != 3 {
+		t.Errorf("Expected only the first request to be sent, got %d requests, %+v", hits, results)
+	}
+
+	vars["L2_STRICT"] = "sometimes"
+	if _, err := controller.RunParsedFileWithVars(context.Background(), parsed, &lama2cmd.Opts{Quiet: true}, t.TempDir(), vars); err == nil {
+		t.Errorf("Expected an error for an invalid L2_STRICT")
+	}
+}
+
+func TestStrictBareName(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer server.Close()
+
+	// `$gt` isn't named like a variable, so it's sent as is
+	parsed, err := parser.NewLama2Parser().Parse("POST " + server.URL + "\nAuthorization: 'Bearer $TOKEN'\n\n{\"$gt\": 1}\n")
+	if err != nil {
+		t.Fatalf("Error on parsing: %v", err)
+	}
+	_, err = controller.RunParsedFileWithVars(context.Background(), parsed, &lama2cmd.Opts{Quiet: true, Strict: true}, t.TempDir(), nil)
+	var unresolved *controller.UnresolvedError
+	if !errors.As(err, &unresolved) || len(unresolved.Vars) != 1 || unresolved.Vars[0].Name != "TOKEN" {
+		t.Fatalf("Expected TOKEN to be reported, got %v", err)
+	}
+	if hits != 0 {
+		t.Errorf("Expected nothing to be sent, got %d requests", hits)
+	}
+}
+
+func TestStrictPreflightAssignments(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&hits, 1)
+	}))
+	defer server.Close()
+
+	// TOKEN is only mentioned in a comment, and LATE is set
+	// after the request using it
+	api := "// TOKEN comes from the env file\nlet {ID} = {ID: 1}\nglobalThis.HOST_A = 'a'\nl2.session && l2.session.set('SID', 's')\n\n---\n\n" +
+		"GET " + server.URL + "/${ID}/${HOST_A}/${SID}/${LATE}\nAuthorization: 'Bearer ${TOKEN}'\n\n---\n\nlet LATE = 'x'\n"
+	parsed, err := parser.NewLama2Parser().Parse(api)
+	if err != nil {
+		t.Fatalf("Error on parsing: %v", err)
+	}
+	_, err = controller.RunParsedFileWithVars(context.Background(), parsed, &lama2cmd.Opts{Quiet: true, Strict: true}, t.TempDir(), nil)
+	var unresolved *controller.UnresolvedError
+	if !errors.As(err, &unresolved) {
+		t.Fatalf("Expected an unresolved variable error, got %v", err)
+	}
+	got := make([]string, 0)
+	for _, v := range unresolved.Vars {
+		got = append(got, v.Name)
+	}
+	if strings.Join(got, ",") != "LATE,TOKEN" {
+		t.Errorf("Expected LATE and TOKEN to be reported, got %v", got)
+	}
+	if hits != 0 {
+		t.Errorf("Expected nothing to be sent, got %d requests", hits)
+	}
+}
@@ -0,0 +1,141 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	controller "github.com/HexmosTech/lama2/controller"
+	"github.com/HexmosTech/lama2/lama2cmd"
+	"github.com/HexmosTech/lama2/parser"
+	"github.com/HexmosTech/lama2/utils"
+)
+
+// slowServer answers `/slow` after two seconds (or when
+// the client gives up) and everything else right away
+func slowServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			select {
+			case <-time.After(2 * time.Second):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		fmt.Fprint(w, `{"path": "`+r.URL.Path+`"}`)
+	}))
+}
+
+func TestParseTimeout(t *testing.T) {
+	cases := map[string]time.Duration{"": 0, "2": 2 * time.Second, "1.5": 1500 * time.Millisecond, "250ms": 250 * time.Millisecond}
+	for spec, want := range cases {
+		if got, err := controller.ParseTimeout(spec); err != nil || got != want {
+			t.Fatalf("ParseTimeout(%q) = %v, %v; want %v", spec, got, err, want)
+		}
+	}
+	for _, spec := range []string{"soon", "-5", "0", "NaN", "Inf", "-1s", "1e300"} {
+		if _, err := controller.ParseTimeout(spec); err == nil {
+			t.Fatalf("Expected an error for the invalid timeout %q", spec)
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	server := slowServer()
+	defer server.Close()
+
+	start := time.Now()
+	_, err := runL2(t, "GET "+server.URL+"/slow\n", &lama2cmd.Opts{Quiet: true, Timeout: "100ms"}, nil)
+	expectExecError(t, err, utils.KindTransport, 1, 1)
+	if !errors.Is(err, context.DeadlineExceeded) || !strings.Contains(err.Error(), "timed out after 100ms") {
+		t.Fatalf("Expected a timeout error, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Expected the request to be abandoned after the timeout")
+	}
+
+	_, err = runL2(t, "@timeout 0.1\nGET "+server.URL+"/slow\n", &lama2cmd.Opts{Quiet: true}, nil)
+	expectExecError(t, err, utils.KindTransport, 1, 1)
+
+	results, err := runL2(t, "@timeout 5s\nGET "+server.URL+"/fast\n", &lama2cmd.Opts{Quiet: true, Timeout: "1ms"}, nil)
+	if err != nil || results[1].Response.StatusCode != 200 {
+		t.Fatalf("Expected @timeout to override --timeout, got %v", err)
+	}
+}
+
+func TestTimeoutPerAttempt(t *testing.T) {
+	var hits int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&hits, 1) == 1 {
+			<-r.Context().Done()
+			return
+		}
+		fmt.Fprint(w, `{}`)
+	}))
+	defer server.Close()
+
+	// The first try hangs until its own deadline; the retry
+	// gets a full timeout of its own
+	results, err := runL2(t, "@timeout 200ms\n@retry 2\n@retry-backoff 10ms\nGET "+server.URL+"\n", &lama2cmd.Opts{Quiet: true}, nil)
+	if err != nil {
+		t.Fatalf("Expected the retry to succeed, got %v", err)
+	}
+	attempts := results[1].Response.Attempts
+	if len(attempts) != 2 || !strings.Contains(attempts[0].Error, "timed out after 200ms") || attempts[1].Status != 200 {
+		t.Errorf("Expected a timed out try followed by a successful one, got %+v", attempts)
+	}
+}
+
+func TestCancelRun(t *testing.T) {
+	server := slowServer()
+	defer server.Close()
+
+	api := "GET " + server.URL + "/fast\n\n---\n\nconsole.log(response.status)\n\n---\n\nGET " + server.URL + "/slow\n"
+	parsed, err := parser.NewLama2Parser().Parse(api)
+	if err != nil {
+		t.Fatalf("Error on parsing: %v", err)
+	}
+	out := filepath.Join(t.TempDir(), "out.json")
+	o := &lama2cmd.Opts{Quiet: true, Output: out}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(300*time.Millisecond, cancel)
+
+	start := time.Now()
+	results, err := controller.HandleParsedFile(ctx, parsed, o, ".")
+	if !errors.Is(err, context.Canceled) || utils.ExitCode(err) != utils.ExitInterrupted {
+		t.Fatalf("Expected the run to be cancelled, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatalf("Expected the request in flight to be abandoned")
+	}
+	if len(results) != 2 || results[1].Response.StatusCode != 200 {
+		t.Fatalf("Expected the partial results, got %+v", results)
+	}
+	written, err := os.ReadFile(out)
+	if err != nil || !strings.Contains(string(written), "/fast") {
+		t.Fatalf("Expected the last response in the output file, got %s (%v)", written, err)
+	}
+
+	ctx, cancel = context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	_, err = runL2Context(t, ctx, "GET "+server.URL+"/fast\n\n---\n\nwhile (true) {}\n")
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("Expected the processor block to be interrupted, got %v", err)
+	}
+}
+
+func runL2Context(t *testing.T, ctx context.Context, api string) ([]controller.StageResult, error) {
+	parsed, err := parser.NewLama2Parser().Parse(api)
+	if err != nil {
+		t.Fatalf("Error on parsing: %v", err)
+	}
+	return controller.RunParsedFileWithVars(ctx, parsed, &lama2cmd.Opts{Quiet: true}, ".", nil)
+}
@@ -1,6 +1,10 @@
 package utils
 
-import "fmt"
+import (
+	"context"
+	"errors"
+	"fmt"
+)
 
 type ParseError struct {
 	Pos     int
@@ -20,3 +24,125 @@ func NewParseError(pos int, line int, msg string, args []string) *ParseError {
 func (p ParseError) Error() string {
 	return fmt.Sprintf("%s at position %d, line %d", fmt.Sprintf(p.msg, p.args...), p.Pos, p.LineNum)
 }
+
+// ErrorKind classifies the errors raised while running
+// an API file. Each kind maps to its own exit code
+type ErrorKind int
+
+const (
+	// KindParse: the API file (or a data file it needs)
+	// couldn't be read or parsed
+	KindParse ErrorKind = iota + 1
+	// KindVariable: variables couldn't be expanded into
+	// a request block
+	KindVariable
+	// KindTransport: the request couldn't be built, sent,
+	// or its response read
+	KindTransport
+	// KindScript: a JS processor block threw an error
+	KindScript
+	// KindAssertion: one or more `expect()`/`l2.test()`
+	// checks failed
+	KindAssertion
+)
+
+// Exit codes of `l2`, one per ErrorKind. ExitFailure is the
+// code of every other error (such as invalid options). A run
+// interrupted with Ctrl-C exits with 130, as shells do
+const (
+	ExitOK        = 0
+	ExitFailure   = 1
+	ExitParse     = 2
+	ExitVariable  = 3
+	ExitTransport = 4
+	ExitScript    = 5
+	ExitAssertion = 6
+
+	ExitInterrupted = 130
+)
+
+func (k ErrorKind) String() string {
+	switch k {
+	case KindParse:
+		return "parse"
+	case KindVariable:
+		return "variable"
+	case KindTransport:
+		return "transport"
+	case KindScript:
+		return "script"
+	case KindAssertion:
+		return "assertion"
+	}
+	return "unknown"
+}
+
+// ExitCode is the process exit code for the kind
+func (k ErrorKind) ExitCode() int {
+	switch k {
+	case KindParse:
+		return ExitParse
+	case KindVariable:
+		return ExitVariable
+	case KindTransport:
+		return ExitTransport
+	case KindScript:
+		return ExitScript
+	case KindAssertion:
+		return ExitAssertion
+	}
+	return ExitFailure
+}
+
+// ExecError is an error raised while running an API
+// file, tagged with its kind and, when known, the block
+// (1-based, counting processor and requester blocks)
+// and source line it comes from
+type ExecError struct {
+	Kind  ErrorKind
+	Block int
+	Line  int
+	Err   error
+}
+
+// NewExecError wraps `err` as an ExecError of the given kind
+func NewExecError(kind ErrorKind, block int, line int, err error) *ExecError {
+	return &ExecError{Kind: kind, Block: block, Line: line, Err: err}
+}
+
+func (e *ExecError) Error() string {
+	location := ""
+	if e.Block > 0 {
+		location = fmt.Sprintf(" in block %d", e.Block)
+	}
+	if e.Line > 0 {
+		location += fmt.Sprintf(" (line %d)", e.Line)
+	}
+	return fmt.Sprintf("%s error%s: %s", e.Kind, location, e.Err.Error())
+}
+
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+// ExitCode returns the process exit code for `err`:
+// ExitOK for nil, ExitInterrupted for a cancelled run, the
+// kind's code for an ExecError (or ExitParse for a
+// ParseError), ExitFailure otherwise
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitOK
+	}
+	if errors.Is(err, context.Canceled) {
+		return ExitInterrupted
+	}
+	var execErr *ExecError
+	if errors.As(err, &execErr) {
+		return execErr.Kind.ExitCode()
+	}
+	var parseErr *ParseError
+	if errors.As(err, &parseErr) {
+		return ExitParse
+	}
+	return ExitFailure
+}
@@ -110,6 +110,39 @@ func UnicodeCategory(r rune) string {
 	return "Cn"
 }
 
+// FlattenHeader reduces response headers to the single
+// values of `httpie.ExResponse`. The values of a header are
+// joined by commas (RFC 9110, section 5.3), except those of
+// Set-Cookie, which can't be combined and are kept one per
+// line instead (see UnflattenHeader)
+func FlattenHeader(header http.Header) map[string]string {
+	flat := make(map[string]string, len(header))
+	for name, values := range header {
+		sep := ", "
+		if http.CanonicalHeaderKey(name) == "Set-Cookie" {
+			sep = "\n"
+		}
+		flat[name] = strings.Join(values, sep)
+	}
+	return flat
+}
+
+// UnflattenHeader restores headers flattened by
+// FlattenHeader, with each Set-Cookie as its own value
+func UnflattenHeader(flat map[string]string) http.Header {
+	header := make(http.Header, len(flat))
+	for name, value := range flat {
+		if http.CanonicalHeaderKey(name) == "Set-Cookie" {
+			for _, v := range strings.Split(value, "\n") {
+				header.Add(name, v)
+			}
+			continue
+		}
+		header.Add(name, value)
+	}
+	return header
+}
+
 // GetFilePathComponent returns absolute path, directory,
 // and filename given a filepath
 func GetFilePathComponents(name string) (string, string, string) {